@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/cvanloo/go-fedi-info/admin"
+)
+
+// adminAuthorizer guards the admin endpoints. If it is still nil when the
+// server starts, a static token from ADMIN_TOKEN is used. To plug in another
+// mechanism, set it from an init function in a file of your own.
+var adminAuthorizer admin.Authorizer
+
+// RequireAdmin only lets requests through that adminAuthorizer accepts.
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin.Require(adminAuthorizer, next).ServeHTTP(w, r)
+	})
+}
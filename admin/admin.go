@@ -0,0 +1,112 @@
+// Package admin guards the endpoints of fedinfo that change its state or are
+// expensive to serve, so that only operators can use them. The check is
+// delegated to an Authorizer, to integrate with existing authentication,
+// e.g. JWTs or mTLS client certificates.
+package admin
+
+import (
+	"log/slog"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Authorizer decides whether a request may use the admin endpoints.
+type Authorizer interface {
+	Authorize(r *http.Request) (bool, error)
+}
+
+// ErrDisabled is returned by an Authorizer to signal that the admin
+// endpoints are turned off altogether.
+var ErrDisabled = errors.New("admin endpoints are disabled")
+
+// StaticToken accepts requests presenting Token as a bearer token. If Token
+// is empty, the admin endpoints are disabled.
+type StaticToken struct {
+	Token string
+}
+
+func (a StaticToken) Authorize(r *http.Request) (bool, error) {
+	if a.Token == "" {
+		return false, ErrDisabled
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1, nil
+}
+
+// ErrForbidden is returned by Check if the admin endpoints are disabled.
+type ErrForbidden string
+
+func (e ErrForbidden) Error() string {
+	return string(e)
+}
+
+func (e ErrForbidden) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	status := http.StatusForbidden
+	http.Error(w, e.Error(), status)
+	return true
+}
+
+func (e ErrForbidden) StatusCode() int {
+	return http.StatusForbidden
+}
+
+// ErrUnauthorized is returned by Check for requests the Authorizer rejected.
+type ErrUnauthorized struct{}
+
+func (e ErrUnauthorized) Error() string {
+	return http.StatusText(http.StatusUnauthorized)
+}
+
+func (e ErrUnauthorized) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, e.Error(), http.StatusUnauthorized)
+	return true
+}
+
+func (e ErrUnauthorized) StatusCode() int {
+	return http.StatusUnauthorized
+}
+
+// Check returns nil if authorizer accepts r, ErrForbidden if the admin
+// endpoints are disabled, which they are if authorizer is nil, and
+// ErrUnauthorized if r is rejected. Other errors come from the authorizer.
+func Check(authorizer Authorizer, r *http.Request) error {
+	if authorizer == nil {
+		return ErrForbidden(ErrDisabled.Error())
+	}
+	ok, err := authorizer.Authorize(r)
+	if errors.Is(err, ErrDisabled) {
+		return ErrForbidden(err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUnauthorized{}
+	}
+	return nil
+}
+
+// Require only lets requests through to next that authorizer accepts, see
+// Check.
+func Require(authorizer Authorizer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := Check(authorizer, r)
+		var forbidden ErrForbidden
+		var unauthorized ErrUnauthorized
+		switch {
+		case err == nil:
+			next.ServeHTTP(w, r)
+		case errors.As(err, &forbidden):
+			forbidden.RespondError(w, r)
+		case errors.As(err, &unauthorized):
+			unauthorized.RespondError(w, r)
+		default:
+			slog.Error("failed to authorize admin request", "error", err)
+			status := http.StatusInternalServerError
+			http.Error(w, http.StatusText(status), status)
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type failingAuthorizer struct{}
+
+func (failingAuthorizer) Authorize(r *http.Request) (bool, error) {
+	return false, errors.New("key server unreachable")
+}
+
+func TestRequire(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, test := range []struct {
+		name string
+		authorizer Authorizer
+		token string
+		want int
+	}{
+		{"unset", nil, "secret", http.StatusForbidden},
+		{"disabled", StaticToken{}, "", http.StatusForbidden},
+		{"missing token", StaticToken{Token: "secret"}, "", http.StatusUnauthorized},
+		{"wrong token", StaticToken{Token: "secret"}, "guess", http.StatusUnauthorized},
+		{"valid token", StaticToken{Token: "secret"}, "secret", http.StatusOK},
+		{"failing authorizer", failingAuthorizer{}, "secret", http.StatusInternalServerError},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/refresh-all", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		Require(test.authorizer, next).ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: missing WWW-Authenticate challenge", test.name)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// badgeColors are the colors of the software families, mostly taken from
+// their logos. Others are shown in badgeDefaultColor.
+var badgeColors = map[string]string{
+	"mastodon": "#6364ff",
+	"misskey": "#86b300",
+	"pleroma": "#fba457",
+	"lemmy": "#00bc8c",
+	"peertube": "#f1680d",
+	"pixelfed": "#6366f1",
+	"friendica": "#1872a2",
+	"gotosocial": "#df8958",
+	"writefreely": "#1a1a1a",
+}
+
+const (
+	badgeDefaultColor = "#007ec6"
+	badgeUnknownColor = "#9f9f9f"
+	badgeLabelColor = "#555"
+	// badgeMaxLength truncates overly long versions, so that a badge can't
+	// be made arbitrarily wide.
+	badgeMaxLength = 32
+)
+
+var hexColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// parseBadgeColors parses a comma separated list of software=color pairs,
+// e.g. mastodon=#563acc,sharkey=#a7d11e.
+func parseBadgeColors(value string) (map[string]string, error) {
+	colors := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		software, color, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || software == "" {
+			return nil, fmt.Errorf("expected software=color: %s", pair)
+		}
+		if !strings.HasPrefix(color, "#") {
+			color = "#" + color
+		}
+		if !hexColor.MatchString(color) {
+			return nil, fmt.Errorf("expected a hex color: %s", color)
+		}
+		colors[strings.ToLower(software)] = color
+	}
+	return colors, nil
+}
+
+func badgeColor(software string) string {
+	name := strings.ToLower(strings.TrimSpace(software))
+	if color, ok := badgeColors[name]; ok {
+		return color
+	}
+	if color, ok := badgeColors[softwareFamily(name)]; ok {
+		return color
+	}
+	return badgeDefaultColor
+}
+
+// Badge is also the response of format=json, which follows the schema of
+// shields.io endpoint badges, to restyle the badge through shields.io.
+type Badge struct {
+	SchemaVersion int `json:"schemaVersion"`
+	Label string `json:"label"`
+	Message string `json:"message"`
+	Color string `json:"color"`
+}
+
+// badgeRoute renders a badge with the software and version of an instance,
+// e.g. "mastodon | 4.3.1", to embed in web pages. Instances that can't be
+// looked up get an "unknown" badge rather than an error, which would only
+// show up as a broken image.
+func badgeRoute(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	domain := r.Form.Get("domain")
+	if domain == "" {
+		return ErrMissingParam("domain")
+	}
+	domain, _, err := parseDomainParam(domain)
+	if err != nil {
+		return err
+	}
+	badge := Badge{SchemaVersion: 1, Label: "software", Message: "unknown", Color: badgeUnknownColor}
+	info, err := client.Lookup(r.Context(), domain)
+	if err == nil && info.Software.IsResolved() {
+		badge.Label = truncateBadgeText(strings.ToLower(info.Software.Name))
+		badge.Message = truncateBadgeText(displayVersion(info.Software.Version))
+		if badge.Message == "" {
+			badge.Message = "unknown"
+		}
+		badge.Color = badgeColor(info.Software.Name)
+	}
+	h := w.Header()
+	h.Add("Vary", "Accept")
+	if err != nil || !info.Software.IsResolved() {
+		// look again soon, the instance might just be down
+		h.Set("Cache-Control", "public, max-age=300")
+	} else {
+		h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, stale-while-revalidate=86400", int(cache.TTL.Seconds())))
+	}
+	if wantsBadgeJSON(r) {
+		h.Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(badge)
+	}
+	h.Set("Content-Type", "image/svg+xml")
+	_, err = w.Write(badge.SVG())
+	return err
+}
+
+// wantsBadgeJSON reports whether the client asked for the badge as json,
+// either via format=json or the Accept header, rather than svg.
+func wantsBadgeJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "image/svg+xml", "image/*", "*/*":
+			return false
+		case "application/json":
+			return true
+		}
+	}
+	return false
+}
+
+func truncateBadgeText(text string) string {
+	if runes := []rune(text); len(runes) > badgeMaxLength {
+		return string(runes[:badgeMaxLength-1]) + "…"
+	}
+	return text
+}
+
+// SVG renders the badge in the flat style of shields.io.
+func (badge Badge) SVG() []byte {
+	const padding = 6
+	labelWidth := badgeTextWidth(badge.Label) + 2*padding
+	messageWidth := badgeTextWidth(badge.Message) + 2*padding
+	width := labelWidth + messageWidth
+	label, message := html.EscapeString(badge.Label), html.EscapeString(badge.Message)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">`, width, label, message)
+	fmt.Fprintf(&b, `<title>%s: %s</title>`, label, message)
+	b.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	fmt.Fprintf(&b, `<clipPath id="r"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath>`, width)
+	fmt.Fprintf(&b, `<g clip-path="url(#r)"><rect width="%d" height="20" fill="%s"/><rect x="%d" width="%d" height="20" fill="%s"/><rect width="%d" height="20" fill="url(#s)"/></g>`,
+		labelWidth, badgeLabelColor, labelWidth, messageWidth, html.EscapeString(badge.Color), width)
+	b.WriteString(`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`)
+	for _, text := range []struct {
+		x int
+		s string
+	}{{labelWidth / 2, label}, {labelWidth + messageWidth/2, message}} {
+		fmt.Fprintf(&b, `<text x="%d" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%d" y="14">%s</text>`, text.x, text.s, text.x, text.s)
+	}
+	b.WriteString(`</g></svg>`)
+	return []byte(b.String())
+}
+
+// badgeTextWidth estimates the width of text in pixels, set in 11px
+// Verdana. It doesn't need to be exact, the text is centered.
+func badgeTextWidth(text string) int {
+	width := 0
+	for _, c := range text {
+		switch {
+		case strings.ContainsRune("ijlt.,:;|!'() ", c):
+			width += 4
+		case strings.ContainsRune("mwMW@%", c):
+			width += 11
+		case c >= 'A' && c <= 'Z':
+			width += 8
+		default:
+			width += 7
+		}
+	}
+	return width
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseBadgeColors(t *testing.T) {
+	colors, err := parseBadgeColors("Sharkey=#a7d11e, mastodon=563acc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if colors["sharkey"] != "#a7d11e" || colors["mastodon"] != "#563acc" {
+		t.Errorf("got %v", colors)
+	}
+	for _, invalid := range []string{"sharkey", "=#fff", "sharkey=red", "sharkey=#12345"} {
+		if _, err := parseBadgeColors(invalid); err == nil {
+			t.Errorf("%q: got no error", invalid)
+		}
+	}
+}
+
+func TestWantsBadgeJSON(t *testing.T) {
+	for _, test := range []struct {
+		query, accept string
+		want bool
+	}{
+		{"", "", false},
+		{"?format=json", "", true},
+		{"?format=svg", "application/json", false},
+		{"", "application/json", true},
+		{"", "image/svg+xml, application/json", false},
+		{"", "text/html, application/json;q=0.9", true},
+		{"", "*/*", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/badge"+test.query, nil)
+		r.Header.Set("Accept", test.accept)
+		if got := wantsBadgeJSON(r); got != test.want {
+			t.Errorf("%q, Accept %q: got %v, want %v", test.query, test.accept, got, test.want)
+		}
+	}
+}
+
+func TestBadgeRoute(t *testing.T) {
+	useTestServer(t, fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+	})
+	for _, test := range []struct {
+		domain string
+		want Badge
+		cacheControl string
+	}{
+		{"example.test", Badge{SchemaVersion: 1, Label: "mastodon", Message: "4.3.2", Color: badgeColors["mastodon"]}, "public, max-age=3600, stale-while-revalidate=86400"},
+		{"missing.test", Badge{SchemaVersion: 1, Label: "software", Message: "unknown", Color: badgeUnknownColor}, "public, max-age=300"},
+	} {
+		w := httptest.NewRecorder()
+		HandlerWithError(badgeRoute).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/badge?format=json&domain="+test.domain, nil))
+		var badge Badge
+		if err := json.NewDecoder(w.Body).Decode(&badge); err != nil {
+			t.Fatalf("%s: %v", test.domain, err)
+		}
+		if badge != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.domain, badge, test.want)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != test.cacheControl {
+			t.Errorf("%s: got Cache-Control %q, want %q", test.domain, cc, test.cacheControl)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	HandlerWithError(badgeRoute).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/badge?domain=example.test", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "image/svg+xml" {
+		t.Errorf("got Content-Type %q, want image/svg+xml", ct)
+	}
+	if body := w.Body.String(); !strings.HasPrefix(body, "<svg") || !strings.Contains(body, "<title>mastodon: 4.3.2</title>") {
+		t.Errorf("got %s", body)
+	}
+}
+
+func TestBadgeSVGEscapes(t *testing.T) {
+	svg := string(Badge{Label: `<script>`, Message: truncateBadgeText(strings.Repeat("9", 100)), Color: "#fff"}.SVG())
+	if strings.Contains(svg, "<script>") || !strings.Contains(svg, "&lt;script&gt;") {
+		t.Errorf("label isn't escaped: %s", svg)
+	}
+	if !strings.Contains(svg, strings.Repeat("9", badgeMaxLength-1)+"…") || strings.Contains(svg, strings.Repeat("9", badgeMaxLength)) {
+		t.Errorf("message isn't truncated: %s", svg)
+	}
+}
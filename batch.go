@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+var (
+	// maxBatchSize caps the number of entries per batch request.
+	maxBatchSize = 500
+	// batchConcurrency bounds the number of lookups in flight per batch.
+	batchConcurrency = 8
+)
+
+// maxBatchBodyBytes caps the size of a batch request body, generously more
+// than maxBatchSize entries of the longest possible domain need.
+func maxBatchBodyBytes() int64 {
+	return int64(maxBatchSize) * 1024
+}
+
+type (
+	BatchRequest struct {
+		// Domains may also contain handles (user@domain), which are resolved
+		// to the software of their instance.
+		Domains []string `json:"domains"`
+	}
+	BatchEntry struct {
+		Query string `json:"query"`
+		Result *fedinfo.NodeInfo `json:"result,omitempty"`
+		Error *ErrorObject `json:"error,omitempty"`
+	}
+)
+
+// ErrRequestTooLarge is returned when a request body exceeds its limit.
+type ErrRequestTooLarge string
+
+func (e ErrRequestTooLarge) Error() string {
+	return string(e)
+}
+
+func (e ErrRequestTooLarge) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	status := http.StatusRequestEntityTooLarge
+	http.Error(w, e.Error(), status)
+	return true
+}
+
+func (e ErrRequestTooLarge) StatusCode() int {
+	return http.StatusRequestEntityTooLarge
+}
+
+// batchRoute looks up many domains at once. Each entry of the response
+// corresponds to the entry of the request at the same position, and carries
+// either the result or its own error, so that one failing instance doesn't
+// fail the whole batch. Every domain is looked up once, no matter how many
+// entries (e.g. handles) refer to it, and through the same cache as the
+// single lookups.
+func batchRoute(w http.ResponseWriter, r *http.Request) error {
+	var request BatchRequest
+	body := http.MaxBytesReader(w, r.Body, maxBatchBodyBytes())
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return ErrRequestTooLarge(fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+		}
+		return ErrBadRequest(fmt.Sprintf("invalid batch request: %v", err))
+	}
+	if len(request.Domains) > maxBatchSize {
+		return ErrBadRequest(fmt.Sprintf("too many domains, at most %d per batch", maxBatchSize))
+	}
+
+	entries := make([]BatchEntry, len(request.Domains))
+	entryDomains := make([]string, len(request.Domains))
+	var domains []string
+	for i, query := range request.Domains {
+		entries[i].Query = query
+		var domain string
+		var err error
+		if strings.Contains(strings.TrimPrefix(query, "@"), "@") {
+			_, domain, err = parseHandle(query)
+		} else {
+			domain, _, err = parseDomainParam(query)
+		}
+		if err != nil {
+			entries[i].Error = newErrorObject(err)
+			continue
+		}
+		entryDomains[i] = domain
+		if !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+
+	results := lookupAll(r.Context(), domains)
+	for _, result := range results {
+		if result.Result != nil {
+			stripOptionalFields(r, result.Result)
+		}
+	}
+	for i, domain := range entryDomains {
+		if domain != "" {
+			entries[i].Result = results[domain].Result
+			entries[i].Error = results[domain].Error
+		}
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Accept")
+	if wantsProtobuf(r) {
+		h.Set("Content-Type", protobufContentType)
+		_, err := w.Write(marshalBatchProto(entries))
+		return err
+	}
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		return err
+	}
+	return nil
+}
+
+// lookupAll looks up every domain through the cache, at most batchConcurrency
+// at a time, and returns the results by domain. Lookups that exceed the
+// client's MaxDuration count as successful, with a warning.
+func lookupAll(ctx context.Context, domains []string) map[string]BatchEntry {
+	results := make(map[string]BatchEntry, len(domains))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, batchConcurrency)
+	for _, domain := range domains {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			var result BatchEntry
+			info, err := client.Lookup(ctx, domain)
+			if errors.Is(err, fedinfo.ErrLookupTimeout) {
+				info.Warnings = append(slices.Clip(info.Warnings), err.Error())
+				err = nil
+			}
+			if err != nil {
+				result.Error = newErrorObject(err)
+			} else {
+				result.Result = &info
+			}
+			lock.Lock()
+			results[domain] = result
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postBatch sends body to the batch route.
+func postBatch(body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/node-info/batch", strings.NewReader(body))
+	HandlerWithError(batchRoute).ServeHTTP(w, r)
+	return w
+}
+
+func TestBatch(t *testing.T) {
+	counter := &hitCounter{next: fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+	}}
+	useTestServer(t, counter)
+	w := postBatch(`{"domains": ["example.test", "https://example.test/", "localhost", "example.test"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var entries []BatchEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("got %d entries, want one per query", len(entries))
+	}
+	for i, entry := range entries {
+		if i == 2 {
+			if entry.Result != nil || entry.Error == nil || entry.Error.Status != http.StatusBadRequest {
+				t.Errorf("%s: got %+v, want a bad request", entry.Query, entry)
+			}
+			continue
+		}
+		if entry.Error != nil || entry.Result == nil || entry.Result.Software.Name != "mastodon" {
+			t.Errorf("%s: got %+v, want the instance", entry.Query, entry)
+		}
+	}
+	if hits := counter.count("example.test/.well-known/nodeinfo"); hits != 1 {
+		t.Errorf("got %d upstream requests, want repeated domains looked up once", hits)
+	}
+}
+
+func TestBatchInvalidBody(t *testing.T) {
+	for _, body := range []string{``, `[]`, `{"domains": "example.test"}`} {
+		if w := postBatch(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	defer func(size int) { maxBatchSize = size }(maxBatchSize)
+	maxBatchSize = 3
+	w := postBatch(`{"domains": ["a.example.test", "b.example.test", "c.example.test", "d.example.test"]}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at most 3") {
+		t.Errorf("too many domains: got status %d: %s", w.Code, w.Body)
+	}
+	padding := strings.Repeat(" ", int(maxBatchBodyBytes()))
+	w = postBatch(`{"domains": ["a.example.test"]` + padding + `}`)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "3072 bytes") {
+		t.Errorf("large body: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestBatchHandles(t *testing.T) {
+	counter := &hitCounter{next: fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+	}}
+	useTestServer(t, counter)
+	queries := []string{"alice@example.test", "@bob@example.test", "example.test", "carol@", "dave@localhost"}
+	body, _ := json.Marshal(BatchRequest{Domains: queries})
+	w := postBatch(string(body))
+	var entries []BatchEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(queries) {
+		t.Fatalf("got %d entries, want one per query", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Query != queries[i] {
+			t.Errorf("entry %d: got query %s, want %s", i, entry.Query, queries[i])
+		}
+		wantResult := i < 3
+		if (entry.Result != nil && entry.Result.Software.Name == "mastodon") != wantResult || (entry.Error == nil) != wantResult {
+			t.Errorf("%s: got %+v, want result: %t", entry.Query, entry, wantResult)
+		}
+	}
+	if hits := counter.count("example.test/.well-known/nodeinfo"); hits != 1 {
+		t.Errorf("got %d upstream requests, want one per domain", hits)
+	}
+}
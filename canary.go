@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log/slog"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Canary periodically performs a real, uncached lookup of a known-good
+// domain to catch breakage of the lookup pipeline (DNS, certificate store,
+// upstream changes) before clients do.
+type Canary struct {
+	Domain string
+	Interval time.Duration
+	lock sync.RWMutex
+	status CanaryStatus
+}
+
+type CanaryStatus struct {
+	Domain string `json:"domain"`
+	Healthy bool `json:"healthy"`
+	LastCheck time.Time `json:"lastCheck,omitempty"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+	Successes int `json:"successes"`
+	Failures int `json:"failures"`
+}
+
+var canary *Canary
+
+func (c *Canary) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		c.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Canary) check(ctx context.Context) {
+	info, err := client.Resolve(ctx, c.Domain, false)
+	if err == nil && !info.Software.IsResolved() {
+		err = fmt.Errorf("%s: no software reported", c.Domain)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.status.Domain = c.Domain
+	c.status.LastCheck = time.Now()
+	c.status.Healthy = err == nil
+	if err != nil {
+		c.status.Failures++
+		c.status.LastError = err.Error()
+		slog.Warn("canary lookup failed", "domain", c.Domain, "error", err)
+	} else {
+		c.status.Successes++
+		c.status.LastSuccess = c.status.LastCheck
+		c.status.LastError = ""
+	}
+	observeCanary(c.status)
+}
+
+func (c *Canary) Status() CanaryStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.status
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+	Canary *CanaryStatus `json:"canary,omitempty"`
+}
+
+func healthRoute(w http.ResponseWriter, r *http.Request) error {
+	health := HealthResponse{
+		Status: "ok",
+	}
+	status := http.StatusOK
+	if canary != nil {
+		canaryStatus := canary.Status()
+		health.Canary = &canaryStatus
+		if !canaryStatus.Healthy && !canaryStatus.LastCheck.IsZero() {
+			health.Status = "degraded"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCanaryFailure(t *testing.T) {
+	defer func(c *Canary) { canary = c }(canary)
+	// resolves to a loopback address, which is never looked up
+	canary = &Canary{Domain: "localhost"}
+	canarySuccess.Set(1)
+	canary.check(context.Background())
+
+	status := canary.Status()
+	if status.Healthy || status.Failures != 1 || status.LastError == "" {
+		t.Errorf("got status %+v, want a failure", status)
+	}
+	if got := testutil.ToFloat64(canarySuccess); got != 0 {
+		t.Errorf("got fedinfo_canary_success %g, want 0", got)
+	}
+	if got := testutil.ToFloat64(canaryLastRun); got != float64(status.LastCheck.Unix()) {
+		t.Errorf("got fedinfo_canary_last_run_timestamp_seconds %g, want %d", got, status.LastCheck.Unix())
+	}
+
+	w := httptest.NewRecorder()
+	if err := healthRoute(w, httptest.NewRequest(http.MethodGet, "/healthz", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got /healthz status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log/slog"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// encoders holds the supported Content-Encodings, in order of preference.
+// gzip is always available; brotli is registered when built with the
+// brotli tag.
+var encoders = []Encoder{
+	{Name: "gzip", Writer: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+}
+
+type Encoder struct {
+	Name string
+	Writer func(w io.Writer) io.WriteCloser
+}
+
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	buf bytes.Buffer
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	if br.status == 0 {
+		br.status = status
+	}
+}
+
+func (br *bufferedResponse) Write(p []byte) (int, error) {
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	return br.buf.Write(p)
+}
+
+// Compress compresses responses of at least minSize bytes with the most
+// preferred encoding the client accepts. Smaller responses are sent as is,
+// since compressing them costs more than it saves.
+func Compress(minSize int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoder, ok := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		resp := &bufferedResponse{ResponseWriter: w}
+		next.ServeHTTP(resp, r)
+		h := w.Header()
+		h.Add("Vary", "Accept-Encoding")
+		if resp.status == 0 {
+			resp.status = http.StatusOK
+		}
+		if resp.buf.Len() < minSize || h.Get("Content-Encoding") != "" || resp.status < 200 || resp.status == http.StatusNoContent || resp.status == http.StatusNotModified {
+			w.WriteHeader(resp.status)
+			w.Write(resp.buf.Bytes())
+			return
+		}
+		h.Set("Content-Encoding", encoder.Name)
+		h.Del("Content-Length")
+		w.WriteHeader(resp.status)
+		cw := encoder.Writer(w)
+		if _, err := cw.Write(resp.buf.Bytes()); err != nil {
+			slog.Warn("failed to write compressed response", "error", err)
+		}
+		if err := cw.Close(); err != nil {
+			slog.Warn("failed to write compressed response", "error", err)
+		}
+	})
+}
+
+// negotiateEncoding picks the encoder with the highest q-value in
+// acceptEncoding, breaking ties by our order of preference.
+func negotiateEncoding(acceptEncoding string) (best Encoder, ok bool) {
+	bestQ := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		for _, encoder := range encoders {
+			if encoder.Name != strings.ToLower(name) && name != "*" {
+				continue
+			}
+			if q > bestQ || q == bestQ && ok && preference(encoder) < preference(best) {
+				best, bestQ, ok = encoder, q, q > 0
+			}
+		}
+	}
+	return best, ok
+}
+
+func preference(encoder Encoder) int {
+	for i, e := range encoders {
+		if e.Name == encoder.Name {
+			return i
+		}
+	}
+	return len(encoders)
+}
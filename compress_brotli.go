@@ -0,0 +1,18 @@
+//go:build brotli
+
+package main
+
+import (
+	"io"
+	"slices"
+
+	"github.com/andybalholm/brotli"
+)
+
+func init() {
+	// brotli compresses json noticeably better than gzip, so prefer it
+	encoders = slices.Insert(encoders, 0, Encoder{
+		Name: "br",
+		Writer: func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// loadConfigFile loads the settings in the file named by CONFIG_FILE, or
+// else in .env or /etc/fedinfo/env, whichever exists. The file sets the same
+// variables as the environment, one NAME=value per line, and variables that
+// are already set in the environment take precedence.
+func loadConfigFile() {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := godotenv.Load(path); err != nil {
+			slog.Warn("failed to load CONFIG_FILE", "error", err)
+		}
+		return
+	}
+	if err := godotenv.Load(".env"); err != nil {
+		_ = godotenv.Load("/etc/fedinfo/env")
+	}
+}
+
+// envDuration sets d to the duration in the environment variable name, if it
+// is set and valid.
+func envDuration(name string, d *time.Duration) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		slog.Warn("invalid duration, expected a non-negative one", "name", name, "value", value)
+		return
+	}
+	*d = parsed
+}
+
+// parsePrefixList parses a comma separated list of ip addresses and cidr
+// prefixes. Invalid entries are logged and skipped.
+func parsePrefixList(name, value string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				slog.Warn("invalid prefix list entry, expected an ip address or cidr prefix", "name", name, "value", entry)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+// ServerConfig are the timeouts of the http server, zero disables them.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout time.Duration
+	// WriteTimeout must leave enough time for batch lookups, which take a
+	// while if many of the domains aren't cached.
+	WriteTimeout time.Duration
+	IdleTimeout time.Duration
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// once the server is asked to stop, zero doesn't wait at all.
+	ShutdownTimeout time.Duration
+}
+
+var serverConfig = ServerConfig{
+	ReadHeaderTimeout: 10*time.Second,
+	ReadTimeout: 30*time.Second,
+	WriteTimeout: 2*time.Minute,
+	IdleTimeout: 2*time.Minute,
+	ShutdownTimeout: 1*time.Minute,
+}
+
+func (c ServerConfig) Server(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr: addr,
+		Handler: handler,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout: c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+		IdleTimeout: c.IdleTimeout,
+	}
+}
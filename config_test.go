@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEnvDuration(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want time.Duration
+	}{
+		{"", time.Minute},
+		{"30s", 30*time.Second},
+		{"0", 0},
+		{"-1s", time.Minute},
+		{"soon", time.Minute},
+	} {
+		t.Setenv("TEST_DURATION", test.value)
+		d := time.Minute
+		envDuration("TEST_DURATION", &d)
+		if d != test.want {
+			t.Errorf("%q: got %v, want %v", test.value, d, test.want)
+		}
+	}
+}
+
+func TestParsePrefixList(t *testing.T) {
+	got := parsePrefixList("TEST_PREFIXES", "10.1.2.3/8, 192.0.2.1, ::1, garbage")
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("::1/128"),
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+// Crawler walks the fediverse from a set of seed domains, by following the
+// peer lists of every instance it resolves, which keeps the cache warm for
+// all of them. Every known domain is revisited once per round, and a round
+// starts at most every Revisit.
+type Crawler struct {
+	Seeds []string
+	// Rate limits how many instances per second are visited.
+	Rate int
+	// Concurrency bounds the number of instances visited at once.
+	Concurrency int
+	// Delay is waited between the requests to the same instance.
+	Delay time.Duration
+	Revisit time.Duration
+	// MaxDomains bounds the number of domains the crawler keeps track of,
+	// further discoveries are ignored.
+	MaxDomains int
+	lock sync.Mutex
+	domains []string // known domains, in order of discovery
+	known map[string]bool
+	instances map[string]bool // domains that resolved in the current or last round
+}
+
+// crawler is nil unless CRAWL_SEEDS is set.
+var crawler *Crawler
+
+func (c *Crawler) Run(ctx context.Context) {
+	c.lock.Lock()
+	c.known = map[string]bool{}
+	c.instances = map[string]bool{}
+	for _, seed := range c.Seeds {
+		c.discover(seed)
+	}
+	c.lock.Unlock()
+	for {
+		start := time.Now()
+		c.round(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(start.Add(c.Revisit))):
+		}
+	}
+}
+
+// discover adds domain to the known domains, it must be called with the
+// lock held.
+func (c *Crawler) discover(domain string) {
+	if c.known[domain] || len(c.domains) >= c.MaxDomains || !fedinfo.IsPublicHostname(domain) {
+		return
+	}
+	c.known[domain] = true
+	c.domains = append(c.domains, domain)
+}
+
+// round visits every known domain, including the ones discovered along the
+// way. Domains that didn't resolve are forgotten afterwards, unless they are
+// seeds, but may be rediscovered later.
+func (c *Crawler) round(ctx context.Context) {
+	ticker := time.NewTicker(time.Second / time.Duration(c.Rate))
+	defer ticker.Stop()
+	slots := make(chan struct{}, c.Concurrency)
+	var wg sync.WaitGroup
+	resolved := map[string]bool{}
+	found := map[string]bool{}
+	visited, failed := 0, 0
+	for i := 0; ; i++ {
+		c.lock.Lock()
+		if i >= len(c.domains) {
+			c.lock.Unlock()
+			// the peers of the domains still being visited may yet
+			// extend the list
+			wg.Wait()
+			c.lock.Lock()
+			if i >= len(c.domains) {
+				c.lock.Unlock()
+				break
+			}
+		}
+		domain := c.domains[i]
+		c.lock.Unlock()
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-ticker.C:
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			canonical, ok := c.visit(ctx, domain)
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			visited++
+			if !ok {
+				failed++
+				return
+			}
+			resolved[domain] = true
+			found[canonical] = true
+			c.instances[canonical] = true
+		}()
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.domains = slices.DeleteFunc(c.domains, func(domain string) bool {
+		if resolved[domain] || slices.Contains(c.Seeds, domain) {
+			return false
+		}
+		delete(c.known, domain)
+		return true
+	})
+	c.instances = found
+	slog.Info("crawl round finished", "visited", visited, "failed", failed, "known", len(c.domains))
+}
+
+// visit looks domain up, through the cache, and discovers its peers. It
+// returns the canonical domain of the instance and whether it resolved.
+func (c *Crawler) visit(ctx context.Context, domain string) (canonical string, ok bool) {
+	info, err := client.Lookup(ctx, domain)
+	if err != nil || !info.Software.IsResolved() {
+		return "", false
+	}
+	canonical = domain
+	if info.CanonicalDomain != "" {
+		canonical = info.CanonicalDomain
+	}
+	host := domain
+	if info.ServerDomain != "" {
+		host = info.ServerDomain
+	}
+	select {
+	case <-ctx.Done():
+		return canonical, true
+	case <-time.After(c.Delay):
+	}
+	peers, _, err := client.Peers(ctx, host)
+	if err != nil {
+		slog.Debug("failed to fetch peers", "domain", host, "error", err)
+		return canonical, true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, peer := range peers {
+		c.discover(peer)
+	}
+	return canonical, true
+}
+
+// Instances returns the instances the crawler found, in no particular order.
+func (c *Crawler) Instances() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	instances := make([]string, 0, len(c.instances))
+	for domain := range c.instances {
+		instances = append(instances, domain)
+	}
+	return instances
+}
+
+type InstancesResponse struct {
+	Total int `json:"total"`
+	Offset int `json:"offset"`
+	Limit int `json:"limit"`
+	Instances []fedinfo.NodeInfo `json:"instances"`
+}
+
+// instancesRoute lists the instances found by the crawler, sorted by domain,
+// optionally restricted to one or more software families, like /domains.
+// It is empty if the crawler isn't enabled.
+func instancesRoute(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		return err
+	}
+	var families []string
+	for _, software := range r.Form["software"] {
+		families = append(families, softwareFamily(software))
+	}
+	matches := []fedinfo.NodeInfo{}
+	if crawler != nil {
+		// every instance was looked up during the last round, so its entry
+		// can't be much older than that, unless it was evicted
+		maxStale := 2*crawler.Revisit
+		for _, domain := range crawler.Instances() {
+			info, ok := cache.GetStale(domain, maxStale)
+			if !ok {
+				continue
+			}
+			if len(families) == 0 || slices.Contains(families, softwareFamily(info.Software.Name)) {
+				stripOptionalFields(r, &info)
+				matches = append(matches, info)
+			}
+		}
+	}
+	slices.SortFunc(matches, func(a, b fedinfo.NodeInfo) int {
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	response := InstancesResponse{
+		Total: len(matches),
+		Offset: offset,
+		Limit: limit,
+		Instances: paginate(matches, offset, limit),
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCrawlerRound(t *testing.T) {
+	lemmyNodeInfo := strings.Replace(mastodonNodeInfo, `"name": "mastodon", "version": "4.3.2"`, `"name": "lemmy", "version": "0.19.8"`, 1)
+	useTestServer(t, fixtures{
+		"seed.test/.well-known/nodeinfo": wellKnown("seed.test"),
+		"seed.test/nodeinfo/2.0": mastodonNodeInfo,
+		"seed.test/api/v1/instance/peers": `["a.test", "gone.test", "127.0.0.1"]`,
+		"a.test/.well-known/nodeinfo": wellKnown("a.test"),
+		"a.test/nodeinfo/2.0": lemmyNodeInfo,
+		"a.test/api/v3/federated_instances": `{"federated_instances": {"linked": [{"domain": "seed.test"}, {"domain": "b.test"}]}}`,
+		"b.test/.well-known/nodeinfo": wellKnown("b.test"),
+		"b.test/nodeinfo/2.0": mastodonNodeInfo,
+	})
+	original := crawler
+	t.Cleanup(func() { crawler = original })
+	crawler = &Crawler{
+		Seeds: []string{"seed.test", "down.test"},
+		Rate: 1000,
+		Concurrency: 2,
+		Revisit: time.Hour,
+		MaxDomains: 100,
+		known: map[string]bool{},
+		instances: map[string]bool{},
+	}
+	for _, seed := range crawler.Seeds {
+		crawler.discover(seed)
+	}
+	crawler.round(context.Background())
+
+	instances := crawler.Instances()
+	slices.Sort(instances)
+	if want := []string{"a.test", "b.test", "seed.test"}; !slices.Equal(instances, want) {
+		t.Errorf("got instances %q, want %q", instances, want)
+	}
+	// seeds are kept even if they don't resolve, other domains are not
+	if want := []string{"seed.test", "down.test", "a.test", "b.test"}; !slices.Equal(crawler.domains, want) {
+		t.Errorf("got known domains %q, want %q", crawler.domains, want)
+	}
+
+	for query, want := range map[string][]string{
+		"": {"a.test", "b.test", "seed.test"},
+		"?software=lemmy": {"a.test"},
+		"?offset=1&limit=1": {"b.test"},
+		fmt.Sprintf("?offset=%d", math.MaxInt): nil,
+	} {
+		w := httptest.NewRecorder()
+		HandlerWithError(instancesRoute).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/instances"+query, nil))
+		var response InstancesResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+		var domains []string
+		for _, info := range response.Instances {
+			domains = append(domains, info.Domain)
+		}
+		if !slices.Equal(domains, want) {
+			t.Errorf("%q: got %q, want %q", query, domains, want)
+		}
+	}
+}
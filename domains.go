@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+const (
+	defaultDomainsLimit = 100
+	maxDomainsLimit = 1000
+)
+
+// softwareFamilies maps forks to the software they derive from, so that
+// e.g. a filter for misskey also finds sharkey instances.
+var softwareFamilies = map[string]string{
+	"glitch": "mastodon",
+	"glitch-soc": "mastodon",
+	"glitchsoc": "mastodon",
+	"hometown": "mastodon",
+	"chuckya": "mastodon",
+	"sharkey": "misskey",
+	"firefish": "misskey",
+	"calckey": "misskey",
+	"iceshrimp": "misskey",
+	"foundkey": "misskey",
+	"catodon": "misskey",
+	"cherrypick": "misskey",
+	"meisskey": "misskey",
+	"akkoma": "pleroma",
+	"incestoma": "pleroma",
+}
+
+func softwareFamily(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if family, ok := softwareFamilies[name]; ok {
+		return family
+	}
+	return name
+}
+
+type DomainsResponse struct {
+	Total int `json:"total"`
+	Offset int `json:"offset"`
+	Limit int `json:"limit"`
+	Domains []fedinfo.NodeInfo `json:"domains"`
+}
+
+// domainsRoute lists the cached instances, sorted by domain, optionally
+// restricted to one or more software families (?software=misskey&software=pleroma).
+func domainsRoute(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		return err
+	}
+	var families []string
+	for _, software := range r.Form["software"] {
+		families = append(families, softwareFamily(software))
+	}
+	matches := []fedinfo.NodeInfo{}
+	cache.Range(func(domain string, info fedinfo.NodeInfo) bool {
+		if len(families) == 0 || slices.Contains(families, softwareFamily(info.Software.Name)) {
+			stripOptionalFields(r, &info)
+			matches = append(matches, info)
+		}
+		return true
+	})
+	slices.SortFunc(matches, func(a, b fedinfo.NodeInfo) int {
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	response := DomainsResponse{
+		Total: len(matches),
+		Offset: offset,
+		Limit: limit,
+		Domains: paginate(matches, offset, limit),
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parsePagination(r *http.Request) (offset, limit int, err error) {
+	limit = defaultDomainsLimit
+	if param := r.Form.Get("offset"); param != "" {
+		offset, err = strconv.Atoi(param)
+		if err != nil || offset < 0 {
+			return 0, 0, ErrBadRequest(fmt.Sprintf("invalid offset: %s", param))
+		}
+	}
+	if param := r.Form.Get("limit"); param != "" {
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > maxDomainsLimit {
+			return 0, 0, ErrBadRequest(fmt.Sprintf("invalid limit, expected 1 to %d: %s", maxDomainsLimit, param))
+		}
+	}
+	return offset, limit, nil
+}
+
+// paginate returns the page of items selected by offset and limit, as
+// parsed by parsePagination. The offset may lie beyond the end, and be large
+// enough that offset+limit overflows.
+func paginate[T any](items []T, offset, limit int) []T {
+	start := min(offset, len(items))
+	return items[start:start+min(limit, len(items)-start)]
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+func TestPaginate(t *testing.T) {
+	items := []int{0, 1, 2, 3, 4}
+	for _, test := range []struct {
+		offset, limit int
+		want []int
+	}{
+		{0, 2, []int{0, 1}},
+		{3, 5, []int{3, 4}},
+		{5, 1, []int{}},
+		{7, 1, []int{}},
+		{math.MaxInt, 1000, []int{}},
+		{2, math.MaxInt, []int{2, 3, 4}},
+	} {
+		if got := paginate(items, test.offset, test.limit); !slices.Equal(got, test.want) {
+			t.Errorf("offset %d, limit %d: got %v, want %v", test.offset, test.limit, got, test.want)
+		}
+	}
+}
+
+func TestDomainsRoute(t *testing.T) {
+	original := cache
+	t.Cleanup(func() { cache = original })
+	cache = &fedinfo.Cache{TTL: time.Hour}
+	cache.Set("a.example.social", fedinfo.NodeInfo{Domain: "a.example.social", Software: fedinfo.Software{Name: "mastodon", Version: "4.3.2"}})
+	cache.Set("b.example.social", fedinfo.NodeInfo{Domain: "b.example.social", Software: fedinfo.Software{Name: "lemmy", Version: "0.19.8"}})
+	cache.Set("c.example.social", fedinfo.NodeInfo{Domain: "c.example.social", Software: fedinfo.Software{Name: "hometown", Version: "4.0.10"}})
+	for _, test := range []struct {
+		query string
+		want []string
+		total int
+	}{
+		{"", []string{"a.example.social", "b.example.social", "c.example.social"}, 3},
+		{"?software=mastodon", []string{"a.example.social", "c.example.social"}, 2},
+		{"?offset=1&limit=1", []string{"b.example.social"}, 3},
+		{fmt.Sprintf("?offset=%d&limit=1000", math.MaxInt), []string{}, 3},
+	} {
+		query := test.query
+		w := httptest.NewRecorder()
+		HandlerWithError(domainsRoute).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/domains"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: got status %d: %s", query, w.Code, w.Body)
+		}
+		var response DomainsResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+		domains := []string{}
+		for _, info := range response.Domains {
+			domains = append(domains, info.Domain)
+		}
+		if !slices.Equal(domains, test.want) || response.Total != test.total {
+			t.Errorf("%q: got %q of %d, want %q of %d", query, domains, response.Total, test.want, test.total)
+		}
+	}
+}
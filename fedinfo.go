@@ -1,76 +1,509 @@
 package main
 
 import (
+	"log/slog"
 	"os"
 	"os/signal"
 	"errors"
 	"net/http"
 	"encoding/json"
+	"slices"
 	"time"
 	"context"
-	"log"
 	"fmt"
 	"net/url"
-	"sync"
 	"syscall"
 	"strings"
+	"strconv"
+	"regexp"
+	"maps"
+	"math"
 
-	"github.com/joho/godotenv"
 	"github.com/rs/cors"
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+	"github.com/cvanloo/go-fedi-info/admin"
 )
 
-var cache = &Cache{TTL: 1*time.Hour}
+var (
+	cache = &fedinfo.Cache{TTL: 1*time.Hour, Jitter: 0.1}
+	client = &fedinfo.Client{
+		Cache: cache,
+		OnResolve: func(domain string, start time.Time, info fedinfo.NodeInfo, err error) {
+			recordHistory(domain, start, info, err)
+			observeLookup(domain, start, info, err)
+		},
+		OnCache: observeCache,
+	}
+)
 
 func main() {
-	if err := godotenv.Load(".env"); err != nil {
-		_ = godotenv.Load("/etc/fedinfo/env")
+	loadConfigFile()
+
+	var logLevel slog.Level
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+			slog.Warn("invalid LOG_LEVEL, expected debug, info, warn, or error", "value", level)
+		}
+	}
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "":
+		// keep the plain log output
+		slog.SetLogLoggerLevel(logLevel)
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+	default:
+		slog.Warn("invalid LOG_FORMAT, expected text or json", "value", format)
 	}
 
-	cacheFile := os.Getenv("CACHE_FILE")
-	log.Printf("populating cache from %s", cacheFile)
+	if ttl := os.Getenv("CACHE_TTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err != nil || d <= 0 {
+			slog.Warn("invalid CACHE_TTL, expected a positive duration", "value", ttl)
+		} else {
+			cache.TTL = d
+		}
+	}
+	if jitter := os.Getenv("CACHE_TTL_JITTER"); jitter != "" {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(jitter, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			slog.Warn("invalid CACHE_TTL_JITTER, expected a percentage between 0 and 100", "value", jitter)
+		} else {
+			cache.Jitter = percent / 100
+		}
+	}
 
-	fd, err := os.Open(cacheFile)
-	if err != nil {
-		log.Printf("failed to open cache file: %v", err)
+	if refreshAhead, _ := strconv.ParseBool(os.Getenv("REFRESH_AHEAD")); refreshAhead {
+		cache.RefreshAhead = fedinfo.RefreshAhead{
+			Enabled: true,
+			Window: 5*time.Minute,
+			MinHits: 10,
+			Refresh: func(domain string) (fedinfo.NodeInfo, error) {
+				return client.Resolve(context.Background(), domain, false)
+			},
+		}
+		if window, err := time.ParseDuration(os.Getenv("REFRESH_AHEAD_WINDOW")); err == nil {
+			cache.RefreshAhead.Window = window
+		}
+		if minHits, err := strconv.Atoi(os.Getenv("REFRESH_AHEAD_MIN_HITS")); err == nil {
+			cache.RefreshAhead.MinHits = minHits
+		}
+		slog.Info("refreshing hot entries before expiry", "hits", cache.RefreshAhead.MinHits, "window", cache.RefreshAhead.Window)
+	}
+
+	switch policy := DomainInputPolicy(os.Getenv("DOMAIN_INPUT_POLICY")); policy {
+	case "":
+		// keep default
+	case DomainInputReject, DomainInputStripAndWarn, DomainInputStripSilent:
+		domainInputPolicy = policy
+	default:
+		slog.Warn("invalid DOMAIN_INPUT_POLICY, expected reject, strip-and-warn, or strip-silent", "value", policy)
+	}
+
+	if webhookUrl := os.Getenv("WEBHOOK_URL"); webhookUrl != "" {
+		slog.Info("sending software changes to webhook", "url", webhookUrl)
+		webhook := &Webhook{
+			URL: webhookUrl,
+			Secret: os.Getenv("WEBHOOK_SECRET"),
+			Retries: 3,
+			Client: &http.Client{Timeout: 10*time.Second},
+		}
+		cache.OnChange = webhook.OnChange
+	}
+
+	if maxDuration := os.Getenv("LOOKUP_MAX_DURATION"); maxDuration != "" {
+		if d, err := time.ParseDuration(maxDuration); err != nil || d <= 0 {
+			slog.Warn("invalid LOOKUP_MAX_DURATION, expected a positive duration", "value", maxDuration)
+		} else {
+			client.MaxDuration = d
+		}
+	}
+	if negativeTTL := os.Getenv("NEGATIVE_CACHE_TTL"); negativeTTL != "" {
+		if d, err := time.ParseDuration(negativeTTL); err != nil || d < 0 {
+			slog.Warn("invalid NEGATIVE_CACHE_TTL, expected a non-negative duration", "value", negativeTTL)
+		} else if d == 0 {
+			client.NegativeTTL = -1 // disabled
+		} else {
+			client.NegativeTTL = d
+		}
+	}
+	// refresh=true only probes instances whose failure is remembered if this
+	// is set, and then at most once per cooldown and domain
+	if cooldown := os.Getenv("NEGATIVE_CACHE_PROBE_COOLDOWN"); cooldown != "" {
+		if d, err := time.ParseDuration(cooldown); err != nil || d < 0 {
+			slog.Warn("invalid NEGATIVE_CACHE_PROBE_COOLDOWN, expected a non-negative duration", "value", cooldown)
+		} else {
+			client.ProbeCooldown = d
+		}
+	}
+	if swr := os.Getenv("STALE_WHILE_REVALIDATE"); swr != "" {
+		if d, err := time.ParseDuration(swr); err != nil || d < 0 {
+			slog.Warn("invalid STALE_WHILE_REVALIDATE, expected a non-negative duration", "value", swr)
+		} else {
+			client.StaleWhileRevalidate = d
+		}
+	}
+	fetchTimeout := 10*time.Second
+	if timeout := os.Getenv("FETCH_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err != nil || d <= 0 {
+			slog.Warn("invalid FETCH_TIMEOUT, expected a positive duration", "value", timeout)
+		} else {
+			fetchTimeout = d
+		}
+	}
+	maxRedirects := 10
+	if redirects := os.Getenv("MAX_REDIRECTS"); redirects != "" {
+		if n, err := strconv.Atoi(redirects); err != nil || n < 0 {
+			slog.Warn("invalid MAX_REDIRECTS, expected a non-negative number", "value", redirects)
+		} else {
+			maxRedirects = n
+		}
+	}
+
+	if maxBodyBytes := os.Getenv("MAX_RESPONSE_BODY_BYTES"); maxBodyBytes != "" {
+		limit, err := strconv.ParseInt(maxBodyBytes, 10, 64)
+		if err != nil || limit <= 0 {
+			slog.Warn("invalid MAX_RESPONSE_BODY_BYTES, expected a positive number", "value", maxBodyBytes)
+		} else {
+			client.MaxBodyBytes = limit
+		}
+	}
+
+	// only meant for testing against instances on a local network
+	if allowlist := os.Getenv("OUTBOUND_ALLOWLIST"); allowlist != "" {
+		fedinfo.AllowedPrefixes = parsePrefixList("OUTBOUND_ALLOWLIST", allowlist)
+		slog.Info("allowing outbound requests to non-public addresses", "prefixes", fedinfo.AllowedPrefixes)
+	}
+
+	switch policy := fedinfo.MixedContentPolicy(os.Getenv("MIXED_CONTENT_POLICY")); policy {
+	case "":
+		// keep default
+	case fedinfo.MixedContentRewrite, fedinfo.MixedContentReject:
+		client.MixedContentPolicy = policy
+	default:
+		slog.Warn("invalid MIXED_CONTENT_POLICY, expected rewrite or reject", "value", policy)
+	}
+
+	if maxEntries, err := strconv.Atoi(os.Getenv("CACHE_MAX_ENTRIES")); err == nil && maxEntries > 0 {
+		cache.MaxEntries = maxEntries
+	}
+
+	storeName, storeUrl := os.Getenv("CACHE_STORE"), os.Getenv("CACHE_STORE_URL")
+	if storeName == "" {
+		storeName, storeUrl = "file", os.Getenv("CACHE_FILE")
+	}
+	if storeUrl == "" {
+		slog.Info("no CACHE_FILE or CACHE_STORE_URL set, not persisting the cache")
+	} else if store, err := openCacheStore(storeName, storeUrl); err != nil {
+		slog.Warn("failed to open cache store, not persisting the cache", "error", err)
 	} else {
-		var cacheData map[string]Software
-		if err := json.NewDecoder(fd).Decode(&cacheData); err != nil {
-			log.Printf("failed to populate cache: %v", err)
+		store = metricsStore{store}
+		if persistResolvedOnly, _ := strconv.ParseBool(os.Getenv("PERSIST_RESOLVED_ONLY")); persistResolvedOnly {
+			store = resolvedOnlyStore{store}
+		}
+		slog.Info("populating cache", "store", storeName, "url", storeUrl)
+		contents, err := store.Load(context.Background())
+		if err != nil {
+			slog.Warn("failed to populate cache", "error", err)
+		}
+		cache.Load(contents)
+		if storeName != "file" {
+			// the file only holds what was flushed from this very cache
+			client.Backend = store
+		}
+		switch policy := fedinfo.BackendPolicy(os.Getenv("CACHE_STORE_POLICY")); policy {
+		case "":
+			// keep default
+		case fedinfo.BackendFailOpen, fedinfo.BackendFailClosed:
+			client.BackendPolicy = policy
+		default:
+			slog.Warn("invalid CACHE_STORE_POLICY, expected fail-open or fail-closed", "value", policy)
+		}
+		flushInterval := 1*time.Minute
+		if d, err := time.ParseDuration(os.Getenv("CACHE_FLUSH_INTERVAL")); err == nil && d > 0 {
+			flushInterval = d
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go cache.FlushEvery(ctx, store, flushInterval)
+		defer func() {
+			cancel()
+			if err := cache.Flush(context.Background(), store); err != nil {
+				slog.Warn("failed to write out cache", "error", err)
+			}
+			if err := store.Close(); err != nil {
+				slog.Warn("failed to close cache store", "error", err)
+			}
+		}()
+	}
+
+	if patterns := os.Getenv("VERSION_TRIM_PATTERNS"); patterns != "" {
+		var exprs []string
+		if err := json.Unmarshal([]byte(patterns), &exprs); err != nil {
+			slog.Warn("invalid VERSION_TRIM_PATTERNS, expected a json array of regexes", "error", err)
+		} else {
+			compiled := make([]*regexp.Regexp, 0, len(exprs))
+			for _, expr := range exprs {
+				pattern, err := regexp.Compile(expr)
+				if err != nil {
+					slog.Warn("invalid version trim pattern", "pattern", expr, "error", err)
+					continue
+				}
+				compiled = append(compiled, pattern)
+			}
+			versionTrimPatterns = compiled
+		}
+	}
+
+	if colors := os.Getenv("BADGE_COLORS"); colors != "" {
+		parsed, err := parseBadgeColors(colors)
+		if err != nil {
+			slog.Warn("invalid BADGE_COLORS", "error", err)
+		} else {
+			maps.Copy(badgeColors, parsed)
+		}
+	}
+
+	if rewrites := os.Getenv("SOFTWARE_REWRITES"); rewrites != "" {
+		rules, err := fedinfo.ParseRewriteRules(rewrites)
+		if err != nil {
+			slog.Warn("invalid SOFTWARE_REWRITES", "error", err)
+		} else {
+			client.Rewrites.Rules = rules
+		}
+	}
+	switch mode := os.Getenv("SOFTWARE_REWRITE_MODE"); mode {
+	case "", "first":
+		client.Rewrites.ApplyAll = false
+	case "all":
+		client.Rewrites.ApplyAll = true
+	default:
+		slog.Warn("invalid SOFTWARE_REWRITE_MODE, expected first or all", "value", mode)
+	}
+
+	ipFamily := fedinfo.IPFamilyAuto
+	switch family := fedinfo.IPFamily(os.Getenv("IP_FAMILY")); family {
+	case "":
+		// keep default
+	case fedinfo.IPFamilyAuto, fedinfo.IPFamilyV4, fedinfo.IPFamilyV6:
+		ipFamily = family
+	default:
+		slog.Warn("invalid IP_FAMILY, expected auto, v4, or v6", "value", family)
+	}
+	outboundTransport := fedinfo.NewTransport(ipFamily)
+	var transport http.RoundTripper = outboundTransport
+
+	if minVersion := os.Getenv("TLS_MIN_VERSION"); minVersion != "" {
+		version, ok := fedinfo.TLSVersions[minVersion]
+		if !ok {
+			slog.Warn("invalid TLS_MIN_VERSION, expected one of 1.0, 1.1, 1.2, 1.3", "value", minVersion)
 		} else {
-			cache.Data = cacheData
+			outboundTransport.TLSClientConfig.MinVersion = version
 		}
-		fd.Close()
 	}
-	defer func() {
-		fd, err := os.Create(cacheFile)
+
+	if maxHeaderBytes := os.Getenv("MAX_RESPONSE_HEADER_BYTES"); maxHeaderBytes != "" {
+		limit, err := strconv.ParseInt(maxHeaderBytes, 10, 64)
+		if err != nil || limit <= 0 {
+			slog.Warn("invalid MAX_RESPONSE_HEADER_BYTES, expected a positive number", "value", maxHeaderBytes)
+		} else {
+			outboundTransport.MaxResponseHeaderBytes = limit
+		}
+	}
+
+	switch enableHttp3 := os.Getenv("ENABLE_HTTP3"); enableHttp3 {
+	case "", "0", "false":
+		// disabled
+	case "force":
+		slog.Info("using http3 for all outbound requests")
+		transport = fedinfo.NewH3FallbackTransport(outboundTransport, ipFamily, true)
+	default:
+		slog.Info("using http3 for outbound requests to hosts advertising it")
+		transport = fedinfo.NewH3FallbackTransport(outboundTransport, ipFamily, false)
+	}
+
+	if outboundHeaders := os.Getenv("OUTBOUND_HEADERS"); outboundHeaders != "" {
+		headers, err := parseOutboundHeaders(outboundHeaders)
 		if err != nil {
-			log.Printf("failed to open cache file for writing: %v", err)
+			slog.Warn("invalid OUTBOUND_HEADERS", "error", err)
+		} else {
+			transport = &headerTransport{headers: headers, next: transport}
+		}
+	}
+
+	if keyFile, keyID := os.Getenv("SIGNING_KEY_FILE"), os.Getenv("SIGNING_KEY_ID"); keyFile != "" || keyID != "" {
+		key, err := loadSigningKey(keyFile)
+		if err != nil {
+			slog.Warn("failed to load signing key", "error", err)
+		} else if keyID == "" {
+			slog.Warn("SIGNING_KEY_FILE requires SIGNING_KEY_ID to be set")
+		} else {
+			slog.Info("signing challenged requests", "key", keyID)
+			transport = &signingTransport{key: key, keyID: keyID, next: transport}
+		}
+	}
+	transport = &metricsTransport{next: transport}
+	client.HTTPClient = fedinfo.NewHTTPClient(transport, fetchTimeout, maxRedirects)
+
+	if adminAuthorizer == nil {
+		adminAuthorizer = admin.StaticToken{Token: os.Getenv("ADMIN_TOKEN")}
+	}
+	if depth, err := strconv.Atoi(os.Getenv("HISTORY_DEPTH")); err == nil && depth > 0 {
+		history.Depth = depth
+	}
+	if maxDomains, err := strconv.Atoi(os.Getenv("HISTORY_MAX_DOMAINS")); err == nil && maxDomains > 0 {
+		history.MaxDomains = maxDomains
+	}
+	if rate, err := strconv.Atoi(os.Getenv("REFRESH_RATE")); err == nil && rate > 0 {
+		refreshRate = rate
+	}
+	if concurrency, err := strconv.Atoi(os.Getenv("REFRESH_CONCURRENCY")); err == nil && concurrency > 0 {
+		refreshConcurrency = concurrency
+	}
+	if size, err := strconv.Atoi(os.Getenv("MAX_BATCH_SIZE")); err == nil && size > 0 {
+		maxBatchSize = size
+	}
+	if concurrency, err := strconv.Atoi(os.Getenv("BATCH_CONCURRENCY")); err == nil && concurrency > 0 {
+		batchConcurrency = concurrency
+	}
+
+	corsOptions := cors.Options{
+		ExposedHeaders: []string{"Retry-After"},
+	}
+	for _, origin := range strings.Split(os.Getenv("ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			corsOptions.AllowedOrigins = append(corsOptions.AllowedOrigins, origin)
+		}
+	}
+	if len(corsOptions.AllowedOrigins) == 0 {
+		// an empty list would allow all origins
+		corsOptions.AllowOriginFunc = func(origin string) bool { return false }
+	}
+	slog.Info("allowed origins", "origins", corsOptions.AllowedOrigins)
+	if headers := os.Getenv("CORS_ALLOWED_HEADERS"); headers != "" {
+		for _, header := range strings.Split(headers, ",") {
+			corsOptions.AllowedHeaders = append(corsOptions.AllowedHeaders, strings.TrimSpace(header))
+		}
+	}
+	if credentials, err := strconv.ParseBool(os.Getenv("CORS_ALLOW_CREDENTIALS")); err == nil {
+		corsOptions.AllowCredentials = credentials
+	}
+	if maxAge := os.Getenv("CORS_MAX_AGE"); maxAge != "" {
+		if d, err := time.ParseDuration(maxAge); err != nil || d < 0 {
+			slog.Warn("invalid CORS_MAX_AGE, expected a non-negative duration", "value", maxAge)
+		} else {
+			corsOptions.MaxAge = int(d.Seconds())
+		}
+	}
+
+	if limit := os.Getenv("RATE_LIMIT"); limit != "" {
+		rate, err := strconv.ParseFloat(limit, 64)
+		if err != nil || rate <= 0 {
+			slog.Warn("invalid RATE_LIMIT, expected a positive number of requests per second", "value", limit)
 		} else {
-			if err := json.NewEncoder(fd).Encode(cache.Data); err != nil {
-				log.Printf("failed to write out cache: %v", err)
+			rateLimiter = &RateLimiter{Rate: rate, Burst: max(1, int(math.Ceil(rate))), MaxClients: 100_000}
+			if burst, err := strconv.Atoi(os.Getenv("RATE_LIMIT_BURST")); err == nil && burst > 0 {
+				rateLimiter.Burst = burst
+			}
+			if maxClients, err := strconv.Atoi(os.Getenv("RATE_LIMIT_MAX_CLIENTS")); err == nil && maxClients > 0 {
+				rateLimiter.MaxClients = maxClients
 			}
+			if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+				rateLimiter.TrustedProxies = parsePrefixList("TRUSTED_PROXIES", proxies)
+			}
+			slog.Info("limiting client requests", "rate", rateLimiter.Rate, "burst", rateLimiter.Burst)
 		}
-	}()
+	}
 
-	origins := strings.Split(os.Getenv("ORIGINS"), ",")
-	log.Printf("allowed origins %v", origins)
+	envDuration("SERVER_READ_HEADER_TIMEOUT", &serverConfig.ReadHeaderTimeout)
+	envDuration("SERVER_READ_TIMEOUT", &serverConfig.ReadTimeout)
+	envDuration("SERVER_WRITE_TIMEOUT", &serverConfig.WriteTimeout)
+	envDuration("SERVER_IDLE_TIMEOUT", &serverConfig.IdleTimeout)
+	envDuration("SHUTDOWN_TIMEOUT", &serverConfig.ShutdownTimeout)
 
 	listen := os.Getenv("LISTEN")
-	log.Printf("listening on %s", listen)
+	slog.Info("listening", "address", listen)
 
-	mux := http.NewServeMux()
-	mux.Handle("GET /node-info", HandlerWithError(nodeInfoRoute))
-	handler := cors.New(cors.Options{
-		AllowedOrigins: origins,
-	}).Handler(mux)
-	srv := &http.Server{
-		Addr: listen,
-		Handler: handler,
+	mux := newMux()
+	compressMinSize := 1024
+	if minSize, err := strconv.Atoi(os.Getenv("COMPRESS_MIN_SIZE")); err == nil {
+		compressMinSize = minSize
+	}
+	handler := Compress(compressMinSize, mux)
+	if rateLimiter != nil {
+		handler = RateLimit(rateLimiter, handler)
+	}
+	// around the rate limit, so that browsers can read 429s too
+	handler = cors.New(corsOptions).Handler(handler)
+	switch accessLog := os.Getenv("ACCESS_LOG"); accessLog {
+	case "":
+		// disabled
+	case "log":
+		handler = RequestLog(slog.Default(), handler)
+	case "stdout":
+		handler = AccessLog(os.Stdout, handler)
+	default:
+		fd, err := os.OpenFile(accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			slog.Warn("failed to open access log", "error", err)
+		} else {
+			defer fd.Close()
+			handler = AccessLog(fd, handler)
+		}
+	}
+	srv := serverConfig.Server(listen, handler)
+
+	if canaryDomain := os.Getenv("CANARY_DOMAIN"); canaryDomain != "" {
+		interval := 5*time.Minute
+		if d, err := time.ParseDuration(os.Getenv("CANARY_INTERVAL")); err == nil && d > 0 {
+			interval = d
+		}
+		slog.Info("checking canary", "domain", canaryDomain, "interval", interval)
+		canary = &Canary{Domain: canaryDomain, Interval: interval}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go canary.Run(ctx)
+	}
+
+	if seeds := os.Getenv("CRAWL_SEEDS"); seeds != "" {
+		crawler = &Crawler{
+			Rate: 2,
+			Concurrency: 4,
+			Delay: 5*time.Second,
+			Revisit: 24*time.Hour,
+			MaxDomains: 100_000,
+		}
+		for _, seed := range strings.Split(seeds, ",") {
+			seed, _, err := parseDomainParam(strings.TrimSpace(seed))
+			if err != nil {
+				slog.Warn("invalid CRAWL_SEEDS entry", "error", err)
+				continue
+			}
+			crawler.Seeds = append(crawler.Seeds, seed)
+		}
+		if rate, err := strconv.Atoi(os.Getenv("CRAWL_RATE")); err == nil && rate > 0 {
+			crawler.Rate = rate
+		}
+		if concurrency, err := strconv.Atoi(os.Getenv("CRAWL_CONCURRENCY")); err == nil && concurrency > 0 {
+			crawler.Concurrency = concurrency
+		}
+		if d, err := time.ParseDuration(os.Getenv("CRAWL_DELAY")); err == nil && d >= 0 {
+			crawler.Delay = d
+		}
+		if d, err := time.ParseDuration(os.Getenv("CRAWL_INTERVAL")); err == nil && d > 0 {
+			crawler.Revisit = d
+		}
+		if maxDomains, err := strconv.Atoi(os.Getenv("CRAWL_MAX_DOMAINS")); err == nil && maxDomains > 0 {
+			crawler.MaxDomains = maxDomains
+		}
+		slog.Info("crawling", "seeds", crawler.Seeds, "rate", crawler.Rate)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go crawler.Run(ctx)
 	}
 
 	go func() {
 		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-			log.Println(err)
+			slog.Error("server stopped", "error", err)
 		}
 	}()
 
@@ -78,11 +511,11 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	<-c
 
-	log.Println("interrupt received, stopped accepting requests")
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	slog.Info("interrupt received, stopped accepting requests")
+	ctx, cancel := context.WithTimeout(context.Background(), serverConfig.ShutdownTimeout)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("error while shutting down server: %v", err)
+		slog.Error("error while shutting down server", "error", err)
 	}
 }
 
@@ -97,6 +530,12 @@ type (
 
 func (h HandlerWithError) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := h(w, r); err != nil {
+		// a 429 keeps its status and Retry-After even with alwaysOK, clients
+		// that read it as a success would just keep hammering
+		if wantsAlwaysOK(r) && !errors.As(err, new(ErrRateLimited)) {
+			respondErrorOK(w, err)
+			return
+		}
 		if err, ok := err.(ErrorResponder); ok {
 			if err.RespondError(w, r) {
 				return
@@ -104,10 +543,54 @@ func (h HandlerWithError) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		status := http.StatusInternalServerError
 		http.Error(w, http.StatusText(status), status)
-		log.Printf("unhandled error in http request handler: %v", err)
+		slog.Error("unhandled error in http request handler", "method", r.Method, "path", r.URL.Path, "error", err)
+	}
+}
+
+// wantsAlwaysOK reports whether the client asked for errors to be delivered
+// with status 200 and an error object in the body (alwaysOK=true).
+//
+// This exists for client frameworks that can't read the body of non-2xx
+// responses. The tradeoff is that caches, proxies, and monitoring see every
+// failed lookup as a success, and clients must inspect the body to tell the
+// two apart. It is opt-in per request; proper status codes remain the default.
+func wantsAlwaysOK(r *http.Request) bool {
+	alwaysOK, _ := strconv.ParseBool(r.URL.Query().Get("alwaysOK"))
+	return alwaysOK
+}
+
+type (
+	ErrorBody struct {
+		Error ErrorObject `json:"error"`
+	}
+	ErrorObject struct {
+		Status int `json:"status"`
+		Message string `json:"message"`
+	}
+	StatusCoder interface {
+		StatusCode() int
+	}
+)
+
+func respondErrorOK(w http.ResponseWriter, err error) {
+	body := ErrorBody{Error: *newErrorObject(err)}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Warn("failed to write error response", "error", err)
 	}
 }
 
+// newErrorObject describes err the way it would be responded with.
+func newErrorObject(err error) *ErrorObject {
+	if sc, ok := err.(StatusCoder); ok {
+		return &ErrorObject{Status: sc.StatusCode(), Message: err.Error()}
+	}
+	slog.Error("unhandled error in http request handler", "error", err)
+	status := http.StatusInternalServerError
+	return &ErrorObject{Status: status, Message: http.StatusText(status)}
+}
+
 func (e ErrMissingParam) Error() string {
 	return fmt.Sprintf("missing mandatory parameter: %s", string(e))
 }
@@ -118,6 +601,10 @@ func (e ErrMissingParam) RespondError(w http.ResponseWriter, r *http.Request) bo
 	return true
 }
 
+func (e ErrMissingParam) StatusCode() int {
+	return http.StatusBadRequest
+}
+
 func (e ErrBadRequest) Error() string {
 	return string(e)
 }
@@ -128,23 +615,9 @@ func (e ErrBadRequest) RespondError(w http.ResponseWriter, r *http.Request) bool
 	return true
 }
 
-type (
-	WellKnownNodeInfo struct {
-		Links []Link `json:"links"`
-	}
-	Link struct {
-		Rel string `json:"rel"`
-		Href string `json:"href"`
-	}
-	NodeInfo struct {
-		Domain string `json:"domain"`
-		Software Software `json:"software"`
-	}
-	Software struct {
-		Name string `json:"name"`
-		Version string `json:"version"`
-	}
-)
+func (e ErrBadRequest) StatusCode() int {
+	return http.StatusBadRequest
+}
 
 func nodeInfoRoute(w http.ResponseWriter, r *http.Request) error {
 	if err := r.ParseForm(); err != nil {
@@ -154,59 +627,67 @@ func nodeInfoRoute(w http.ResponseWriter, r *http.Request) error {
 	if domain == "" {
 		return ErrMissingParam("domain")
 	}
-	parsedDomain, err := url.Parse(domain)
+	domain, warning, err := parseDomainParam(domain)
 	if err != nil {
-		return ErrBadRequest(fmt.Sprintf("not an url: %s", domain))
+		return err
 	}
-	if parsedDomain.Host == "" {
-		domain = parsedDomain.Path // if you don't enter a schema, url.Parse will think the domain is the path
-	} else {
-		domain = parsedDomain.Host
+	var homographWarning string
+	switch homograph := r.Form.Get("homograph"); homograph {
+	case "", "false":
+		// not requested
+	case "true", "warn":
+		homographWarning = detectHomograph(domain)
+	case "strict":
+		if homographWarning := detectHomograph(domain); homographWarning != "" {
+			return ErrBadRequest(fmt.Sprintf("refusing to resolve possible homograph: %s", homographWarning))
+		}
+	default:
+		return ErrBadRequest(fmt.Sprintf("invalid homograph mode, expected warn or strict: %s", homograph))
 	}
-	queryResponse := NodeInfo{
-		Domain: domain,
+	var maxAge time.Duration
+	if maxAgeParam := r.Form.Get("maxAge"); maxAgeParam != "" {
+		maxAge, err = time.ParseDuration(maxAgeParam)
+		if err != nil || maxAge < 0 {
+			return ErrBadRequest(fmt.Sprintf("not a duration: %s", maxAgeParam))
+		}
+		maxAge = max(maxAge, minMaxAge)
 	}
-	if sfw, ok := cache.Get(domain); ok {
-		queryResponse.Software = sfw
+	var queryResponse fedinfo.NodeInfo
+	if strict, _ := strconv.ParseBool(r.Form.Get("strict")); strict {
+		// a compliance check has to look at the current document, but not
+		// more often than any other client may ask for it
+		queryResponse, err = client.LookupStrict(r.Context(), domain, max(maxAge, minMaxAge))
+	} else if refresh, _ := strconv.ParseBool(r.Form.Get("refresh")); refresh {
+		queryResponse, err = client.LookupRefresh(r.Context(), domain, maxAge)
 	} else {
-		resp, err := http.Get(fmt.Sprintf("https://%s/.well-known/nodeinfo", domain))
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-		wk := WellKnownNodeInfo{}
-		if err := json.NewDecoder(resp.Body).Decode(&wk); err != nil {
-			return err
-		}
-		var nodeInfoUrl string
-		for _, link := range wk.Links {
-			switch link.Rel {
-			default:
-				// continue
-			case "http://nodeinfo.diaspora.software/ns/schema/2.0":
-				fallthrough
-			case "http://nodeinfo.diaspora.software/ns/schema/2.1":
-				nodeInfoUrl = link.Href
-				break
-			}
-		}
-		if len(nodeInfoUrl) > 0 {
-			resp, err := http.Get(nodeInfoUrl)
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-			var resInfo struct {
-				Software Software `json:"software"`
-			}
-			if err := json.NewDecoder(resp.Body).Decode(&resInfo); err != nil {
-				return err
-			}
-			cache.Set(domain, resInfo.Software)
-			queryResponse.Software = resInfo.Software
-		}
+		queryResponse, err = client.LookupMaxAge(r.Context(), domain, maxAge)
+	}
+	if errors.Is(err, fedinfo.ErrLookupTimeout) {
+		queryResponse.Warnings = append(slices.Clip(queryResponse.Warnings), err.Error())
+	} else if err != nil {
+		return err
+	}
+	stripOptionalFields(r, &queryResponse)
+	if cleanVersion, _ := strconv.ParseBool(r.Form.Get("cleanversion")); cleanVersion {
+		queryResponse.Software.VersionDisplay = displayVersion(queryResponse.Software.Version)
+	}
+	if warning != "" {
+		queryResponse.Warnings = append(slices.Clip(queryResponse.Warnings), warning)
+	}
+	// ifVersionNot lets polling clients skip unchanged results. An unknown
+	// version never matches, so the full result is returned in that case.
+	if ifVersionNot := r.Form.Get("ifVersionNot"); ifVersionNot != "" && queryResponse.Software.Version != "" && queryResponse.Software.Version == ifVersionNot {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
 	}
+	queryResponse.HomographWarning = homographWarning
 	h := w.Header()
+	h.Add("Vary", "Accept")
+	if wantsProtobuf(r) {
+		h.Set("Content-Type", protobufContentType)
+		_, err := w.Write(marshalNodeInfoProto(queryResponse))
+		return err
+	}
 	h.Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(queryResponse); err != nil {
 		return err
@@ -214,44 +695,88 @@ func nodeInfoRoute(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-type Cache struct {
-	TTL time.Duration
-	Data map[string]Software
-	Age map[string]time.Time
-	lock sync.RWMutex
-}
-
-func (c *Cache) Get(key string) (sfw Software, foundAndNotStale bool) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.segfaultPrevention()
-	if age, ok := c.Age[key]; ok {
-		if time.Now().Sub(age) > c.TTL {
-			return sfw, false
-		}
-		sfw, foundAndNotStale = c.Data[key]
-		return sfw, foundAndNotStale
+// stripOptionalFields clears the fields of info that are only included on
+// request, with the languages, since and peers_count flags. Every route that
+// returns nodeinfo applies it, so that the flags mean the same everywhere.
+func stripOptionalFields(r *http.Request, info *fedinfo.NodeInfo) {
+	query := r.URL.Query()
+	if languages, _ := strconv.ParseBool(query.Get("languages")); !languages {
+		info.Languages = nil
+	}
+	if since, _ := strconv.ParseBool(query.Get("since")); !since {
+		info.InstanceSince = nil
 	}
-	if sfw, ok := c.Data[key]; ok {
-		c.Age[key] = time.Now()
-		return sfw, true
+	if peersCount, _ := strconv.ParseBool(query.Get("peers_count")); !peersCount {
+		info.PeerCount = nil
 	}
-	return sfw, false
 }
 
-func (c *Cache) Set(key string, sfw Software) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.segfaultPrevention()
-	c.Data[key] = sfw
-	c.Age[key] = time.Now()
+// versionTrimPatterns strip build and commit metadata from a version string,
+// applied in order, to obtain the version shown to humans.
+var versionTrimPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\+.*$`), // semver build metadata: 4.3.0+glitch.abc123
+	regexp.MustCompile(`(?i)-(unstable|nightly|dev|snapshot|git)\b.*$`), // 2024.5.0-unstable-a1b2c3
+	regexp.MustCompile(`[-.~]g?[0-9]*[a-f][0-9a-f]{5,}$`), // trailing commit hash: 0.16.0-1a2b3c4d
 }
 
-func (c *Cache) segfaultPrevention() {
-	if c.Data == nil {
-		c.Data = map[string]Software{}
+func displayVersion(version string) string {
+	for _, pattern := range versionTrimPatterns {
+		version = pattern.ReplaceAllString(version, "")
 	}
-	if c.Age == nil {
-		c.Age = map[string]time.Time{}
+	return strings.TrimSpace(version)
+}
+
+// minMaxAge is the lowest maxAge a client may request, so that clients can't
+// use it to bypass the cache entirely.
+const minMaxAge = 1*time.Minute
+
+type DomainInputPolicy string
+
+const (
+	DomainInputReject DomainInputPolicy = "reject"
+	DomainInputStripAndWarn DomainInputPolicy = "strip-and-warn"
+	DomainInputStripSilent DomainInputPolicy = "strip-silent"
+)
+
+// domainInputPolicy decides what happens to a domain parameter that carries
+// more than a host, such as https://example.social/about?lang=en.
+var domainInputPolicy = DomainInputStripAndWarn
+
+// parseDomainParam extracts the host from the domain parameter. Depending on
+// domainInputPolicy, extra url parts are rejected or stripped, in which case
+// a warning for the response may be returned.
+func parseDomainParam(param string) (domain, warning string, err error) {
+	raw := param
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw // without a schema, url.Parse would think the domain is the path
+	}
+	parsedDomain, err := url.Parse(raw)
+	if err != nil || parsedDomain.Host == "" {
+		return "", "", ErrBadRequest(fmt.Sprintf("not an url: %s", param))
+	}
+	if parsedDomain.Scheme != "https" && parsedDomain.Scheme != "http" {
+		return "", "", ErrBadRequest(fmt.Sprintf("unsupported scheme, instances are always queried over https: %s", param))
+	}
+	if parsedDomain.User != nil {
+		return "", "", ErrBadRequest(fmt.Sprintf("expected a domain without credentials: %s", param))
+	}
+	if parsedDomain.Port() != "" {
+		return "", "", ErrBadRequest(fmt.Sprintf("expected a domain without port: %s", param))
+	}
+	domain = strings.ToLower(parsedDomain.Hostname())
+	if !fedinfo.IsPublicHostname(domain) {
+		return "", "", ErrBadRequest(fmt.Sprintf("not a public domain name: %s", param))
+	}
+	if (parsedDomain.Path == "" || parsedDomain.Path == "/") && parsedDomain.RawQuery == "" && parsedDomain.Fragment == "" {
+		return domain, "", nil
+	}
+	switch domainInputPolicy {
+	case DomainInputReject:
+		return "", "", ErrBadRequest(fmt.Sprintf("expected a domain without path or query: %s", param))
+	case DomainInputStripSilent:
+		return domain, "", nil
+	default:
+		return domain, fmt.Sprintf("input was sanitized, path and query were dropped: using domain %s", domain), nil
 	}
 }
+
@@ -0,0 +1,338 @@
+package fedinfo
+
+import (
+	"log/slog"
+	"container/list"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+type Cache struct {
+	TTL time.Duration
+	// Jitter randomizes each entry's TTL by up to ±Jitter*TTL, so that
+	// entries stored together (e.g. when loading the cache file) don't all
+	// expire at the same instant.
+	Jitter float64
+	// RefreshAhead, if enabled, refreshes frequently accessed entries in
+	// the background shortly before they expire.
+	RefreshAhead RefreshAhead
+	// OnChange, if set, is called in its own goroutine whenever an existing
+	// entry is replaced.
+	OnChange func(key string, old, new NodeInfo)
+	// MaxEntries, if positive, bounds the number of entries. Set evicts the
+	// least recently used entry once it is exceeded.
+	MaxEntries int
+	Data map[string]NodeInfo
+	Age map[string]time.Time
+	lru *list.List // of keys, most recently used at the front
+	elems map[string]*list.Element
+	ttls map[string]time.Duration
+	hits map[string]int
+	refreshing map[string]bool
+	aliases map[string]string
+	dirty map[string]bool // set since the last Flush
+	lock sync.RWMutex
+}
+
+// CacheFile is what gets persisted of the cache. Entries are stored
+// together with their age, so they don't turn fresh again on a restart.
+type CacheFile struct {
+	// Version is bumped whenever the format changes. Fields added to
+	// NodeInfo don't need a bump, they are just missing from older entries.
+	Version int `json:"version"`
+	Data map[string]NodeInfo `json:"data"`
+	Age map[string]time.Time `json:"age"`
+	// Aliases maps domains to the key of the entry they resolve to, e.g.
+	// the www form of a domain to its apex. Added in version 3.
+	Aliases map[string]string `json:"aliases,omitempty"`
+}
+
+// CacheFileVersion is the version of the CacheFile format written. Version 1
+// didn't record it yet; before that, the file only held the data.
+const CacheFileVersion = 3
+
+type RefreshAhead struct {
+	Enabled bool
+	// Window before expiry in which a hit triggers a refresh.
+	Window time.Duration
+	// MinHits an entry must have received since it was last set to be
+	// considered hot enough for refreshing.
+	MinHits int
+	Refresh func(key string) (NodeInfo, error)
+}
+
+func (c *Cache) Get(key string) (info NodeInfo, foundAndNotStale bool) {
+	return c.GetMaxAge(key, 0)
+}
+
+// GetMaxAge is like Get, but additionally treats entries stored longer than
+// maxAge ago as stale. A maxAge of zero only applies the TTL.
+func (c *Cache) GetMaxAge(key string, maxAge time.Duration) (info NodeInfo, foundAndNotStale bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.segfaultPrevention()
+	if target, ok := c.aliases[key]; ok {
+		key = target
+	}
+	if age, ok := c.Age[key]; ok {
+		ttl := c.ttlOf(key)
+		if maxAge > 0 && maxAge < ttl {
+			ttl = maxAge
+		}
+		since := time.Now().Sub(age)
+		if since > ttl {
+			return info, false
+		}
+		info, foundAndNotStale = c.Data[key]
+		if foundAndNotStale {
+			c.hits[key]++
+			c.lru.MoveToFront(c.elems[key])
+			c.maybeRefreshAhead(key, ttl-since)
+		}
+		return info, foundAndNotStale
+	}
+	return info, false
+}
+
+// GetStale returns the entry of key even if it expired, as long as it did so
+// at most maxStale ago.
+func (c *Cache) GetStale(key string, maxStale time.Duration) (info NodeInfo, found bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.segfaultPrevention()
+	if target, ok := c.aliases[key]; ok {
+		key = target
+	}
+	age, ok := c.Age[key]
+	if !ok || time.Now().Sub(age) > c.ttlOf(key)+maxStale {
+		return info, false
+	}
+	info, found = c.Data[key]
+	if found {
+		c.lru.MoveToFront(c.elems[key])
+	}
+	return info, found
+}
+
+// ttlOf must be called with the lock held.
+func (c *Cache) ttlOf(key string) time.Duration {
+	if ttl, ok := c.ttls[key]; ok {
+		return ttl
+	}
+	return c.TTL
+}
+
+func (c *Cache) Set(key string, info NodeInfo) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.segfaultPrevention()
+	if old, ok := c.Data[key]; ok && c.OnChange != nil {
+		go c.OnChange(key, old, info)
+	}
+	c.Data[key] = info
+	c.Age[key] = time.Now()
+	c.ttls[key] = c.jitteredTTL()
+	c.dirty[key] = true
+	delete(c.hits, key)
+	delete(c.aliases, key)
+	c.touch(key)
+	c.evict()
+}
+
+// SetAge stores an entry that was set at age elsewhere, e.g. by another
+// replica, unless a more recent one is cached. Unlike Set, it doesn't call
+// OnChange or mark the entry for flushing, as it only catches up with a
+// change that was already handled.
+func (c *Cache) SetAge(key string, info NodeInfo, age time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.segfaultPrevention()
+	if existing, ok := c.Age[key]; ok && !existing.Before(age) {
+		return
+	}
+	c.Data[key] = info
+	c.Age[key] = age
+	c.ttls[key] = c.jitteredTTL()
+	delete(c.aliases, key)
+	c.touch(key)
+	c.evict()
+}
+
+// Load replaces the cached data with the contents of a cache file. Entries
+// without an age are considered stale.
+func (c *Cache) Load(file CacheFile) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Data, c.Age, c.lru, c.elems, c.ttls, c.hits, c.aliases, c.dirty = nil, nil, nil, nil, nil, nil, nil, nil
+	c.segfaultPrevention()
+	keys := slices.Collect(maps.Keys(file.Data))
+	slices.SortFunc(keys, func(a, b string) int {
+		return file.Age[a].Compare(file.Age[b])
+	})
+	for _, key := range keys {
+		c.Data[key] = file.Data[key]
+		c.Age[key] = file.Age[key]
+		c.ttls[key] = c.jitteredTTL()
+		c.touch(key)
+	}
+	c.evict()
+	for alias, key := range file.Aliases {
+		_, isEntry := c.Data[alias]
+		if _, ok := c.Data[key]; ok && !isEntry {
+			c.aliases[alias] = key
+		}
+	}
+}
+
+// Dump returns a copy of the cached data, ages and aliases.
+func (c *Cache) Dump() CacheFile {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return CacheFile{
+		Version: CacheFileVersion,
+		Data: maps.Clone(c.Data),
+		Age: maps.Clone(c.Age),
+		Aliases: maps.Clone(c.aliases),
+	}
+}
+
+// touch marks key as most recently used, it must be called with the lock held.
+func (c *Cache) touch(key string) {
+	if elem, ok := c.elems[key]; ok {
+		c.lru.MoveToFront(elem)
+	} else {
+		c.elems[key] = c.lru.PushFront(key)
+	}
+}
+
+// evict drops the least recently used entries beyond MaxEntries, it must be
+// called with the lock held.
+func (c *Cache) evict() {
+	if c.MaxEntries <= 0 {
+		return
+	}
+	for c.lru.Len() > c.MaxEntries {
+		key := c.lru.Remove(c.lru.Back()).(string)
+		delete(c.elems, key)
+		delete(c.Data, key)
+		delete(c.Age, key)
+		delete(c.ttls, key)
+		delete(c.hits, key)
+		delete(c.dirty, key)
+		for alias, target := range c.aliases {
+			if target == key {
+				delete(c.aliases, alias)
+			}
+		}
+	}
+}
+
+// Alias makes lookups of alias return the entry stored under key.
+func (c *Cache) Alias(alias, key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.segfaultPrevention()
+	delete(c.Data, alias)
+	delete(c.Age, alias)
+	delete(c.ttls, alias)
+	if elem, ok := c.elems[alias]; ok {
+		c.lru.Remove(elem)
+		delete(c.elems, alias)
+	}
+	c.aliases[alias] = key
+	c.dirty[key] = true // so the alias is flushed along with it
+}
+
+// maybeRefreshAhead must be called with the lock held.
+func (c *Cache) maybeRefreshAhead(key string, remaining time.Duration) {
+	ra := c.RefreshAhead
+	if !ra.Enabled || ra.Refresh == nil || remaining > ra.Window || c.hits[key] < ra.MinHits || c.refreshing[key] {
+		return
+	}
+	c.refreshing[key] = true
+	go func() {
+		info, err := ra.Refresh(key)
+		if err != nil {
+			slog.Warn("failed to refresh ahead of expiry", "domain", key, "error", err)
+		} else {
+			c.Set(key, info)
+		}
+		c.lock.Lock()
+		delete(c.refreshing, key)
+		c.lock.Unlock()
+	}()
+}
+
+// Range calls fn for every cached entry, stale or not, until fn returns
+// false. The cache is locked for reading meanwhile, so fn must not modify it.
+func (c *Cache) Range(fn func(key string, info NodeInfo) bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for key, info := range c.Data {
+		if !fn(key, info) {
+			return
+		}
+	}
+}
+
+// Len returns the number of cached entries, stale or not.
+func (c *Cache) Len() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.Data)
+}
+
+// Snapshot returns a copy of the cached data.
+func (c *Cache) Snapshot() map[string]NodeInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	snapshot := make(map[string]NodeInfo, len(c.Data))
+	for key, info := range c.Data {
+		snapshot[key] = info
+	}
+	return snapshot
+}
+
+func (c *Cache) jitteredTTL() time.Duration {
+	return jitterTTL(c.TTL, c.Jitter)
+}
+
+// jitterTTL randomizes ttl by up to ±jitter*ttl.
+func jitterTTL(ttl time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return ttl
+	}
+	offset := (rand.Float64()*2 - 1) * jitter * float64(ttl)
+	return ttl + time.Duration(offset)
+}
+
+func (c *Cache) segfaultPrevention() {
+	if c.Data == nil {
+		c.Data = map[string]NodeInfo{}
+	}
+	if c.Age == nil {
+		c.Age = map[string]time.Time{}
+	}
+	if c.lru == nil {
+		c.lru = list.New()
+		c.elems = map[string]*list.Element{}
+	}
+	if c.ttls == nil {
+		c.ttls = map[string]time.Duration{}
+	}
+	if c.hits == nil {
+		c.hits = map[string]int{}
+	}
+	if c.refreshing == nil {
+		c.refreshing = map[string]bool{}
+	}
+	if c.aliases == nil {
+		c.aliases = map[string]string{}
+	}
+	if c.dirty == nil {
+		c.dirty = map[string]bool{}
+	}
+}
@@ -0,0 +1,195 @@
+package fedinfo
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJitteredTTL(t *testing.T) {
+	const ttl = time.Hour
+	if got := (&Cache{TTL: ttl}).jitteredTTL(); got != ttl {
+		t.Errorf("without jitter: got %s, want %s", got, ttl)
+	}
+	c := &Cache{TTL: ttl, Jitter: 0.1}
+	for range 1000 {
+		if got := c.jitteredTTL(); got < 54*time.Minute || got > 66*time.Minute {
+			t.Fatalf("got %s, want within 10%% of %s", got, ttl)
+		}
+	}
+}
+
+func TestCacheJitterSpreadsExpiry(t *testing.T) {
+	now := time.Now()
+	file := CacheFile{Data: map[string]NodeInfo{}, Age: map[string]time.Time{}}
+	for i := range 100 {
+		domain := fmt.Sprintf("%d.example.test", i)
+		file.Data[domain] = NodeInfo{Domain: domain}
+		file.Age[domain] = now
+	}
+	c := &Cache{TTL: time.Hour, Jitter: 0.1}
+	c.Load(file)
+	c.Set("set.example.test", NodeInfo{})
+	c.Set("together.example.test", NodeInfo{})
+	expiries := map[time.Duration]bool{}
+	for key, ttl := range c.ttls {
+		if ttl < 54*time.Minute || ttl > 66*time.Minute {
+			t.Errorf("%s: got ttl %s, want within 10%% of an hour", key, ttl)
+		}
+		expiries[ttl] = true
+	}
+	if len(expiries) < 90 {
+		t.Errorf("102 entries stored together expire at only %d different times", len(expiries))
+	}
+}
+
+func TestCachePersistsAge(t *testing.T) {
+	store := &JSONFileStore{Path: filepath.Join(t.TempDir(), "cache.json")}
+	cache := &Cache{TTL: time.Hour}
+	cache.Set("fresh.example.test", NodeInfo{Domain: "fresh.example.test"})
+	cache.SetAge("stale.example.test", NodeInfo{Domain: "stale.example.test"}, time.Now().Add(-2*time.Hour))
+	cache.Alias("www.fresh.example.test", "fresh.example.test")
+	if err := store.Put(context.Background(), cache.Dump()); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := &JSONFileStore{Path: store.Path}
+	contents, err := reopened.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := &Cache{TTL: time.Hour}
+	restarted.Load(contents)
+	if _, ok := restarted.Get("fresh.example.test"); !ok {
+		t.Error("fresh entry is stale after reopening the cache file")
+	}
+	if _, ok := restarted.Get("stale.example.test"); ok {
+		t.Error("entry older than the TTL is fresh after reopening the cache file")
+	}
+	if _, ok := restarted.GetStale("stale.example.test", 2*time.Hour); !ok {
+		t.Error("stale entry was lost when reopening the cache file")
+	}
+	if info, ok := restarted.Get("www.fresh.example.test"); !ok || info.Domain != "fresh.example.test" {
+		t.Errorf("alias: got %+v, want the entry of fresh.example.test", info)
+	}
+
+	flushed := &JSONFileStore{Path: filepath.Join(t.TempDir(), "cache.json")}
+	if err := cache.Flush(context.Background(), flushed); err != nil {
+		t.Fatal(err)
+	}
+	contents, err = (&JSONFileStore{Path: flushed.Path}).Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents.Aliases["www.fresh.example.test"] != "fresh.example.test" {
+		t.Errorf("flush: got aliases %v", contents.Aliases)
+	}
+}
+
+func TestCacheLoadResets(t *testing.T) {
+	c := &Cache{TTL: time.Hour}
+	c.Set("example.test", NodeInfo{Domain: "example.test"})
+	c.Alias("www.example.test", "example.test")
+	c.Get("example.test")
+	c.Load(CacheFile{
+		Data: map[string]NodeInfo{"example.test": {Domain: "example.test"}, "other.example.test": {}},
+		Age: map[string]time.Time{"example.test": time.Now(), "other.example.test": time.Now()},
+		Aliases: map[string]string{
+			"www.other.example.test": "other.example.test",
+			"www.gone.example.test": "gone.example.test",
+			"other.example.test": "example.test", // an entry itself
+		},
+	})
+	if _, ok := c.Get("www.example.test"); ok {
+		t.Error("alias survived loading a file without it")
+	}
+	if c.hits["example.test"] != 0 {
+		t.Errorf("got %d hits after loading, want 0", c.hits["example.test"])
+	}
+	if _, ok := c.Get("www.other.example.test"); !ok {
+		t.Error("alias from the file wasn't loaded")
+	}
+	if len(c.aliases) != 1 {
+		t.Errorf("got aliases %v, want only www.other.example.test", c.aliases)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := &Cache{TTL: time.Hour, MaxEntries: 2}
+	c.Set("a.example.test", NodeInfo{})
+	c.Set("b.example.test", NodeInfo{})
+	c.Get("a.example.test")
+	c.Set("c.example.test", NodeInfo{})
+	for key, want := range map[string]bool{
+		"a.example.test": true,
+		"b.example.test": false,
+		"c.example.test": true,
+	} {
+		if _, ok := c.Get(key); ok != want {
+			t.Errorf("%s: got cached: %t, want cached: %t", key, ok, want)
+		}
+	}
+	if len(c.Data) != 2 || len(c.Age) != 2 {
+		t.Errorf("got %d entries and %d ages, want 2", len(c.Data), len(c.Age))
+	}
+}
+
+func TestCacheRefreshAhead(t *testing.T) {
+	refreshed := make(chan string, 1)
+	c := &Cache{
+		TTL: time.Hour,
+		RefreshAhead: RefreshAhead{
+			Enabled: true,
+			Window: 30*time.Minute,
+			MinHits: 2,
+			Refresh: func(key string) (NodeInfo, error) {
+				refreshed <- key
+				return NodeInfo{Domain: key, Software: Software{Name: "mastodon", Version: "4.3.2"}}, nil
+			},
+		},
+	}
+	c.Load(CacheFile{
+		Data: map[string]NodeInfo{"hot.example.test": {}},
+		Age: map[string]time.Time{"hot.example.test": time.Now().Add(-45*time.Minute)},
+	})
+	c.Set("cold.example.test", NodeInfo{})
+	for range 3 {
+		c.Get("cold.example.test")
+	}
+	c.Get("hot.example.test")
+	select {
+	case key := <-refreshed:
+		t.Fatalf("%s was refreshed before reaching MinHits", key)
+	case <-time.After(50*time.Millisecond):
+	}
+	c.Get("hot.example.test")
+	select {
+	case key := <-refreshed:
+		if key != "hot.example.test" {
+			t.Errorf("refreshed %s, want hot.example.test", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("entry close to expiry wasn't refreshed")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, ok := c.Get("hot.example.test")
+		if ok && info.Software.Name == "mastodon" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %+v, want the refreshed entry", info)
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+func TestDumpWritesVersion(t *testing.T) {
+	c := &Cache{TTL: time.Hour}
+	c.Set("example.social", NodeInfo{Domain: "example.social"})
+	if got := c.Dump().Version; got != CacheFileVersion {
+		t.Errorf("got version %d, want %d", got, CacheFileVersion)
+	}
+}
@@ -0,0 +1,420 @@
+// Package fedinfo discovers which software a fediverse instance runs, from
+// its nodeinfo or, failing that, from other apis it serves.
+package fedinfo
+
+import (
+	"log/slog"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Store is the cache backend of a Client. Cache implements it in memory.
+type Store interface {
+	// GetMaxAge returns the entry of key (or of what key is an alias of),
+	// unless it is older than its TTL or maxAge, if positive.
+	GetMaxAge(key string, maxAge time.Duration) (info NodeInfo, foundAndNotStale bool)
+	// GetStale returns the entry of key even if it expired, as long as it
+	// did so at most maxStale ago.
+	GetStale(key string, maxStale time.Duration) (info NodeInfo, found bool)
+	Set(key string, info NodeInfo)
+	// SetAge stores an entry that was set at age, unless a more recent one
+	// is stored.
+	SetAge(key string, info NodeInfo, age time.Time)
+	// Alias makes lookups of alias return the entry stored under key.
+	Alias(alias, key string)
+}
+
+// Client looks up instances. Its zero value is usable, with a default http
+// client and an in-memory cache.
+type Client struct {
+	// HTTPClient is used for all requests to instances, see NewHTTPClient.
+	HTTPClient *http.Client
+	// Cache stores the results of Lookup. If nil, an in-memory Cache with
+	// TTL is used.
+	Cache Store
+	// Backend, if set, is consulted whenever Cache misses, to pick up
+	// entries stored by other replicas or before a restart. Writing to it
+	// is left to the owner of Cache, see Cache.Flush.
+	Backend CacheStore
+	// BackendPolicy decides what happens to lookups while Backend can't be
+	// read, defaults to BackendFailOpen.
+	BackendPolicy BackendPolicy
+	TTL time.Duration
+	// NegativeTTL is how long failed lookups are remembered, so that an
+	// instance that is down isn't queried again on every request. Defaults
+	// to a minute, negative values disable it.
+	NegativeTTL time.Duration
+	// ProbeCooldown, if positive, lets LookupRefresh probe a domain whose
+	// failed lookup is remembered, to recover an instance that came back
+	// before NegativeTTL is up. Each domain is probed at most once per
+	// ProbeCooldown, so that refreshing can't be used to hammer instances
+	// that are down.
+	ProbeCooldown time.Duration
+	// StaleWhileRevalidate, if positive, lets Lookup return entries that
+	// expired at most this long ago, while refreshing them in the background.
+	StaleWhileRevalidate time.Duration
+	// MaxDuration caps the total time spent on a single lookup, including
+	// all fallbacks, defaults to 30 seconds.
+	MaxDuration time.Duration
+	// MaxBodyBytes caps the size of responses read from instances, larger
+	// ones fail the request. Defaults to 1 MiB. Peer lists have their own,
+	// higher limit.
+	MaxBodyBytes int64
+	// MixedContentPolicy decides what to do with http nodeinfo hrefs
+	// advertised by a well-known document fetched over https, which are a
+	// downgrade and usually a misconfiguration.
+	MixedContentPolicy MixedContentPolicy
+	// Rewrites relabel the software reported by instances.
+	Rewrites RewriteRules
+	// Detectors are tried in order if nodeinfo discovery fails, the first
+	// one that succeeds wins. If nil, DefaultDetectors are used.
+	Detectors []Detector
+	// Accounts caches the results of LookupAccount. If nil, an AccountCache
+	// with the TTL and Jitter of Cache is used.
+	Accounts *AccountCache
+	// OnResolve, if set, is called after every uncached lookup.
+	OnResolve func(domain string, start time.Time, info NodeInfo, err error)
+	// OnCache, if set, is called with how each Lookup was served.
+	OnCache func(domain string, result CacheResult)
+
+	init sync.Once
+	lookups singleflight.Group
+	accountLookups singleflight.Group
+	failuresLock sync.Mutex
+	failures map[string]failure
+	strictChecks map[string]failure // guarded by failuresLock too
+}
+
+// failure is a negatively cached lookup, or the outcome of a strict check.
+type failure struct {
+	info NodeInfo
+	err error
+	until time.Time
+	probed time.Time // last time LookupRefresh probed the domain anyway
+}
+
+// CacheResult tells how a Lookup was served.
+type CacheResult string
+
+const (
+	CacheHit CacheResult = "hit"
+	// CacheBackendHit is a fresh entry found in the Backend only.
+	CacheBackendHit CacheResult = "backend"
+	// CacheStale is an expired entry served while it is revalidated.
+	CacheStale CacheResult = "stale"
+	// CacheNegativeHit is a remembered failure.
+	CacheNegativeHit CacheResult = "negative"
+	CacheMiss CacheResult = "miss"
+)
+
+// maxFailures bounds the number of negatively cached lookups, beyond it
+// expired ones are dropped first, then arbitrary ones.
+const maxFailures = 10_000
+
+const (
+	DefaultTTL = 1*time.Hour
+	DefaultMaxDuration = 30*time.Second
+	DefaultNegativeTTL = 1*time.Minute
+	DefaultMaxBodyBytes = 1 << 20
+)
+
+var defaultHTTPClient = NewHTTPClient(NewTransport(IPFamilyAuto), 10*time.Second, 10)
+
+// ErrLookupTimeout is wrapped by the error of lookups that exceeded the
+// client's MaxDuration, which come with a partial result.
+var ErrLookupTimeout = errors.New("timeout")
+
+func (c *Client) setDefaults() {
+	c.init.Do(func() {
+		if c.Cache == nil {
+			ttl := c.TTL
+			if ttl <= 0 {
+				ttl = DefaultTTL
+			}
+			c.Cache = &Cache{TTL: ttl}
+		}
+		if c.Accounts == nil {
+			c.Accounts = &AccountCache{TTL: DefaultTTL, MaxEntries: DefaultMaxAccounts}
+			if cache, ok := c.Cache.(*Cache); ok {
+				c.Accounts.TTL, c.Accounts.Jitter = cache.TTL, cache.Jitter
+			}
+		}
+	})
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return defaultHTTPClient
+	}
+	return c.HTTPClient
+}
+
+func (c *Client) maxDuration() time.Duration {
+	if c.MaxDuration <= 0 {
+		return DefaultMaxDuration
+	}
+	return c.MaxDuration
+}
+
+func (c *Client) maxBodyBytes() int64 {
+	if c.MaxBodyBytes <= 0 {
+		return DefaultMaxBodyBytes
+	}
+	return c.MaxBodyBytes
+}
+
+// Lookup returns the nodeinfo of domain, from the cache if possible.
+func (c *Client) Lookup(ctx context.Context, domain string) (NodeInfo, error) {
+	return c.LookupMaxAge(ctx, domain, 0)
+}
+
+// LookupMaxAge is like Lookup, but additionally treats cached results older
+// than maxAge as stale. A maxAge of zero only applies the TTL. Stale entries
+// are only served if maxAge is zero.
+//
+// Concurrent lookups of the same domain share a single request to the
+// instance.
+func (c *Client) LookupMaxAge(ctx context.Context, domain string, maxAge time.Duration) (NodeInfo, error) {
+	c.setDefaults()
+	if info, ok := c.Cache.GetMaxAge(domain, maxAge); ok {
+		c.observe(domain, CacheHit)
+		return fromAlias(domain, info), nil
+	}
+	if err := c.loadFromBackend(ctx, domain); err != nil {
+		return NodeInfo{Domain: domain}, err
+	}
+	if info, ok := c.Cache.GetMaxAge(domain, maxAge); ok {
+		c.observe(domain, CacheBackendHit)
+		return fromAlias(domain, info), nil
+	}
+	failed, failedErr, hasFailed := c.cachedFailure(domain)
+	if maxAge == 0 && c.StaleWhileRevalidate > 0 {
+		if info, ok := c.Cache.GetStale(domain, c.StaleWhileRevalidate); ok {
+			if !hasFailed {
+				c.resolveShared(ctx, domain)
+			}
+			c.observe(domain, CacheStale)
+			return fromAlias(domain, info), nil
+		}
+	}
+	if hasFailed {
+		c.observe(domain, CacheNegativeHit)
+		return failed, failedErr
+	}
+	c.observe(domain, CacheMiss)
+	select {
+	case <-ctx.Done():
+		return NodeInfo{Domain: domain}, ctx.Err()
+	case res := <-c.resolveShared(ctx, domain):
+		return res.Val.(NodeInfo), res.Err
+	}
+}
+
+// resolveShared resolves domain and caches the result, or remembers the
+// failure, unless the same is already in flight. The lookup must not be
+// cancelled just because the client that started it left.
+func (c *Client) resolveShared(ctx context.Context, domain string) <-chan singleflight.Result {
+	return c.lookups.DoChan(domain, func() (any, error) {
+		info, err := c.Resolve(context.WithoutCancel(ctx), domain, false)
+		if err == nil {
+			c.Store(domain, info)
+		} else {
+			c.storeFailure(domain, info, err)
+		}
+		return info, err
+	})
+}
+
+func (c *Client) observe(domain string, result CacheResult) {
+	if c.OnCache != nil {
+		c.OnCache(domain, result)
+	}
+}
+
+// loadFromBackend copies the entry of domain from the backend into the
+// cache, whether it is stale or not.
+func (c *Client) loadFromBackend(ctx context.Context, domain string) error {
+	if c.Backend == nil {
+		return nil
+	}
+	info, age, found, err := c.Backend.Get(ctx, domain)
+	if err != nil {
+		if c.BackendPolicy == BackendFailClosed {
+			return ErrCacheUnavailable{Err: err}
+		}
+		slog.Warn("cache backend unavailable, looking up without it", "domain", domain, "error", err)
+		return nil
+	}
+	if found {
+		c.Cache.SetAge(domain, info, age)
+	}
+	return nil
+}
+
+// fromAlias presents an entry found through an alias as the queried domain.
+func fromAlias(domain string, info NodeInfo) NodeInfo {
+	if info.Domain != domain {
+		info.CanonicalDomain = info.Domain
+		info.Domain = domain
+	}
+	return info
+}
+
+func (c *Client) cachedFailure(domain string) (NodeInfo, error, bool) {
+	c.failuresLock.Lock()
+	defer c.failuresLock.Unlock()
+	f, ok := c.failures[domain]
+	if !ok || time.Now().After(f.until) {
+		return NodeInfo{}, nil, false
+	}
+	return f.info, f.err, true
+}
+
+// negativeTTL is negative if failures aren't to be cached.
+func (c *Client) negativeTTL() time.Duration {
+	if c.NegativeTTL == 0 {
+		return DefaultNegativeTTL
+	}
+	return c.NegativeTTL
+}
+
+func (c *Client) storeFailure(domain string, info NodeInfo, err error) {
+	ttl := c.negativeTTL()
+	if ttl < 0 {
+		return
+	}
+	c.failuresLock.Lock()
+	defer c.failuresLock.Unlock()
+	if c.failures == nil {
+		c.failures = map[string]failure{}
+	}
+	probed := c.failures[domain].probed
+	storeBounded(c.failures, domain, failure{info: info, err: err, until: time.Now().Add(ttl), probed: probed})
+}
+
+// Refresh resolves domain again, regardless of what is cached, and caches the
+// result like Lookup. It shares a single request with concurrent lookups of
+// the same domain.
+func (c *Client) Refresh(ctx context.Context, domain string) (NodeInfo, error) {
+	c.setDefaults()
+	select {
+	case <-ctx.Done():
+		return NodeInfo{Domain: domain}, ctx.Err()
+	case res := <-c.resolveShared(ctx, domain):
+		return res.Val.(NodeInfo), res.Err
+	}
+}
+
+// LookupRefresh is like LookupMaxAge, but if a failed lookup of domain is
+// remembered, it probes the instance again, as long as it hasn't done so in
+// the last ProbeCooldown. A successful probe clears the failure. Without a
+// ProbeCooldown, the failure is returned right away, like by Lookup.
+func (c *Client) LookupRefresh(ctx context.Context, domain string, maxAge time.Duration) (NodeInfo, error) {
+	c.setDefaults()
+	if !c.claimProbe(domain) {
+		return c.LookupMaxAge(ctx, domain, maxAge)
+	}
+	c.observe(domain, CacheMiss)
+	select {
+	case <-ctx.Done():
+		return NodeInfo{Domain: domain}, ctx.Err()
+	case res := <-c.resolveShared(ctx, domain):
+		return res.Val.(NodeInfo), res.Err
+	}
+}
+
+// claimProbe reports whether domain has a remembered failure that may be
+// probed now, and if so, records the probe.
+func (c *Client) claimProbe(domain string) bool {
+	if c.ProbeCooldown <= 0 {
+		return false
+	}
+	c.failuresLock.Lock()
+	defer c.failuresLock.Unlock()
+	f, ok := c.failures[domain]
+	now := time.Now()
+	if !ok || now.After(f.until) || now.Sub(f.probed) < c.ProbeCooldown {
+		return false
+	}
+	f.probed = now
+	c.failures[domain] = f
+	return true
+}
+
+// storeBounded adds f to failures, first making room if there are already
+// maxFailures of them.
+func storeBounded(failures map[string]failure, domain string, f failure) {
+	now := time.Now()
+	if len(failures) >= maxFailures {
+		for key, f := range failures {
+			if now.After(f.until) {
+				delete(failures, key)
+			}
+		}
+		for key := range failures {
+			if len(failures) < maxFailures {
+				break
+			}
+			delete(failures, key)
+		}
+	}
+	failures[domain] = f
+}
+
+// LookupStrict checks the current nodeinfo of domain in strict mode, see
+// Resolve. Concurrent checks of the same domain share a single request, and
+// the outcome is reused for maxAge, so that checks don't bypass the cache
+// altogether. A successful result is cached like that of Lookup.
+func (c *Client) LookupStrict(ctx context.Context, domain string, maxAge time.Duration) (NodeInfo, error) {
+	c.setDefaults()
+	c.failuresLock.Lock()
+	checked, ok := c.strictChecks[domain]
+	c.failuresLock.Unlock()
+	if ok && time.Now().Before(checked.until) {
+		return checked.info, checked.err
+	}
+	res := c.lookups.DoChan("strict:"+domain, func() (any, error) {
+		info, err := c.Resolve(context.WithoutCancel(ctx), domain, true)
+		if err == nil {
+			c.Store(domain, info)
+		}
+		if err == nil || errors.As(err, new(ErrUpstreamInvalid)) {
+			c.failuresLock.Lock()
+			if c.strictChecks == nil {
+				c.strictChecks = map[string]failure{}
+			}
+			storeBounded(c.strictChecks, domain, failure{info: info, err: err, until: time.Now().Add(maxAge)})
+			c.failuresLock.Unlock()
+		}
+		return info, err
+	})
+	select {
+	case <-ctx.Done():
+		return NodeInfo{Domain: domain}, ctx.Err()
+	case res := <-res:
+		return res.Val.(NodeInfo), res.Err
+	}
+}
+
+// Store caches info under its canonical domain, making the queried domain
+// an alias of it, so that apex and www don't end up as separate entries.
+func (c *Client) Store(domain string, info NodeInfo) {
+	c.setDefaults()
+	c.failuresLock.Lock()
+	delete(c.failures, domain)
+	c.failuresLock.Unlock()
+	if info.CanonicalDomain == "" || info.CanonicalDomain == domain {
+		c.Cache.Set(domain, info)
+		return
+	}
+	canonical := info
+	canonical.Domain = info.CanonicalDomain
+	canonical.CanonicalDomain = ""
+	c.Cache.Set(canonical.Domain, canonical)
+	c.Cache.Alias(domain, canonical.Domain)
+}
@@ -0,0 +1,382 @@
+package fedinfo
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLookupRefreshProbesAfterCooldown(t *testing.T) {
+	var up atomic.Bool
+	counter := &hitCounter{next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		fixtures{
+			"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+			"example.test/nodeinfo/2.0": mastodonNodeInfo,
+		}.ServeHTTP(w, r)
+	})}
+	c := newTestClient(t, counter)
+	c.NegativeTTL = time.Hour
+	c.ProbeCooldown = 100*time.Millisecond
+	ctx := context.Background()
+	hits := func() int {
+		return counter.count("example.test/.well-known/nodeinfo")
+	}
+
+	if _, err := c.Lookup(ctx, "example.test"); err == nil {
+		t.Fatal("lookup of a down instance succeeded")
+	}
+	if _, err := c.Lookup(ctx, "example.test"); err == nil || hits() != 1 {
+		t.Fatalf("got %v after %d requests, want the remembered failure", err, hits())
+	}
+	if _, err := c.LookupRefresh(ctx, "example.test", 0); err == nil || hits() != 2 {
+		t.Fatalf("got %v after %d requests, want a failed probe", err, hits())
+	}
+	up.Store(true)
+	if _, err := c.LookupRefresh(ctx, "example.test", 0); err == nil || hits() != 2 {
+		t.Fatalf("got %v after %d requests, want the failure during the cooldown", err, hits())
+	}
+	time.Sleep(c.ProbeCooldown)
+	if info, err := c.LookupRefresh(ctx, "example.test", 0); err != nil || info.Software.Name != "mastodon" || hits() != 3 {
+		t.Fatalf("got %+v, %v after %d requests, want a successful probe", info, err, hits())
+	}
+	if info, err := c.Lookup(ctx, "example.test"); err != nil || info.Software.Name != "mastodon" || hits() != 3 {
+		t.Errorf("got %+v, %v after %d requests, want the cached result", info, err, hits())
+	}
+}
+
+func TestLookupRefreshWithoutCooldown(t *testing.T) {
+	counter := &hitCounter{next: fixtures{}}
+	c := newTestClient(t, counter)
+	c.NegativeTTL = time.Hour
+	for range 3 {
+		if _, err := c.LookupRefresh(context.Background(), "example.test", 0); err == nil {
+			t.Fatal("lookup of a down instance succeeded")
+		}
+	}
+	if hits := counter.count("example.test/.well-known/nodeinfo"); hits != 1 {
+		t.Errorf("got %d requests, want 1", hits)
+	}
+}
+
+// failingStore is a backend that is down.
+type failingStore struct{}
+
+var errStoreDown = errors.New("connection refused")
+
+func (failingStore) Load(ctx context.Context) (CacheFile, error) {
+	return CacheFile{}, errStoreDown
+}
+
+func (failingStore) Get(ctx context.Context, key string) (NodeInfo, time.Time, bool, error) {
+	return NodeInfo{}, time.Time{}, false, errStoreDown
+}
+
+func (failingStore) Put(ctx context.Context, file CacheFile) error {
+	return errStoreDown
+}
+
+func (failingStore) Close() error {
+	return nil
+}
+
+func TestBackendPolicy(t *testing.T) {
+	instance := fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+	}
+
+	c := newTestClient(t, instance)
+	c.Backend = failingStore{}
+	info, err := c.Lookup(context.Background(), "example.test")
+	if err != nil || info.Software.Name != "mastodon" {
+		t.Errorf("fail-open: got %+v, %v, want the looked up result", info, err)
+	}
+
+	c = newTestClient(t, instance)
+	c.Backend = failingStore{}
+	c.BackendPolicy = BackendFailClosed
+	_, err = c.Lookup(context.Background(), "example.test")
+	var unavailable ErrCacheUnavailable
+	if !errors.As(err, &unavailable) || !errors.Is(err, errStoreDown) || unavailable.StatusCode() != http.StatusServiceUnavailable {
+		t.Errorf("fail-closed: got %v, want ErrCacheUnavailable", err)
+	}
+	if ErrorClass(err) != "cache" {
+		t.Errorf("fail-closed: got error class %s, want cache", ErrorClass(err))
+	}
+}
+
+// gated holds requests until release is closed, and reports the first one on
+// arrived.
+type gated struct {
+	next http.Handler
+	arrived chan struct{}
+	release chan struct{}
+	once sync.Once
+}
+
+func newGated(next http.Handler) *gated {
+	return &gated{next: next, arrived: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (g *gated) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.once.Do(func() { close(g.arrived) })
+	<-g.release
+	g.next.ServeHTTP(w, r)
+}
+
+func TestLookupCoalesces(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		instance fixtures
+		wantErr bool
+	}{
+		{"success", fixtures{
+			"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+			"example.test/nodeinfo/2.0": mastodonNodeInfo,
+		}, false},
+		{"failure", fixtures{}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			gate := newGated(test.instance)
+			counter := &hitCounter{next: gate}
+			c := newTestClient(t, counter)
+			const n = 20
+			results := make(chan error, n)
+			for range n {
+				go func() {
+					_, err := c.Lookup(context.Background(), "example.test")
+					results <- err
+				}()
+			}
+			<-gate.arrived
+			time.Sleep(50*time.Millisecond) // let the others join the lookup in flight
+			close(gate.release)
+			for range n {
+				if err := <-results; (err != nil) != test.wantErr {
+					t.Errorf("got error %v, want error: %t", err, test.wantErr)
+				}
+			}
+			if hits := counter.count("example.test/.well-known/nodeinfo"); hits != 1 {
+				t.Errorf("got %d upstream requests, want 1", hits)
+			}
+			if _, ok := c.Cache.GetMaxAge("example.test", 0); ok == test.wantErr {
+				t.Errorf("got cached: %t, want cached: %t", ok, !test.wantErr)
+			}
+		})
+	}
+}
+
+func TestLookupSurvivesCancelledCaller(t *testing.T) {
+	gate := newGated(fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+	})
+	counter := &hitCounter{next: gate}
+	c := newTestClient(t, counter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := c.Lookup(ctx, "example.test")
+		cancelled <- err
+	}()
+	<-gate.arrived
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := c.Lookup(context.Background(), "example.test")
+		waiting <- err
+	}()
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled caller: got %v, want context.Canceled", err)
+	}
+	close(gate.release)
+	if err := <-waiting; err != nil {
+		t.Errorf("other caller: got %v, want the shared result", err)
+	}
+	if hits := counter.count("example.test/.well-known/nodeinfo"); hits != 1 {
+		t.Errorf("got %d upstream requests, want 1", hits)
+	}
+}
+
+func TestLookupMaxDuration(t *testing.T) {
+	// every step of the discovery takes a while, and none of them succeeds
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(100*time.Millisecond):
+		case <-r.Context().Done():
+		}
+		http.NotFound(w, r)
+	})
+	counter := &hitCounter{next: slow}
+	c := newTestClient(t, counter)
+	c.MaxDuration = 150*time.Millisecond
+	start := time.Now()
+	info, err := c.Lookup(context.Background(), "example.test")
+	if took := time.Since(start); took > c.MaxDuration+200*time.Millisecond {
+		t.Errorf("lookup took %s, want at most about %s", took, c.MaxDuration)
+	}
+	if !errors.Is(err, ErrLookupTimeout) || ErrorClass(err) != "timeout" {
+		t.Errorf("got %v, want ErrLookupTimeout", err)
+	}
+	if info.Domain != "example.test" {
+		t.Errorf("got %+v, want the partial result", info)
+	}
+	if counter.count("example.test/.well-known/nodeinfo") != 1 || counter.count("example.test/.well-known/host-meta") != 1 {
+		t.Error("lookup timed out before trying more than one step")
+	}
+}
+
+func TestLookupCanonicalDomain(t *testing.T) {
+	for _, test := range []struct {
+		queried, canonical string
+	}{
+		{"example.test", "www.example.test"},
+		{"www.example.test", "example.test"},
+	} {
+		t.Run(test.queried, func(t *testing.T) {
+			instance := fixtures{
+				test.canonical + "/.well-known/nodeinfo": wellKnown(test.canonical),
+				test.canonical + "/nodeinfo/2.0": mastodonNodeInfo,
+			}
+			counter := &hitCounter{next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Host == test.queried {
+					http.Redirect(w, r, "https://"+test.canonical+r.URL.Path, http.StatusMovedPermanently)
+					return
+				}
+				instance.ServeHTTP(w, r)
+			})}
+			c := newTestClient(t, counter)
+
+			info, err := c.Lookup(context.Background(), test.queried)
+			if err != nil || info.Domain != test.queried || info.CanonicalDomain != test.canonical || info.Software.Name != "mastodon" {
+				t.Fatalf("got %+v, %v, want %s found at %s", info, err, test.queried, test.canonical)
+			}
+			if cached, ok := c.Cache.GetMaxAge(test.canonical, 0); !ok || cached.Domain != test.canonical || cached.CanonicalDomain != "" {
+				t.Errorf("got %+v cached under %s, want the canonical entry", cached, test.canonical)
+			}
+			info, err = c.Lookup(context.Background(), test.canonical)
+			if err != nil || info.Domain != test.canonical || info.CanonicalDomain != "" {
+				t.Errorf("got %+v, %v for the canonical domain", info, err)
+			}
+			if info, err := c.Lookup(context.Background(), test.queried); err != nil || info.CanonicalDomain != test.canonical {
+				t.Errorf("got %+v, %v through the alias", info, err)
+			}
+			if hits := counter.count(test.canonical + "/.well-known/nodeinfo"); hits != 1 {
+				t.Errorf("got %d requests to the canonical domain, want 1", hits)
+			}
+		})
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	instance := fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+	}
+	release := make(chan struct{})
+	counter := &hitCounter{next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nodeinfo/2.0" && strings.Contains(instance[r.Host+r.URL.Path], "4.3.3") {
+			<-release // the revalidation is held until the stale reads are done
+		}
+		instance.ServeHTTP(w, r)
+	})}
+	c := newTestClient(t, counter)
+	c.Cache = &Cache{TTL: 50*time.Millisecond}
+	c.StaleWhileRevalidate = time.Hour
+	ctx := context.Background()
+	hits := func() int {
+		return counter.count("example.test/.well-known/nodeinfo")
+	}
+
+	if info, err := c.Lookup(ctx, "example.test"); err != nil || info.Software.Version != "4.3.2" {
+		t.Fatalf("got %+v, %v", info, err)
+	}
+	time.Sleep(60*time.Millisecond)
+	instance["example.test/nodeinfo/2.0"] = strings.Replace(mastodonNodeInfo, "4.3.2", "4.3.3", 1)
+	for range 5 {
+		start := time.Now()
+		info, err := c.Lookup(ctx, "example.test")
+		if err != nil || info.Software.Version != "4.3.2" {
+			t.Fatalf("got %+v, %v, want the stale entry", info, err)
+		}
+		if took := time.Since(start); took > 20*time.Millisecond {
+			t.Errorf("stale read took %s, want it to not wait for the revalidation", took)
+		}
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if info, ok := c.Cache.GetMaxAge("example.test", 0); ok && info.Software.Version == "4.3.3" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the stale entry was never revalidated")
+		}
+		time.Sleep(5*time.Millisecond)
+	}
+	if hits() != 2 {
+		t.Errorf("got %d upstream requests, want exactly one revalidation", hits())
+	}
+
+	// without StaleWhileRevalidate, an expired entry is looked up again first
+	c.StaleWhileRevalidate = 0
+	time.Sleep(60*time.Millisecond)
+	if info, err := c.Lookup(ctx, "example.test"); err != nil || info.Software.Version != "4.3.3" || hits() != 3 {
+		t.Errorf("got %+v, %v after %d requests, want a fresh lookup", info, err, hits())
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	for _, test := range []struct {
+		ttl time.Duration
+		wantHits int
+	}{
+		{0, 1}, // the default
+		{time.Hour, 1},
+		{-1, 3},
+	} {
+		counter := &hitCounter{next: fixtures{}}
+		c := newTestClient(t, counter)
+		c.NegativeTTL = test.ttl
+		for range 3 {
+			if _, err := c.Lookup(context.Background(), "example.test"); err == nil {
+				t.Fatal("lookup of a missing instance succeeded")
+			}
+		}
+		if hits := counter.count("example.test/.well-known/nodeinfo"); hits != test.wantHits {
+			t.Errorf("negative ttl %s: got %d requests, want %d", test.ttl, hits, test.wantHits)
+		}
+	}
+}
+
+func TestOnCache(t *testing.T) {
+	instance := fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+	}
+	c := newTestClient(t, instance)
+	var results []CacheResult
+	c.OnCache = func(domain string, result CacheResult) {
+		results = append(results, result)
+	}
+	ctx := context.Background()
+	c.Lookup(ctx, "example.test")
+	c.Lookup(ctx, "example.test")
+	c.Lookup(ctx, "missing.test")
+	c.Lookup(ctx, "missing.test")
+	want := []CacheResult{CacheMiss, CacheHit, CacheMiss, CacheNegativeHit}
+	if !slices.Equal(results, want) {
+		t.Errorf("got %q, want %q", results, want)
+	}
+}
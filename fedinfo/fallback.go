@@ -0,0 +1,218 @@
+package fedinfo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DiscoveryNodeInfo is the discovery method of results read from nodeinfo,
+// results of fallback detectors carry the detector's name instead.
+const DiscoveryNodeInfo = "nodeinfo"
+
+// A Detector derives the software of an instance that doesn't serve (usable)
+// nodeinfo from some other api it exposes, along with whatever else about
+// the instance that api tells. It should make its requests through c, so
+// that they are subject to the same policies as all others.
+type Detector interface {
+	// Name is reported as the discovery method of results of the detector.
+	Name() string
+	Detect(ctx context.Context, c *Client, domain string) (NodeInfo, error)
+}
+
+// DefaultDetectors are used by clients without Detectors of their own.
+var DefaultDetectors = []Detector{
+	MastodonInstanceDetector{Path: "/api/v2/instance", Method: "mastodon-api-v2"},
+	MastodonInstanceDetector{Path: "/api/v1/instance", Method: "mastodon-api-v1"},
+	MisskeyMetaDetector{},
+}
+
+// detectFallback runs the client's detectors against domain.
+func (c *Client) detectFallback(ctx context.Context, domain string) (info NodeInfo, method string, err error) {
+	detectors := c.Detectors
+	if detectors == nil {
+		detectors = DefaultDetectors
+	}
+	for _, detector := range detectors {
+		info, err = detector.Detect(ctx, c, domain)
+		if err == nil && info.Software.IsResolved() {
+			return info, detector.Name(), nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return NodeInfo{}, "", fmt.Errorf("%s: no fallback detector recognized the instance", domain)
+}
+
+// MastodonInstanceDetector reads the version from the Mastodon instance api,
+// which is also implemented by Pleroma, Akkoma, GoToSocial and others. Path
+// may be that of version 1 or 2 of the api, which differ in shape.
+type MastodonInstanceDetector struct {
+	Path string
+	Method string
+}
+
+// compatibleVersion matches versions like "2.7.2 (compatible; Pleroma
+// 2.5.0)", where the first version is the Mastodon api version implemented,
+// and the one in parentheses the actual software and its version.
+var compatibleVersion = regexp.MustCompile(`\(compatible; ([^ )]+) ([^ )]+)\)`)
+
+type (
+	mastodonInstance struct {
+		Version string `json:"version"`
+		Languages any `json:"languages"`
+		// a boolean in v1, an object in v2
+		Registrations any `json:"registrations"`
+		// v1 only
+		Stats struct {
+			UserCount any `json:"user_count"`
+			StatusCount any `json:"status_count"`
+			DomainCount any `json:"domain_count"`
+		} `json:"stats"`
+		ContactAccount *mastodonAccount `json:"contact_account"`
+		// v2 only
+		Usage struct {
+			Users struct {
+				ActiveMonth any `json:"active_month"`
+			} `json:"users"`
+		} `json:"usage"`
+		Contact struct {
+			Account *mastodonAccount `json:"account"`
+		} `json:"contact"`
+		// only Pleroma and its forks have this block
+		Pleroma *struct {
+			Metadata struct {
+				Features []string `json:"features"`
+			} `json:"metadata"`
+		} `json:"pleroma"`
+	}
+	mastodonAccount struct {
+		CreatedAt string `json:"created_at"`
+	}
+)
+
+func (d MastodonInstanceDetector) Name() string {
+	return d.Method
+}
+
+func (d MastodonInstanceDetector) Detect(ctx context.Context, c *Client, domain string) (NodeInfo, error) {
+	var instance mastodonInstance
+	if err := c.GetJSON(ctx, fmt.Sprintf("https://%s%s", domain, d.Path), &instance); err != nil {
+		return NodeInfo{}, err
+	}
+	info := NodeInfo{
+		Domain: domain,
+		Languages: dedupeLanguages(normalizeLanguages(instance.Languages)),
+		PeerCount: looseCount(instance.Stats.DomainCount),
+	}
+	info.Software, info.Warnings = instance.software()
+	switch registrations := instance.Registrations.(type) {
+	case bool:
+		info.OpenRegistrations = &registrations
+	case map[string]any:
+		if enabled, ok := registrations["enabled"].(bool); ok {
+			info.OpenRegistrations = &enabled
+		}
+	}
+	usage := Usage{
+		Users: UsageUsers{
+			Total: looseCount(instance.Stats.UserCount),
+			ActiveMonth: looseCount(instance.Usage.Users.ActiveMonth),
+		},
+		LocalPosts: looseCount(instance.Stats.StatusCount),
+	}
+	if usage != (Usage{}) {
+		info.Usage = &usage
+	}
+	// there is no creation date of the instance, but the contact account,
+	// usually the admin's, tends to be among the first ones
+	contact := instance.ContactAccount
+	if contact == nil {
+		contact = instance.Contact.Account
+	}
+	if contact != nil {
+		if since, ok := parseLooseTime(contact.CreatedAt); ok {
+			info.InstanceSince = &since
+		}
+	}
+	return info, nil
+}
+
+// software tells the software apart by the shape of the response. Pleroma
+// and its forks report the Mastodon api version they implement as version,
+// with their own in parentheses, and have a block of their own, whose
+// features set Akkoma apart from Pleroma.
+func (instance mastodonInstance) software() (sfw Software, warnings []string) {
+	match := compatibleVersion.FindStringSubmatch(instance.Version)
+	if instance.Pleroma == nil {
+		if match != nil {
+			return Software{Name: strings.ToLower(match[1]), Version: match[2]}, nil
+		}
+		return Software{Name: "mastodon", Version: instance.Version}, nil
+	}
+	sfw.Name = "pleroma"
+	if slices.ContainsFunc(instance.Pleroma.Metadata.Features, func(feature string) bool {
+		return strings.HasPrefix(feature, "akkoma")
+	}) {
+		sfw.Name = "akkoma"
+	}
+	if match == nil {
+		sfw.Version = instance.Version
+		warnings = append(warnings, fmt.Sprintf("%s doesn't report its own version, %s may be the Mastodon api version it implements", sfw.Name, sfw.Version))
+		return sfw, warnings
+	}
+	if name := strings.ToLower(match[1]); name != "pleroma" {
+		sfw.Name = name // Akkoma, or forks further down the line
+	}
+	sfw.Version = match[2]
+	return sfw, nil
+}
+
+// MisskeyMetaDetector reads the version from the meta endpoint of Misskey and
+// its forks.
+type MisskeyMetaDetector struct{}
+
+func (MisskeyMetaDetector) Name() string {
+	return "misskey-api-meta"
+}
+
+func (MisskeyMetaDetector) Detect(ctx context.Context, c *Client, domain string) (NodeInfo, error) {
+	var meta struct {
+		Version string `json:"version"`
+		Langs any `json:"langs"`
+		// specific to Misskey, other software may well serve some other
+		// /api/meta with a version
+		DisableRegistration *bool `json:"disableRegistration"`
+	}
+	if err := c.GetJSON(ctx, fmt.Sprintf("https://%s/api/meta", domain), &meta); err != nil {
+		return NodeInfo{}, err
+	}
+	if meta.DisableRegistration == nil {
+		return NodeInfo{}, fmt.Errorf("%s: /api/meta isn't that of misskey", domain)
+	}
+	openRegistrations := !*meta.DisableRegistration
+	return NodeInfo{
+		Domain: domain,
+		Software: Software{Name: "misskey", Version: meta.Version},
+		Languages: dedupeLanguages(normalizeLanguages(meta.Langs)),
+		OpenRegistrations: &openRegistrations,
+	}, nil
+}
+
+// GetJSON requests url from an instance and decodes the response into v.
+func (c *Client) GetJSON(ctx context.Context, url string, v any) error {
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status: %s", resp.Request.URL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
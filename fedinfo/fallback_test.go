@@ -0,0 +1,173 @@
+package fedinfo
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// trimmed responses of real instances
+const (
+	mastodonInstanceV2 = `{
+		"domain": "example.test",
+		"title": "Example",
+		"version": "4.3.2",
+		"source_url": "https://github.com/mastodon/mastodon",
+		"usage": {"users": {"active_month": 1234}},
+		"languages": ["en", "de_CH"],
+		"registrations": {"enabled": false, "approval_required": false},
+		"contact": {"email": "admin@example.test", "account": {"username": "admin", "created_at": "2022-11-05T00:00:00.000Z"}}
+	}`
+	mastodonInstanceV1 = `{
+		"uri": "example.test",
+		"title": "Example",
+		"version": "3.5.19",
+		"languages": ["en"],
+		"registrations": true,
+		"stats": {"user_count": 5000, "status_count": 100000, "domain_count": 4321},
+		"contact_account": {"username": "admin", "created_at": "2018-04-01T12:00:00.000Z"}
+	}`
+)
+
+func TestMastodonInstanceFallback(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"v2.test/api/v2/instance": mastodonInstanceV2,
+		"v1.test/api/v1/instance": mastodonInstanceV1,
+	})
+
+	info, err := c.Resolve(context.Background(), "v2.test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Domain != "v2.test" || info.DiscoveryMethod != "mastodon-api-v2" || info.Software != (Software{Name: "mastodon", Version: "4.3.2"}) {
+		t.Errorf("v2: got %+v", info)
+	}
+	if !slices.Equal(info.Languages, []string{"en", "de-ch"}) {
+		t.Errorf("v2: got languages %q", info.Languages)
+	}
+	if info.InstanceSince == nil || !info.InstanceSince.Equal(time.Date(2022, 11, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("v2: got instance since %v", info.InstanceSince)
+	}
+	if info.OpenRegistrations == nil || *info.OpenRegistrations {
+		t.Errorf("v2: got open registrations %v, want false", info.OpenRegistrations)
+	}
+	if info.Usage == nil || info.Usage.Users.ActiveMonth == nil || *info.Usage.Users.ActiveMonth != 1234 {
+		t.Errorf("v2: got usage %+v", info.Usage)
+	}
+
+	info, err = c.Resolve(context.Background(), "v1.test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.DiscoveryMethod != "mastodon-api-v1" || info.Software != (Software{Name: "mastodon", Version: "3.5.19"}) {
+		t.Errorf("v1: got %+v", info)
+	}
+	if info.PeerCount == nil || *info.PeerCount != 4321 {
+		t.Errorf("v1: got peer count %v, want 4321", info.PeerCount)
+	}
+	if info.Usage == nil || info.Usage.Users.Total == nil || *info.Usage.Users.Total != 5000 {
+		t.Errorf("v1: got usage %+v", info.Usage)
+	}
+	if info.InstanceSince == nil || info.InstanceSince.Year() != 2018 {
+		t.Errorf("v1: got instance since %v", info.InstanceSince)
+	}
+}
+
+func TestFallbackOnlyWithoutNodeInfo(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+		"example.test/api/v2/instance": `{"version":"1.0.0"}`,
+	})
+	info, err := c.Resolve(context.Background(), "example.test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.DiscoveryMethod != DiscoveryNodeInfo || info.Software.Version != "4.3.2" {
+		t.Errorf("got %+v, want the nodeinfo result", info)
+	}
+}
+
+func TestPleromaFamilyFallback(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"pleroma.test/api/v1/instance": `{
+			"uri": "https://pleroma.test",
+			"version": "2.7.2 (compatible; Pleroma 2.6.3)",
+			"registrations": false,
+			"stats": {"user_count": 12, "status_count": 3456, "domain_count": 789},
+			"pleroma": {
+				"metadata": {"features": ["pleroma_api", "mastodon_api", "polls", "pleroma_emoji_reactions", "pleroma_chat_messages"], "federation": {"enabled": true}},
+				"stats": {"mau": 5},
+				"vapid_public_key": "BJ3..."
+			}
+		}`,
+		"akkoma.test/api/v1/instance": `{
+			"uri": "https://akkoma.test",
+			"version": "2.7.2 (compatible; Akkoma 3.13.2)",
+			"languages": ["en"],
+			"pleroma": {"metadata": {"features": ["pleroma_api", "akkoma_api", "mastodon_api", "editing"]}}
+		}`,
+		// early Akkoma releases still called themselves Pleroma
+		"old-akkoma.test/api/v1/instance": `{
+			"version": "2.7.2 (compatible; Pleroma 2.4.5+akkoma)",
+			"pleroma": {"metadata": {"features": ["pleroma_api", "akkoma_api"]}}
+		}`,
+		"unversioned.test/api/v1/instance": `{
+			"version": "2.7.2",
+			"pleroma": {"metadata": {"features": ["pleroma_api"]}}
+		}`,
+	})
+	for _, test := range []struct {
+		domain string
+		want Software
+		warns bool
+	}{
+		{"pleroma.test", Software{Name: "pleroma", Version: "2.6.3"}, false},
+		{"akkoma.test", Software{Name: "akkoma", Version: "3.13.2"}, false},
+		{"old-akkoma.test", Software{Name: "akkoma", Version: "2.4.5+akkoma"}, false},
+		{"unversioned.test", Software{Name: "pleroma", Version: "2.7.2"}, true},
+	} {
+		info, err := c.Resolve(context.Background(), test.domain, false)
+		if err != nil {
+			t.Errorf("%s: %v", test.domain, err)
+			continue
+		}
+		if info.Software != test.want || info.DiscoveryMethod != "mastodon-api-v1" {
+			t.Errorf("%s: got %+v via %s, want %+v", test.domain, info.Software, info.DiscoveryMethod, test.want)
+		}
+		if warns := len(info.Warnings) > 0; warns != test.warns {
+			t.Errorf("%s: got warnings %q", test.domain, info.Warnings)
+		}
+	}
+}
+
+func TestMisskeyFallback(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"misskey.test/api/meta": `{
+			"maintainerName": "admin",
+			"version": "2024.11.0",
+			"name": "Misskey Test",
+			"langs": ["ja", "en"],
+			"disableRegistration": true,
+			"driveCapacityPerLocalUserMb": 1024
+		}`,
+		// some other software's meta endpoint, that happens to have a version
+		"other.test/api/meta": `{"name": "other", "version": "1.2.3"}`,
+	})
+	info, err := c.Resolve(context.Background(), "misskey.test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Software != (Software{Name: "misskey", Version: "2024.11.0"}) || info.DiscoveryMethod != "misskey-api-meta" {
+		t.Errorf("got %+v via %s", info.Software, info.DiscoveryMethod)
+	}
+	if !slices.Equal(info.Languages, []string{"ja", "en"}) || info.OpenRegistrations == nil || *info.OpenRegistrations {
+		t.Errorf("got languages %q, open registrations %v", info.Languages, info.OpenRegistrations)
+	}
+
+	info, err = c.Resolve(context.Background(), "other.test", false)
+	if err == nil && info.Software.Name == "misskey" {
+		t.Errorf("got %+v, want no misskey result", info.Software)
+	}
+}
@@ -0,0 +1,78 @@
+package fedinfo
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixtures serves documents keyed by host and path, like
+// "example.test/.well-known/nodeinfo", and 404 for everything else.
+type fixtures map[string]string
+
+func (f fixtures) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := f[r.Host+r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, body)
+}
+
+// wellKnown is a well-known document linking to a 2.0 nodeinfo on host.
+func wellKnown(host string) string {
+	return `{"links":[{"rel":"http://nodeinfo.diaspora.software/ns/schema/2.0","href":"https://` + host + `/nodeinfo/2.0"}]}`
+}
+
+const mastodonNodeInfo = `{
+	"version": "2.0",
+	"software": {"name": "mastodon", "version": "4.3.2"},
+	"protocols": ["activitypub"],
+	"services": {"inbound": [], "outbound": []},
+	"openRegistrations": true,
+	"usage": {"users": {"total": 10, "activeMonth": 5, "activeHalfyear": 7}, "localPosts": 100},
+	"metadata": {"nodeName": "example"}
+}`
+
+// hitCounter counts the requests to each host and path.
+type hitCounter struct {
+	next http.Handler
+	lock sync.Mutex
+	hits map[string]int
+}
+
+func (h *hitCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.lock.Lock()
+	if h.hits == nil {
+		h.hits = map[string]int{}
+	}
+	h.hits[r.Host+r.URL.Path]++
+	h.lock.Unlock()
+	h.next.ServeHTTP(w, r)
+}
+
+func (h *hitCounter) count(key string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.hits[key]
+}
+
+// newTestClient returns a client whose requests all end up at handler, no
+// matter the host, which handler can tell apart by r.Host.
+func newTestClient(t *testing.T, handler http.Handler) *Client {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.InsecureSkipVerify = true // the certificate is only valid for example.com
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	return &Client{HTTPClient: NewHTTPClient(transport, 5*time.Second, 10)}
+}
@@ -0,0 +1,161 @@
+package fedinfo
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// h3FallbackTransport attempts HTTP/3 for hosts that advertised it via
+// Alt-Svc (or for every host, if forced) and falls back to the regular
+// HTTP/2 / HTTP/1.1 transport when that fails.
+type h3FallbackTransport struct {
+	h3 *http3.Transport
+	fallback http.RoundTripper
+	force bool
+	advertisedLock sync.Mutex
+	advertised map[string]time.Time // host -> end of the Alt-Svc max age
+}
+
+// maxAdvertised bounds how many hosts advertising HTTP/3 are remembered.
+const maxAdvertised = 10_000
+
+// defaultAltSvcMaxAge applies to alternatives without an ma parameter.
+const defaultAltSvcMaxAge = 24*time.Hour
+
+// NewH3FallbackTransport wraps a transport created by NewTransport, reusing
+// its tls config and limits for HTTP/3.
+func NewH3FallbackTransport(fallback *http.Transport, family IPFamily, force bool) http.RoundTripper {
+	return &h3FallbackTransport{
+		h3: &http3.Transport{
+			TLSClientConfig: fallback.TLSClientConfig.Clone(),
+			MaxResponseHeaderBytes: fallback.MaxResponseHeaderBytes,
+			Dial: family.dialQUIC,
+		},
+		fallback: fallback,
+		force: force,
+	}
+}
+
+func (t *h3FallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" && req.Body == nil {
+		if t.force || t.isAdvertised(req.URL.Host) {
+			resp, err := t.h3.RoundTrip(req)
+			if err == nil {
+				return resp, nil
+			}
+			slog.Debug("http3 request failed, falling back", "host", req.URL.Host, "error", err)
+		}
+	}
+	resp, err := t.fallback.RoundTrip(req)
+	if err == nil {
+		if altSvc := resp.Header.Get("Alt-Svc"); altSvc != "" {
+			t.recordAltSvc(req.URL.Host, altSvc, req.URL.Port())
+		}
+	}
+	return resp, err
+}
+
+func (t *h3FallbackTransport) isAdvertised(host string) bool {
+	t.advertisedLock.Lock()
+	defer t.advertisedLock.Unlock()
+	until, ok := t.advertised[host]
+	if ok && time.Now().After(until) {
+		delete(t.advertised, host)
+		return false
+	}
+	return ok
+}
+
+// recordAltSvc remembers (or forgets) that host offers HTTP/3, according to
+// its Alt-Svc header.
+func (t *h3FallbackTransport) recordAltSvc(host, altSvc, port string) {
+	maxAge, ok := advertisesH3(altSvc, port)
+	t.advertisedLock.Lock()
+	defer t.advertisedLock.Unlock()
+	if !ok {
+		delete(t.advertised, host)
+		return
+	}
+	if t.advertised == nil {
+		t.advertised = map[string]time.Time{}
+	}
+	now := time.Now()
+	if _, ok := t.advertised[host]; !ok && len(t.advertised) >= maxAdvertised {
+		for key, until := range t.advertised {
+			if now.After(until) {
+				delete(t.advertised, key)
+			}
+		}
+		for key := range t.advertised {
+			if len(t.advertised) < maxAdvertised {
+				break
+			}
+			delete(t.advertised, key)
+		}
+	}
+	t.advertised[host] = now.Add(maxAge)
+}
+
+// dialQUIC resolves the address in the ip family before dialing, since
+// quic-go would otherwise pick any.
+func (family IPFamily) dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ipAddr, err := family.resolveAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := guardDial("udp", ipAddr, nil); err != nil {
+		return nil, err
+	}
+	tlsCfg = tlsCfg.Clone()
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName = host
+	}
+	return quic.DialAddrEarly(ctx, ipAddr, tlsCfg, cfg)
+}
+
+// advertisesH3 reports whether an Alt-Svc header offers h3 on the same host
+// and port, and for how long; alternatives on other authorities are ignored.
+func advertisesH3(altSvc, port string) (time.Duration, bool) {
+	if port == "" {
+		port = "443"
+	}
+	for _, alt := range strings.Split(altSvc, ",") {
+		protocol, rest, ok := strings.Cut(strings.TrimSpace(alt), "=")
+		if !ok || protocol != "h3" {
+			continue
+		}
+		authority, params, _ := strings.Cut(rest, ";")
+		if strings.Trim(strings.TrimSpace(authority), `"`) != ":"+port {
+			continue
+		}
+		maxAge := defaultAltSvcMaxAge
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key != "ma" {
+				continue
+			}
+			if seconds, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64); err == nil && seconds >= 0 {
+				maxAge = time.Duration(min(seconds, int64(365*24*time.Hour/time.Second)))*time.Second
+			}
+		}
+		if maxAge == 0 {
+			continue
+		}
+		return maxAge, true
+	}
+	return 0, false
+}
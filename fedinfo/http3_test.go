@@ -0,0 +1,173 @@
+package fedinfo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newH3Server starts a tls server that advertises HTTP/3 on the same port,
+// and, if serveH3 is set, a QUIC listener answering there. Both respond with
+// the protocol the request arrived over.
+func newH3Server(t *testing.T, serveH3 bool) *httptest.Server {
+	var port string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%s"; ma=60`, port))
+		fmt.Fprint(w, r.Proto)
+	})
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	_, port, _ = net.SplitHostPort(srv.Listener.Addr().String())
+	if serveH3 {
+		conn, err := net.ListenPacket("udp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		h3 := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(srv.TLS)}
+		go h3.Serve(conn)
+		t.Cleanup(func() {
+			h3.Close()
+			conn.Close()
+		})
+	}
+	return srv
+}
+
+// newH3Client returns a client using an h3FallbackTransport that trusts srv.
+func newH3Client(srv *httptest.Server, force bool) (*http.Client, *h3FallbackTransport) {
+	transport := NewTransport(IPFamilyAuto)
+	transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+	transport.TLSClientConfig.RootCAs.AddCert(srv.Certificate())
+	transport.TLSClientConfig.ServerName = "example.com"
+	h3 := NewH3FallbackTransport(transport, IPFamilyAuto, force).(*h3FallbackTransport)
+	h3.h3.QUICConfig = &quic.Config{HandshakeIdleTimeout: 500*time.Millisecond}
+	return &http.Client{Transport: h3, Timeout: 5*time.Second}, h3
+}
+
+func getProto(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	return resp.Proto
+}
+
+func TestH3AfterAltSvc(t *testing.T) {
+	allowLoopback(t)
+	srv := newH3Server(t, true)
+	client, transport := newH3Client(srv, false)
+
+	if proto := getProto(t, client, srv.URL); proto != "HTTP/2.0" {
+		t.Errorf("first request: got %s, want HTTP/2.0", proto)
+	}
+	if !transport.isAdvertised(srv.Listener.Addr().String()) {
+		t.Fatal("Alt-Svc was not recorded")
+	}
+	if proto := getProto(t, client, srv.URL); proto != "HTTP/3.0" {
+		t.Errorf("second request: got %s, want HTTP/3.0", proto)
+	}
+}
+
+func TestH3Force(t *testing.T) {
+	allowLoopback(t)
+	srv := newH3Server(t, true)
+	client, _ := newH3Client(srv, true)
+	if proto := getProto(t, client, srv.URL); proto != "HTTP/3.0" {
+		t.Errorf("got %s, want HTTP/3.0", proto)
+	}
+}
+
+func TestH3FallsBackToTCP(t *testing.T) {
+	allowLoopback(t)
+	srv := newH3Server(t, false)
+	client, _ := newH3Client(srv, true)
+	if proto := getProto(t, client, srv.URL); proto != "HTTP/2.0" {
+		t.Errorf("forced: got %s, want HTTP/2.0", proto)
+	}
+
+	client, transport := newH3Client(srv, false)
+	getProto(t, client, srv.URL)
+	if !transport.isAdvertised(srv.Listener.Addr().String()) {
+		t.Fatal("Alt-Svc was not recorded")
+	}
+	if proto := getProto(t, client, srv.URL); proto != "HTTP/2.0" {
+		t.Errorf("advertised: got %s, want HTTP/2.0", proto)
+	}
+}
+
+func TestH3GuardsDial(t *testing.T) {
+	srv := newH3Server(t, true)
+	client, _ := newH3Client(srv, true)
+	if _, err := client.Get(srv.URL); !errors.Is(err, errBlockedAddress) {
+		t.Errorf("request: got %v, want a blocked address", err)
+	}
+	_, err := IPFamilyAuto.dialQUIC(context.Background(), srv.Listener.Addr().String(), &tls.Config{}, nil)
+	if !errors.Is(err, errBlockedAddress) {
+		t.Errorf("dial: got %v, want a blocked address", err)
+	}
+}
+
+func TestAdvertisesH3(t *testing.T) {
+	for _, test := range []struct {
+		altSvc, port string
+		maxAge time.Duration
+		ok bool
+	}{
+		{`h3=":443"`, "", defaultAltSvcMaxAge, true},
+		{`h3=":443"; ma=3600`, "443", time.Hour, true},
+		{`h2=":443", h3=":8443"; ma=60; persist=1`, "8443", time.Minute, true},
+		{`h3="other.example:443"`, "443", 0, false},
+		{`h3=":8443"`, "443", 0, false},
+		{`h3-29=":443"`, "443", 0, false},
+		{`h3=":443"; ma=0`, "443", 0, false},
+		{`h3=":443"; ma=nonsense`, "443", defaultAltSvcMaxAge, true},
+		{`clear`, "443", 0, false},
+	} {
+		maxAge, ok := advertisesH3(test.altSvc, test.port)
+		if maxAge != test.maxAge || ok != test.ok {
+			t.Errorf("%q on port %q: got %v, %v, want %v, %v", test.altSvc, test.port, maxAge, ok, test.maxAge, test.ok)
+		}
+	}
+}
+
+func TestAdvertisedExpiresAndIsBounded(t *testing.T) {
+	transport := &h3FallbackTransport{}
+	transport.recordAltSvc("example.com", `h3=":443"`, "")
+	if !transport.isAdvertised("example.com") {
+		t.Fatal("not recorded")
+	}
+	transport.recordAltSvc("example.com", "clear", "")
+	if transport.isAdvertised("example.com") {
+		t.Error("clear did not forget the host")
+	}
+
+	transport.recordAltSvc("example.com", `h3=":443"`, "")
+	transport.advertised["example.com"] = time.Now().Add(-time.Second)
+	if transport.isAdvertised("example.com") {
+		t.Error("expired advertisement is used")
+	}
+	if _, ok := transport.advertised["example.com"]; ok {
+		t.Error("expired advertisement is kept")
+	}
+
+	for i := range maxAdvertised+10 {
+		transport.recordAltSvc(fmt.Sprintf("host%d.example", i), `h3=":443"`, "")
+	}
+	if len(transport.advertised) > maxAdvertised {
+		t.Errorf("got %d advertised hosts, want at most %d", len(transport.advertised), maxAdvertised)
+	}
+}
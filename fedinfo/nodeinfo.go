@@ -0,0 +1,643 @@
+package fedinfo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ErrUpstreamInvalid struct {
+	Domain string
+	Violations []string
+	// Err is the underlying error, if the violation is one of the
+	// connection rather than the document.
+	Err error
+}
+
+func (e ErrUpstreamInvalid) Unwrap() error {
+	return e.Err
+}
+
+func (e ErrUpstreamInvalid) Error() string {
+	return fmt.Sprintf("%s: invalid nodeinfo: %s", e.Domain, strings.Join(e.Violations, "; "))
+}
+
+func (e ErrUpstreamInvalid) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	status := http.StatusBadGateway
+	http.Error(w, fmt.Sprintf("%s: invalid nodeinfo:\n%s", e.Domain, strings.Join(e.Violations, "\n")), status)
+	return true
+}
+
+func (e ErrUpstreamInvalid) StatusCode() int {
+	return http.StatusBadGateway
+}
+
+type (
+	WellKnownNodeInfo struct {
+		Links []Link `json:"links"`
+	}
+	Link struct {
+		Rel string `json:"rel"`
+		Href string `json:"href"`
+	}
+	NodeInfo struct {
+		Domain string `json:"domain"`
+		ServerDomain string `json:"serverDomain,omitempty"`
+		// CanonicalDomain is set if the instance redirected from Domain to
+		// its www (or apex) variant, which is the form to store.
+		CanonicalDomain string `json:"canonicalDomain,omitempty"`
+		InstanceID string `json:"instanceId,omitempty"`
+		Software Software `json:"software"`
+		DiscoveryMethod string `json:"discoveryMethod,omitempty"`
+		Languages []string `json:"languages,omitempty"`
+		InstanceSince *time.Time `json:"instanceSince,omitempty"`
+		PeerCount *int `json:"peerCount,omitempty"`
+		Usage *Usage `json:"usage,omitempty"`
+		OpenRegistrations *bool `json:"openRegistrations,omitempty"`
+		Protocols []string `json:"protocols,omitempty"`
+		Services *Services `json:"services,omitempty"`
+		Metadata map[string]any `json:"metadata,omitempty"`
+		Warnings []string `json:"warnings,omitempty"`
+		HomographWarning string `json:"homographWarning,omitempty"`
+	}
+	Software struct {
+		Name string `json:"name"`
+		Version string `json:"version"`
+		VersionDisplay string `json:"versionDisplay,omitempty"`
+		// Repository and Homepage are only defined since nodeinfo 2.1.
+		Repository string `json:"repository,omitempty"`
+		Homepage string `json:"homepage,omitempty"`
+	}
+	NodeInfoDocument struct {
+		Software Software `json:"software"`
+		Metadata map[string]any `json:"metadata"`
+		Usage json.RawMessage `json:"usage"`
+		OpenRegistrations json.RawMessage `json:"openRegistrations"`
+		Protocols json.RawMessage `json:"protocols"`
+		Services json.RawMessage `json:"services"`
+		Raw json.RawMessage `json:"-"`
+		Warnings []string `json:"-"`
+		// WellKnownURL is where the well-known document was found after redirects.
+		WellKnownURL *url.URL `json:"-"`
+	}
+)
+
+// IsResolved reports whether sfw holds a usable result rather than the empty
+// value stored when discovery didn't find any nodeinfo.
+func (sfw Software) IsResolved() bool {
+	return sfw.Name != "" && sfw.Version != ""
+}
+
+var errNoNodeInfo = errors.New("no supported nodeinfo schema advertised")
+
+// Resolve looks up the nodeinfo of domain, bypassing the cache. In strict
+// mode a document that doesn't conform to the nodeinfo schema results in
+// ErrUpstreamInvalid instead of a best-effort result, and no fallback
+// detectors are tried.
+//
+// The whole lookup, including all fallbacks, is bounded by the client's
+// MaxDuration. If that is exceeded, the partial result is returned along
+// with an error wrapping ErrLookupTimeout.
+func (c *Client) Resolve(ctx context.Context, domain string, strict bool) (info NodeInfo, err error) {
+	info = NodeInfo{
+		Domain: domain,
+	}
+	maxDuration := c.maxDuration()
+	ctx, cancel := context.WithTimeout(ctx, maxDuration)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: lookup exceeded %s", ErrLookupTimeout, maxDuration)
+		}
+		if c.OnResolve != nil {
+			c.OnResolve(domain, start, info, err)
+		}
+	}()
+	if err := checkPublicHost(ctx, domain); err != nil {
+		return info, err
+	}
+	docUrl, doc, err := c.fetchNodeInfo(ctx, domain)
+	if err != nil {
+		// split-domain setups (handle on example.com, server on social.example.com)
+		// may only advertise the server domain through host-meta
+		delegate, hmErr := c.fetchHostMetaDomain(ctx, domain)
+		if hmErr == nil && delegate != domain {
+			info.ServerDomain = delegate
+			docUrl, doc, err = c.fetchNodeInfo(ctx, delegate)
+		}
+	}
+	if err != nil {
+		if strict && errors.Is(err, errNoNodeInfo) {
+			// not advertising any nodeinfo is the most basic violation
+			return info, ErrUpstreamInvalid{Domain: domain, Violations: []string{err.Error()}}
+		}
+		if strict {
+			return info, err
+		}
+		host := domain
+		if info.ServerDomain != "" {
+			host = info.ServerDomain
+		}
+		detected, method, fbErr := c.detectFallback(ctx, host)
+		if fbErr != nil {
+			return info, ignoreNoNodeInfo(err)
+		}
+		detected.Domain, detected.ServerDomain = info.Domain, info.ServerDomain
+		detected.Software = c.Rewrites.Apply(detected.Software)
+		detected.DiscoveryMethod = method
+		info = detected
+		return info, nil
+	}
+	if strict {
+		if violations := validateNodeInfo(doc.Raw); len(violations) > 0 {
+			return info, ErrUpstreamInvalid{Domain: domain, Violations: violations}
+		}
+	}
+	info.ServerDomain = ""
+	if docUrl.Host != domain {
+		info.ServerDomain = docUrl.Host
+	}
+	if doc.WellKnownURL != nil && isWWWVariant(domain, doc.WellKnownURL.Host) {
+		info.CanonicalDomain = strings.ToLower(doc.WellKnownURL.Host)
+	}
+	info.DiscoveryMethod = DiscoveryNodeInfo
+	info.InstanceID = instanceID(docUrl)
+	info.Software = c.Rewrites.Apply(doc.Software)
+	info.Warnings = doc.Warnings
+	info.Languages = extractLanguages(doc.Metadata)
+	info.InstanceSince = extractInstanceSince(doc.Metadata)
+	info.PeerCount = extractPeerCount(doc.Metadata)
+	if info.PeerCount == nil {
+		// most servers only publish it through the Mastodon API, which is
+		// served by the same host as the nodeinfo
+		peerCount, pcErr := c.PeerCount(ctx, docUrl.Host)
+		if pcErr != nil {
+			slog.Debug("failed to fetch peer count", "domain", docUrl.Host, "error", pcErr)
+		}
+		info.PeerCount = peerCount
+	}
+	info.Usage = parseUsage(doc.Usage)
+	info.OpenRegistrations = parseOpenRegistrations(doc.OpenRegistrations)
+	info.Protocols = parseProtocols(doc.Protocols)
+	info.Services = parseServices(doc.Services)
+	info.Metadata = doc.Metadata
+	return info, nil
+}
+
+func ignoreNoNodeInfo(err error) error {
+	if errors.Is(err, errNoNodeInfo) {
+		return nil
+	}
+	return err
+}
+
+// fetchNodeInfo resolves the nodeinfo document advertised by domain and
+// returns the url it was actually served from, whose host differs from domain
+// if discovery was redirected or delegated to another server.
+func (c *Client) fetchNodeInfo(ctx context.Context, domain string) (docUrl *url.URL, doc NodeInfoDocument, err error) {
+	resp, err := c.get(ctx, fmt.Sprintf("https://%s/.well-known/nodeinfo", domain))
+	if err != nil {
+		return nil, doc, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, doc, fmt.Errorf("%s: unexpected status: %s", resp.Request.URL, resp.Status)
+	}
+	wk := WellKnownNodeInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(&wk); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, doc, ErrUpstreamInvalid{Domain: domain, Violations: []string{"empty well-known response"}}
+		}
+		return nil, doc, err
+	}
+	candidates := nodeInfoCandidates(resp.Request.URL, wk.Links, c.MixedContentPolicy)
+	if len(candidates) == 0 {
+		return nil, doc, errNoNodeInfo
+	}
+	var firstErr error
+	for _, candidate := range candidates {
+		docUrl, doc, err = c.fetchNodeInfoDocument(ctx, candidate.href)
+		if err == nil {
+			doc.WellKnownURL = resp.Request.URL
+			if candidate.warning != "" {
+				doc.Warnings = append(doc.Warnings, candidate.warning)
+			}
+			return docUrl, doc, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, doc, firstErr
+}
+
+func (c *Client) fetchNodeInfoDocument(ctx context.Context, nodeInfoUrl *url.URL) (docUrl *url.URL, doc NodeInfoDocument, err error) {
+	resp, err := c.get(ctx, nodeInfoUrl.String())
+	if err != nil {
+		return nil, doc, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, doc, fmt.Errorf("%s: unexpected status: %s", resp.Request.URL, resp.Status)
+	}
+	doc.Raw, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, doc, err
+	}
+	if err := json.Unmarshal(doc.Raw, &doc); err != nil {
+		// e.g. a version that is a number, which strict mode should report
+		// along with everything else that is wrong
+		violations := validateNodeInfo(doc.Raw)
+		if len(violations) == 0 {
+			violations = []string{err.Error()}
+		}
+		return nil, doc, ErrUpstreamInvalid{Domain: nodeInfoUrl.Host, Violations: violations}
+	}
+	return resp.Request.URL, doc, nil
+}
+
+var nodeInfoSchemas = []string{
+	"http://nodeinfo.diaspora.software/ns/schema/2.1",
+	"http://nodeinfo.diaspora.software/ns/schema/2.0",
+}
+
+type MixedContentPolicy string
+
+const (
+	// MixedContentRewrite upgrades http hrefs on the instance's own host to
+	// https and ignores http hrefs on other hosts. This is the default.
+	MixedContentRewrite MixedContentPolicy = "rewrite"
+	// MixedContentReject ignores all http hrefs.
+	MixedContentReject MixedContentPolicy = "reject"
+)
+
+type nodeInfoCandidate struct {
+	href *url.URL
+	warning string
+	schema int
+	rank int
+}
+
+// nodeInfoCandidates returns the hrefs of all supported nodeinfo schema links
+// in the order they should be tried. Newer schemas come first. Servers
+// sometimes advertise the same schema more than once, so within a schema
+// absolute https hrefs on the same host as the well-known document are
+// preferred, followed by https hrefs on other hosts and relative hrefs. Links
+// that rank equal keep their document order. Nodeinfo is only ever fetched
+// over https, so plain http hrefs are dropped, unless they can be upgraded
+// as per the policy.
+func nodeInfoCandidates(wellKnownUrl *url.URL, links []Link, policy MixedContentPolicy) []nodeInfoCandidate {
+	var candidates []nodeInfoCandidate
+	for _, link := range links {
+		schema := slices.Index(nodeInfoSchemas, link.Rel)
+		if schema < 0 {
+			continue
+		}
+		href, err := url.Parse(link.Href)
+		if err != nil {
+			continue
+		}
+		var warning string
+		if href.Scheme == "http" && wellKnownUrl.Scheme == "https" {
+			if policy == MixedContentReject {
+				continue
+			}
+			if strings.EqualFold(href.Host, wellKnownUrl.Host) {
+				warning = fmt.Sprintf("rewrote mixed-content nodeinfo href %s to https", href)
+				href.Scheme = "https"
+			}
+		}
+		rank := 0
+		switch {
+		case !href.IsAbs():
+			rank = 2
+			href = wellKnownUrl.ResolveReference(href)
+		case href.Scheme == "https" && strings.EqualFold(href.Host, wellKnownUrl.Host):
+			rank = 0
+		case href.Scheme == "https":
+			rank = 1
+		}
+		if href.Scheme != "https" || !IsPublicHostname(href.Hostname()) {
+			continue
+		}
+		candidates = append(candidates, nodeInfoCandidate{href, warning, schema, rank})
+	}
+	slices.SortStableFunc(candidates, func(a, b nodeInfoCandidate) int {
+		if a.schema != b.schema {
+			return a.schema - b.schema
+		}
+		return a.rank - b.rank
+	})
+	return candidates
+}
+
+// instanceID derives a stable identifier for the server behind a nodeinfo
+// document, so that aliases of the same instance (www variants, handle
+// domains) can be detected. It is the hex encoded SHA-256 of the document url
+// after redirects, reduced to lowercased host and path: the scheme, a default
+// port, the query, and the fragment do not contribute.
+func instanceID(docUrl *url.URL) string {
+	host := strings.ToLower(docUrl.Hostname())
+	if port := docUrl.Port(); port != "" && port != "443" && port != "80" {
+		host = net.JoinHostPort(host, port)
+	}
+	sum := sha256.Sum256([]byte(host + docUrl.EscapedPath()))
+	return hex.EncodeToString(sum[:])
+}
+
+// extractLanguages collects the instance languages from nodeinfo metadata,
+// which software variously exposes as languages, langs, or language.
+func extractLanguages(metadata map[string]any) []string {
+	var languages []string
+	for _, key := range []string{"languages", "langs", "language"} {
+		languages = append(languages, normalizeLanguages(metadata[key])...)
+	}
+	return dedupeLanguages(languages)
+}
+
+// normalizeLanguages turns a list of language codes, or a single
+// comma-separated string of them, into lowercased BCP-47 tags.
+func normalizeLanguages(value any) (languages []string) {
+	switch value := value.(type) {
+	case string:
+		for _, lang := range strings.Split(value, ",") {
+			if lang = strings.TrimSpace(lang); lang != "" {
+				languages = append(languages, strings.ToLower(strings.ReplaceAll(lang, "_", "-")))
+			}
+		}
+	case []any:
+		for _, lang := range value {
+			languages = append(languages, normalizeLanguages(lang)...)
+		}
+	case []string:
+		for _, lang := range value {
+			languages = append(languages, normalizeLanguages(lang)...)
+		}
+	}
+	return languages
+}
+
+func dedupeLanguages(languages []string) []string {
+	seen := map[string]bool{}
+	deduped := languages[:0]
+	for _, lang := range languages {
+		if !seen[lang] {
+			seen[lang] = true
+			deduped = append(deduped, lang)
+		}
+	}
+	if len(deduped) == 0 {
+		return nil
+	}
+	return deduped
+}
+
+// extractInstanceSince makes a best-effort guess at when the instance was
+// created from the nodeinfo metadata. There is no standard field for this, so
+// the keys and formats used by various software are tried in turn.
+func extractInstanceSince(metadata map[string]any) *time.Time {
+	for _, key := range []string{"instanceSince", "createdAt", "created_at", "startDate", "launchDate", "since"} {
+		if since, ok := parseLooseTime(metadata[key]); ok {
+			return &since
+		}
+	}
+	return nil
+}
+
+func parseLooseTime(value any) (time.Time, bool) {
+	switch value := value.(type) {
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02", time.RFC1123Z, time.RFC1123} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.UTC(), true
+			}
+		}
+		if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return parseLooseTime(float64(unix))
+		}
+	case float64:
+		if value <= 0 {
+			return time.Time{}, false
+		}
+		if value > 1e12 { // milliseconds
+			return time.UnixMilli(int64(value)).UTC(), true
+		}
+		return time.Unix(int64(value), 0).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+type (
+	Usage struct {
+		Users UsageUsers `json:"users"`
+		LocalPosts *int `json:"localPosts,omitempty"`
+		LocalComments *int `json:"localComments,omitempty"`
+	}
+	UsageUsers struct {
+		Total *int `json:"total,omitempty"`
+		ActiveMonth *int `json:"activeMonth,omitempty"`
+		ActiveHalfyear *int `json:"activeHalfyear,omitempty"`
+	}
+	Services struct {
+		Inbound []string `json:"inbound"`
+		Outbound []string `json:"outbound"`
+	}
+)
+
+// parseUsage reads the usage statistics of a nodeinfo document. Some
+// software reports counts as strings or leaves them out, so this never fails
+// and just returns nil if there's nothing usable.
+func parseUsage(raw json.RawMessage) *Usage {
+	var usage struct {
+		Users map[string]any `json:"users"`
+		LocalPosts any `json:"localPosts"`
+		LocalComments any `json:"localComments"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &usage) != nil {
+		return nil
+	}
+	parsed := Usage{
+		Users: UsageUsers{
+			Total: looseCount(usage.Users["total"]),
+			ActiveMonth: looseCount(usage.Users["activeMonth"]),
+			ActiveHalfyear: looseCount(usage.Users["activeHalfyear"]),
+		},
+		LocalPosts: looseCount(usage.LocalPosts),
+		LocalComments: looseCount(usage.LocalComments),
+	}
+	if parsed == (Usage{}) {
+		return nil
+	}
+	return &parsed
+}
+
+// parseOpenRegistrations reads whether an instance accepts signups, also
+// accepting the flag as a string.
+func parseOpenRegistrations(raw json.RawMessage) *bool {
+	var value any
+	if len(raw) == 0 || json.Unmarshal(raw, &value) != nil {
+		return nil
+	}
+	switch value := value.(type) {
+	case bool:
+		return &value
+	case string:
+		if open, err := strconv.ParseBool(value); err == nil {
+			return &open
+		}
+	}
+	return nil
+}
+
+// parseProtocols reads the supported protocols, which are a list in schema
+// 2.x, but an object of inbound and outbound lists in 1.x, which some
+// software still serves.
+func parseProtocols(raw json.RawMessage) []string {
+	var value any
+	if len(raw) == 0 || json.Unmarshal(raw, &value) != nil {
+		return nil
+	}
+	var protocols []string
+	var collect func(value any)
+	collect = func(value any) {
+		switch value := value.(type) {
+		case string:
+			protocol := strings.ToLower(strings.TrimSpace(value))
+			if protocol != "" && !slices.Contains(protocols, protocol) {
+				protocols = append(protocols, protocol)
+			}
+		case []any:
+			for _, v := range value {
+				collect(v)
+			}
+		case map[string]any:
+			collect(value["inbound"])
+			collect(value["outbound"])
+		}
+	}
+	collect(value)
+	return protocols
+}
+
+// parseServices reads the third party services an instance can talk to,
+// ignoring anything that isn't a list of names.
+func parseServices(raw json.RawMessage) *Services {
+	var services struct {
+		Inbound []any `json:"inbound"`
+		Outbound []any `json:"outbound"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &services) != nil {
+		return nil
+	}
+	names := func(values []any) []string {
+		names := []string{}
+		for _, value := range values {
+			if name, ok := value.(string); ok && name != "" {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return &Services{
+		Inbound: names(services.Inbound),
+		Outbound: names(services.Outbound),
+	}
+}
+
+func looseCount(value any) *int {
+	switch value := value.(type) {
+	case float64:
+		if value >= 0 {
+			count := int(value)
+			return &count
+		}
+	case string:
+		if count, err := strconv.Atoi(value); err == nil && count >= 0 {
+			return &count
+		}
+	}
+	return nil
+}
+
+type (
+	XRD struct {
+		Links []XRDLink `xml:"Link"`
+	}
+	XRDLink struct {
+		Rel string `xml:"rel,attr"`
+		Template string `xml:"template,attr"`
+		Href string `xml:"href,attr"`
+	}
+)
+
+// fetchHostMetaDomain reads the lrdd (WebFinger) link from domain's host-meta
+// and returns the host it points at.
+func (c *Client) fetchHostMetaDomain(ctx context.Context, domain string) (string, error) {
+	lrdd, err := c.hostMetaLRDD(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(strings.ReplaceAll(lrdd, "{uri}", ""))
+	if err != nil {
+		return "", err
+	}
+	return u.Host, nil
+}
+
+// hostMetaLRDD returns the first usable lrdd link of domain's host-meta, one
+// with an https url on a public host. A template is returned as is, with the
+// {uri} to be replaced by the resource to look up.
+func (c *Client) hostMetaLRDD(ctx context.Context, domain string) (string, error) {
+	resp, err := c.get(ctx, fmt.Sprintf("https://%s/.well-known/host-meta", domain))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: unexpected status: %s", resp.Request.URL, resp.Status)
+	}
+	var xrd XRD
+	if err := xml.NewDecoder(resp.Body).Decode(&xrd); err != nil {
+		return "", err
+	}
+	for _, link := range xrd.Links {
+		if link.Rel != "lrdd" {
+			continue
+		}
+		target := link.Template
+		if target == "" {
+			target = link.Href
+		}
+		u, err := url.Parse(strings.ReplaceAll(target, "{uri}", ""))
+		if err != nil || u.Scheme != "https" || !IsPublicHostname(u.Hostname()) {
+			continue
+		}
+		return target, nil
+	}
+	return "", fmt.Errorf("%s: no usable lrdd link in host-meta", domain)
+}
+
+// isWWWVariant reports whether a and b are the apex and www form of the same
+// domain, in either order.
+func isWWWVariant(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	return a == "www."+b || b == "www."+a
+}
+
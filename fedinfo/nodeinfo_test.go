@@ -0,0 +1,444 @@
+package fedinfo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// candidateHrefs runs nodeInfoCandidates for a well-known document fetched
+// from https://example.test.
+func candidateHrefs(links []Link, policy MixedContentPolicy) (hrefs []string) {
+	wellKnownUrl, _ := url.Parse("https://example.test/.well-known/nodeinfo")
+	for _, candidate := range nodeInfoCandidates(wellKnownUrl, links, policy) {
+		hrefs = append(hrefs, candidate.href.String())
+	}
+	return hrefs
+}
+
+func TestExtractLanguages(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		metadata map[string]any
+		want []string
+	}{
+		{"list", map[string]any{"languages": []any{"EN", "de_CH"}}, []string{"en", "de-ch"}},
+		{"comma separated", map[string]any{"langs": "en, ja,"}, []string{"en", "ja"}},
+		{"single", map[string]any{"language": "fr"}, []string{"fr"}},
+		{"deduplicated across keys", map[string]any{"languages": []any{"en"}, "langs": []any{"EN", "de"}}, []string{"en", "de"}},
+		{"none", map[string]any{"nodeName": "example"}, nil},
+		{"wrong type", map[string]any{"languages": 42.0}, nil},
+	} {
+		if got := extractLanguages(test.metadata); !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLanguagesFromNodeInfo(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"nodeinfo.test/.well-known/nodeinfo": wellKnown("nodeinfo.test"),
+		"nodeinfo.test/nodeinfo/2.0": `{
+			"version": "2.0",
+			"software": {"name": "pleroma", "version": "2.7.0"},
+			"protocols": ["activitypub"],
+			"services": {"inbound": [], "outbound": []},
+			"openRegistrations": true,
+			"usage": {"users": {}},
+			"metadata": {"languages": ["EN", "de_CH", "en"]}
+		}`,
+	})
+	info, err := c.Lookup(context.Background(), "nodeinfo.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"en", "de-ch"}; !slices.Equal(info.Languages, want) {
+		t.Errorf("got %q, want %q", info.Languages, want)
+	}
+}
+
+func TestInstanceID(t *testing.T) {
+	const id = "1021cd724516844254b6ec9350d91c84c44a8647a1d7555ccd496883b9347adc" // sha256 of mastodon.social/nodeinfo/2.0
+	for _, docUrl := range []string{
+		"https://mastodon.social/nodeinfo/2.0",
+		"https://Mastodon.Social/nodeinfo/2.0",
+		"http://mastodon.social:443/nodeinfo/2.0",
+		"https://mastodon.social/nodeinfo/2.0?cache=no#top",
+	} {
+		parsed, _ := url.Parse(docUrl)
+		if got := instanceID(parsed); got != id {
+			t.Errorf("%s: got %s, want %s", docUrl, got, id)
+		}
+	}
+	for _, docUrl := range []string{
+		"https://mastodon.social/nodeinfo/2.1",
+		"https://mastodon.social:8443/nodeinfo/2.0",
+		"https://www.mastodon.social/nodeinfo/2.0",
+	} {
+		parsed, _ := url.Parse(docUrl)
+		if got := instanceID(parsed); got == id {
+			t.Errorf("%s: got the same id as mastodon.social/nodeinfo/2.0", docUrl)
+		}
+	}
+}
+
+func TestExtractInstanceSince(t *testing.T) {
+	want := time.Date(2019, 3, 1, 12, 30, 0, 0, time.UTC)
+	for _, metadata := range []map[string]any{
+		{"instanceSince": "2019-03-01T12:30:00Z"},
+		{"createdAt": "2019-03-01T13:30:00.000+01:00"},
+		{"created_at": "2019-03-01 12:30:00"},
+		{"startDate": "2019-03-01T12:30:00"},
+		{"launchDate": "Fri, 01 Mar 2019 12:30:00 +0000"},
+		{"since": float64(want.Unix())},
+		{"since": float64(want.UnixMilli())},
+		{"since": strconv.FormatInt(want.Unix(), 10)},
+	} {
+		got := extractInstanceSince(metadata)
+		if got == nil || !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("%v: got %v, want %v", metadata, got, want)
+		}
+	}
+	if got := extractInstanceSince(map[string]any{"createdAt": "2019-03-01"}); got == nil || !got.Equal(time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("date only: got %v", got)
+	}
+	for _, metadata := range []map[string]any{
+		{},
+		{"instanceSince": "a while ago"},
+		{"since": float64(0)},
+		{"uptime": "2019-03-01T12:30:00Z"},
+	} {
+		if got := extractInstanceSince(metadata); got != nil {
+			t.Errorf("%v: got %v, want nil", metadata, got)
+		}
+	}
+}
+
+func TestInstanceSinceFromNodeInfo(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"friendica.test/.well-known/nodeinfo": wellKnown("friendica.test"),
+		"friendica.test/nodeinfo/2.0": `{
+			"version": "2.0",
+			"software": {"name": "friendica", "version": "2024.08"},
+			"protocols": ["activitypub", "dfrn"],
+			"services": {"inbound": [], "outbound": []},
+			"openRegistrations": false,
+			"usage": {"users": {"total": 3}},
+			"metadata": {"nodeName": "Friendica", "createdAt": 1551443400}
+		}`,
+	})
+	info, err := c.Lookup(context.Background(), "friendica.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1551443400, 0); info.InstanceSince == nil || !info.InstanceSince.Equal(want) {
+		t.Errorf("got %v, want %v", info.InstanceSince, want)
+	}
+}
+
+func TestEmptyWellKnown(t *testing.T) {
+	counter := &hitCounter{next: fixtures{"example.test/.well-known/nodeinfo": ""}}
+	c := newTestClient(t, counter)
+	for range 2 {
+		_, err := c.Lookup(context.Background(), "example.test")
+		var invalid ErrUpstreamInvalid
+		if !errors.As(err, &invalid) || !slices.Contains(invalid.Violations, "empty well-known response") {
+			t.Errorf("got %v, want an empty well-known response", err)
+		}
+	}
+	if hits := counter.count("example.test/.well-known/nodeinfo"); hits != 1 {
+		t.Errorf("got %d requests, want the failure to be cached", hits)
+	}
+}
+
+func TestOnResolveReportsEveryLookup(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+	})
+	resolved := map[string]error{}
+	c.OnResolve = func(domain string, start time.Time, info NodeInfo, err error) {
+		resolved[domain] = err
+	}
+	c.Resolve(context.Background(), "example.test", false)
+	c.Resolve(context.Background(), "localhost", false)
+	if err, ok := resolved["example.test"]; !ok || err != nil {
+		t.Errorf("example.test: got reported %t with %v, want reported without error", ok, err)
+	}
+	if err, ok := resolved["localhost"]; !ok || !errors.As(err, new(ErrNonPublicHost)) {
+		t.Errorf("localhost: got reported %t with %v, want reported as a non-public host", ok, err)
+	}
+}
+
+func TestNodeInfoCandidatesDuplicateRels(t *testing.T) {
+	const schema = "http://nodeinfo.diaspora.software/ns/schema/2.0"
+	links := []Link{
+		{Rel: schema, Href: "/nodeinfo/relative"},
+		{Rel: schema, Href: "https://cdn.example/nodeinfo/2.0"},
+		{Rel: "http://nodeinfo.diaspora.software/ns/schema/2.1", Href: "https://example.test/nodeinfo/2.1"},
+		{Rel: schema, Href: "https://example.test/nodeinfo/2.0"},
+	}
+	want := []string{
+		"https://example.test/nodeinfo/2.1",
+		"https://example.test/nodeinfo/2.0",
+		"https://cdn.example/nodeinfo/2.0",
+		"https://example.test/nodeinfo/relative",
+	}
+	if hrefs := candidateHrefs(links, ""); !slices.Equal(hrefs, want) {
+		t.Errorf("got %q, want %q", hrefs, want)
+	}
+}
+
+func TestNodeInfoFallsBackToAlternateHref(t *testing.T) {
+	instance := fixtures{
+		"example.test/.well-known/nodeinfo": `{"links": [
+			{"rel": "http://nodeinfo.diaspora.software/ns/schema/2.0", "href": "/nodeinfo/alternate"},
+			{"rel": "http://nodeinfo.diaspora.software/ns/schema/2.0", "href": "https://example.test/nodeinfo/2.0"}
+		]}`,
+		"example.test/nodeinfo/alternate": mastodonNodeInfo,
+	}
+	counter := &hitCounter{next: instance}
+	c := newTestClient(t, counter)
+	info, err := c.Lookup(context.Background(), "example.test")
+	if err != nil || info.Software.Name != "mastodon" {
+		t.Fatalf("got %+v, %v, want the alternate document", info, err)
+	}
+	if counter.count("example.test/nodeinfo/2.0") != 1 {
+		t.Error("preferred href wasn't tried")
+	}
+
+	instance["example.test/nodeinfo/2.0"] = strings.Replace(mastodonNodeInfo, "4.3.2", "4.3.3", 1)
+	c = newTestClient(t, instance)
+	if info, err := c.Lookup(context.Background(), "example.test"); err != nil || info.Software.Version != "4.3.3" {
+		t.Errorf("got %+v, %v, want the preferred document", info, err)
+	}
+}
+
+func TestMixedContentHref(t *testing.T) {
+	instance := fixtures{
+		"example.test/.well-known/nodeinfo": `{"links":[{"rel":"http://nodeinfo.diaspora.software/ns/schema/2.0","href":"http://example.test/nodeinfo/2.0"}]}`,
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+	}
+
+	c := newTestClient(t, instance)
+	info, err := c.Lookup(context.Background(), "example.test")
+	if err != nil || info.Software.Name != "mastodon" {
+		t.Fatalf("rewrite: got %+v, %v, want the rewritten document", info, err)
+	}
+	if !slices.ContainsFunc(info.Warnings, func(warning string) bool { return strings.Contains(warning, "rewrote mixed-content") }) {
+		t.Errorf("rewrite: got warnings %q, want the rewrite recorded", info.Warnings)
+	}
+
+	counter := &hitCounter{next: instance}
+	c = newTestClient(t, counter)
+	c.MixedContentPolicy = MixedContentReject
+	if info, err := c.Lookup(context.Background(), "example.test"); info.Software.IsResolved() {
+		t.Errorf("reject: got %+v, %v, want nothing resolved", info, err)
+	}
+	if counter.count("example.test/nodeinfo/2.0") != 0 {
+		t.Error("reject: the http href was followed")
+	}
+}
+
+// hostMetaXRD is a host-meta document that delegates webfinger to lrdd.
+func hostMetaXRD(lrdd string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<XRD xmlns="http://docs.oasis-open.org/ns/xri/xrd-1.0">
+	<Link rel="lrdd" template="` + lrdd + `"/>
+</XRD>`
+}
+
+func TestSplitDomain(t *testing.T) {
+	server := fixtures{
+		"social.example.test/.well-known/nodeinfo": wellKnown("social.example.test"),
+		"social.example.test/nodeinfo/2.0": mastodonNodeInfo,
+	}
+	for _, test := range []struct {
+		name string
+		handle http.Handler
+		wantServer string
+	}{
+		{"host-meta", fixtures{
+			"example.test/.well-known/host-meta": hostMetaXRD("https://social.example.test/.well-known/webfinger?resource={uri}"),
+		}, "social.example.test"},
+		{"redirect", http.RedirectHandler("https://social.example.test/.well-known/nodeinfo", http.StatusMovedPermanently), "social.example.test"},
+		{"http lrdd", fixtures{
+			"example.test/.well-known/host-meta": hostMetaXRD("http://social.example.test/.well-known/webfinger?resource={uri}"),
+		}, ""},
+		{"private lrdd", fixtures{
+			"example.test/.well-known/host-meta": hostMetaXRD("https://localhost/.well-known/webfinger?resource={uri}"),
+		}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Host == "example.test" {
+					test.handle.ServeHTTP(w, r)
+					return
+				}
+				server.ServeHTTP(w, r)
+			}))
+			info, _ := c.Lookup(context.Background(), "example.test")
+			if info.Domain != "example.test" || info.ServerDomain != test.wantServer {
+				t.Fatalf("got domain %s on server %q, want example.test on %q", info.Domain, info.ServerDomain, test.wantServer)
+			}
+			if resolved := info.Software.Name == "mastodon"; resolved != (test.wantServer != "") {
+				t.Errorf("got software %+v", info.Software)
+			}
+		})
+	}
+}
+
+// counts formats optional counts for comparison.
+func counts(values ...*int) string {
+	var formatted []string
+	for _, value := range values {
+		if value == nil {
+			formatted = append(formatted, "nil")
+		} else {
+			formatted = append(formatted, strconv.Itoa(*value))
+		}
+	}
+	return strings.Join(formatted, " ")
+}
+
+func TestParseUsage(t *testing.T) {
+	for _, test := range []struct {
+		raw string
+		want string // total, activeMonth, activeHalfyear, localPosts and localComments, or "" for no usage
+	}{
+		{`{"users": {"total": 10, "activeMonth": 5}}`, "10 5 nil nil nil"},
+		{`{"users": {"total": "10", "activeMonth": "5"}}`, "10 5 nil nil nil"},
+		{`{"users": {"total": 10}}`, "10 nil nil nil nil"},
+		{`{"users": {"activeMonth": 5.0}}`, "nil 5 nil nil nil"},
+		{`{"users": {"activeHalfyear": 7}, "localPosts": 100, "localComments": "3"}`, "nil nil 7 100 3"},
+		{`{"localPosts": 100}`, "nil nil nil 100 nil"},
+		{`{"users": {"total": -1, "activeMonth": "many"}}`, ""},
+		{`{"users": {}}`, ""},
+		{`{}`, ""},
+		{`[]`, ""},
+		{``, ""},
+	} {
+		usage := parseUsage(json.RawMessage(test.raw))
+		got := ""
+		if usage != nil {
+			got = counts(usage.Users.Total, usage.Users.ActiveMonth, usage.Users.ActiveHalfyear, usage.LocalPosts, usage.LocalComments)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestParseServices(t *testing.T) {
+	for _, test := range []struct {
+		raw string
+		want *Services
+	}{
+		{`{"inbound": ["gnusocial"], "outbound": ["atom1.0", "rss2.0"]}`, &Services{Inbound: []string{"gnusocial"}, Outbound: []string{"atom1.0", "rss2.0"}}},
+		{`{"inbound": [], "outbound": ["rss2.0", 42, "", null]}`, &Services{Inbound: []string{}, Outbound: []string{"rss2.0"}}},
+		{`{}`, &Services{Inbound: []string{}, Outbound: []string{}}},
+		{`{"inbound": "gnusocial"}`, nil},
+		{`[]`, nil},
+		{``, nil},
+	} {
+		got := parseServices(json.RawMessage(test.raw))
+		if (got == nil) != (test.want == nil) {
+			t.Errorf("%s: got %+v, want %+v", test.raw, got, test.want)
+			continue
+		}
+		if got != nil && (!slices.Equal(got.Inbound, test.want.Inbound) || !slices.Equal(got.Outbound, test.want.Outbound)) {
+			t.Errorf("%s: got %+v, want %+v", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestParseOpenRegistrations(t *testing.T) {
+	for _, test := range []struct {
+		raw string
+		want string
+	}{
+		{`true`, "true"},
+		{`false`, "false"},
+		{`"true"`, "true"},
+		{`"0"`, "false"},
+		{`"maybe"`, "nil"},
+		{`1`, "nil"},
+		{`null`, "nil"},
+		{``, "nil"},
+	} {
+		got := "nil"
+		if open := parseOpenRegistrations(json.RawMessage(test.raw)); open != nil {
+			got = strconv.FormatBool(*open)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestParseProtocols(t *testing.T) {
+	for _, test := range []struct {
+		raw string
+		want []string
+	}{
+		{`["activitypub", "diaspora"]`, []string{"activitypub", "diaspora"}},
+		{`["ActivityPub", " activitypub ", ""]`, []string{"activitypub"}},
+		{`{"inbound": ["ostatus"], "outbound": ["ostatus", "activitypub"]}`, []string{"ostatus", "activitypub"}},
+		{`"activitypub"`, []string{"activitypub"}},
+		{`[]`, nil},
+		{`42`, nil},
+		{``, nil},
+	} {
+		if got := parseProtocols(json.RawMessage(test.raw)); !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestRicherNodeInfo(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+	})
+	info, err := c.Lookup(context.Background(), "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Usage == nil || counts(info.Usage.Users.Total, info.Usage.Users.ActiveMonth) != "10 5" {
+		t.Errorf("got usage %+v, want 10 users, 5 active", info.Usage)
+	}
+	if counts(info.Usage.Users.ActiveHalfyear, info.Usage.LocalPosts) != "7 100" {
+		t.Errorf("got usage %+v, want 7 active in the half year, 100 posts", info.Usage)
+	}
+	if info.OpenRegistrations == nil || !*info.OpenRegistrations {
+		t.Errorf("got open registrations %v, want true", info.OpenRegistrations)
+	}
+	if !slices.Equal(info.Protocols, []string{"activitypub"}) {
+		t.Errorf("got protocols %q", info.Protocols)
+	}
+	if info.Metadata["nodeName"] != "example" {
+		t.Errorf("got metadata %v", info.Metadata)
+	}
+}
+
+func TestNodeInfoCandidatesOnlyHTTPS(t *testing.T) {
+	const schema = "http://nodeinfo.diaspora.software/ns/schema/2.0"
+	links := []Link{
+		{Rel: schema, Href: "http://other.test/nodeinfo/2.0"},
+		{Rel: schema, Href: "http://10.0.0.1/nodeinfo/2.0"},
+		{Rel: schema, Href: "ftp://example.test/nodeinfo/2.0"},
+		{Rel: schema, Href: "https://localhost/nodeinfo/2.0"},
+	}
+	for _, policy := range []MixedContentPolicy{"", MixedContentRewrite, MixedContentReject} {
+		if hrefs := candidateHrefs(links, policy); len(hrefs) > 0 {
+			t.Errorf("policy %q: got %q, want none", policy, hrefs)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package fedinfo
+
+import (
+	"context"
+	"net"
+	"time"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/net/idna"
+)
+
+// NewTransport returns a transport for requests to instances, which only
+// connects to public addresses of the ip family.
+func NewTransport(family IPFamily) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout: 30*time.Second,
+		KeepAlive: 30*time.Second,
+		Control: guardDial,
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, family.network(network), addr)
+	}
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	// crypto/tls reports some handshake failures, like an unsupported
+	// version, as plain errors; doing the handshake here marks them all
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := transport.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		config := transport.TLSClientConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		if config.NextProtos == nil {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
+		if transport.TLSHandshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, transport.TLSHandshakeTimeout)
+			defer cancel()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			var netErr net.Error
+			if ctx.Err() != nil || errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, err
+			}
+			return nil, tlsHandshakeError{err}
+		}
+		return tlsConn, nil
+	}
+	// instances have no business sending anywhere near the 1MB go allows by default
+	transport.MaxResponseHeaderBytes = 64 << 10
+	return transport
+}
+
+// IPFamily restricts which address family outbound connections use, to
+// diagnose instances that are only reachable over one of them.
+type IPFamily string
+
+const (
+	IPFamilyAuto IPFamily = "auto"
+	IPFamilyV4 IPFamily = "v4"
+	IPFamilyV6 IPFamily = "v6"
+)
+
+// network narrows a dial network like tcp or udp to the family.
+func (family IPFamily) network(network string) string {
+	switch family {
+	case IPFamilyV4:
+		return strings.TrimRight(network, "46") + "4"
+	case IPFamilyV6:
+		return strings.TrimRight(network, "46") + "6"
+	}
+	return network
+}
+
+// resolveAddr resolves the host of addr to an ip address of the family.
+func (family IPFamily) resolveAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, family.network("ip"), host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no %s address for %s", family, host)
+	}
+	return net.JoinHostPort(ips[0].Unmap().String(), port), nil
+}
+
+// blockedPrefixes are ranges that aren't publicly routable, on top of the
+// ones covered by the netip.Addr predicates.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade nat
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // nat64, may embed any of the above
+}
+
+// AllowedPrefixes are exempt from isBlockedIP, to test against instances on
+// a local network. Set it before the first lookup, it is not synchronized.
+var AllowedPrefixes []netip.Prefix
+
+// isBlockedIP reports whether ip is in a range that outbound requests must
+// never reach, so that the service can't be used to probe the network it
+// runs in: private, loopback, link-local, unspecified and the like.
+func isBlockedIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range AllowedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if !ip.IsValid() || ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPublicHostname reports whether host is a dns name that can be looked up
+// publicly, rejecting ip literals and single labels like localhost.
+func IsPublicHostname(host string) bool {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return false
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return false
+	}
+	return IsValidHostname(ascii) && strings.Contains(ascii, ".")
+}
+
+// checkPublicHost rejects host if it resolves to a blocked address. Failing
+// to resolve it at all is left for the actual request to report.
+func checkPublicHost(ctx context.Context, host string) error {
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if isBlockedIP(ip) {
+			return ErrNonPublicHost{Host: host}
+		}
+	}
+	return nil
+}
+
+var errBlockedAddress = errors.New("refusing to connect to non-public address")
+
+// ErrNonPublicHost is returned for lookups of domains that resolve to
+// addresses that are off limits, see isBlockedIP.
+type ErrNonPublicHost struct {
+	Host string
+}
+
+func (e ErrNonPublicHost) Error() string {
+	return fmt.Sprintf("refusing to query %s, it resolves to a non-public address", e.Host)
+}
+
+func (e ErrNonPublicHost) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	status := http.StatusBadRequest
+	http.Error(w, e.Error(), status)
+	return true
+}
+
+func (e ErrNonPublicHost) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// guardDial checks every outbound connection once its address is resolved.
+// This also covers redirect targets and nodeinfo urls, which are chosen by
+// the remote server, and dns records that change after checkPublicHost.
+func guardDial(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if isBlockedIP(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", errBlockedAddress, address)
+	}
+	return nil
+}
+
+// TLSVersions maps the usual names of tls versions to their ids.
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// get requests url with the client's http client, and classifies errors that
+// are the instance's fault. The response body is capped at the client's
+// MaxBodyBytes.
+func (c *Client) get(ctx context.Context, url string) (*http.Response, error) {
+	return c.getLimit(ctx, url, c.maxBodyBytes())
+}
+
+// getLimit is like get, with a body size limit for responses known to be
+// larger than usual.
+func (c *Client) getLimit(ctx context.Context, url string, limit int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil && errors.Is(err, errBlockedAddress) {
+		return nil, ErrUpstreamInvalid{
+			Domain: req.URL.Host,
+			Violations: []string{err.Error()},
+			Err: err,
+		}
+	}
+	if err != nil && isTLSError(err) {
+		return nil, ErrUpstreamTLS{Host: req.URL.Host, Err: err}
+	}
+	if err != nil && isHeaderLimitError(err) {
+		return nil, ErrUpstreamInvalid{
+			Domain: req.URL.Host,
+			Violations: []string{err.Error()},
+			Err: err,
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	tooLarge := ErrUpstreamInvalid{
+		Domain: req.URL.Host,
+		Violations: []string{fmt.Sprintf("response body exceeds %d bytes", limit)},
+	}
+	if resp.ContentLength > limit {
+		resp.Body.Close()
+		return nil, tooLarge
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: limit, err: tooLarge}
+	return resp, nil
+}
+
+// limitedBody fails reads past its limit instead of silently truncating, so
+// that an oversized document isn't mistaken for a malformed one.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1] // one more byte, to tell whether the limit is exceeded
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n = int(b.remaining)
+	b.remaining = -1
+	return n, b.err
+}
+
+// ErrUpstreamTLS is returned when no acceptable TLS connection could be
+// established with an instance, e.g. because it only supports TLS versions
+// below the configured minimum or presents an invalid certificate.
+type ErrUpstreamTLS struct {
+	Host string
+	Err error
+}
+
+func (e ErrUpstreamTLS) Error() string {
+	return fmt.Sprintf("tls connection to %s failed: %v", e.Host, e.Err)
+}
+
+func (e ErrUpstreamTLS) Unwrap() error {
+	return e.Err
+}
+
+func (e ErrUpstreamTLS) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	status := http.StatusBadGateway
+	http.Error(w, e.Error(), status)
+	return true
+}
+
+func (e ErrUpstreamTLS) StatusCode() int {
+	return http.StatusBadGateway
+}
+
+// tlsHandshakeError marks errors of handshakes done by NewTransport.
+type tlsHandshakeError struct {
+	err error
+}
+
+func (e tlsHandshakeError) Error() string {
+	return e.err.Error()
+}
+
+func (e tlsHandshakeError) Unwrap() error {
+	return e.err
+}
+
+func isTLSError(err error) bool {
+	var (
+		handshakeErr tlsHandshakeError
+		alertErr tls.AlertError
+		recordErr tls.RecordHeaderError
+		certErr *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+	)
+	return errors.As(err, &handshakeErr) || errors.As(err, &alertErr) || errors.As(err, &recordErr) ||
+		errors.As(err, &certErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// isHeaderLimitError reports whether err is due to the response headers
+// exceeding the transport's MaxResponseHeaderBytes. net/http has no error
+// type or value for this, so the message is all there is to go by.
+func isHeaderLimitError(err error) bool {
+	return strings.Contains(err.Error(), "server response headers exceeded")
+}
+
+// ErrorClass sorts errors of lookups and of requests to instances into a
+// few broad classes, for monitoring: timeout, blocked, tls, dns, refused,
+// invalid, cache or other. It returns an empty string for a nil error.
+func ErrorClass(err error) string {
+	var (
+		netErr net.Error
+		dnsErr *net.DNSError
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrLookupTimeout), errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, errBlockedAddress), errors.As(err, new(ErrNonPublicHost)):
+		return "blocked"
+	case errors.As(err, new(ErrUpstreamTLS)), isTLSError(err):
+		return "tls"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.As(err, new(ErrUpstreamInvalid)):
+		return "invalid"
+	case errors.As(err, new(ErrCacheUnavailable)):
+		return "cache"
+	}
+	return "other"
+}
+
+// NewHTTPClient returns a client for requests to instances. Its timeout
+// bounds each single request, including reading the body, while a Client's
+// MaxDuration bounds a whole lookup. Only redirects to public https urls are
+// followed, and at most maxRedirects of them.
+func NewHTTPClient(transport http.RoundTripper, timeout time.Duration, maxRedirects int) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if req.URL.Scheme != "https" || req.URL.User != nil || !IsPublicHostname(req.URL.Hostname()) {
+				return fmt.Errorf("refusing to follow redirect to %s", req.URL)
+			}
+			return nil
+		},
+	}
+}
+
+// IsValidHostname reports whether host is syntactically a dns name: at most
+// 253 characters of dot separated labels, each of 1 to 63 letters, digits
+// and inner hyphens. Internationalized names must be converted to ascii
+// first, see IsPublicHostname.
+func IsValidHostname(host string) bool {
+	if len(host) == 0 || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
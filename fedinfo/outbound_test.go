@@ -0,0 +1,360 @@
+package fedinfo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// allowLoopback exempts the loopback addresses of test servers from the
+// guard for the rest of the test.
+func allowLoopback(t *testing.T) {
+	original := AllowedPrefixes
+	t.Cleanup(func() { AllowedPrefixes = original })
+	AllowedPrefixes = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+}
+
+// newTrustingClient returns a client with the transport used in production
+// for family, trusting srv, after passing the transport to configure.
+func newTrustingClient(t *testing.T, srv *httptest.Server, family IPFamily, configure func(*http.Transport)) *Client {
+	allowLoopback(t)
+	transport := NewTransport(family)
+	transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+	transport.TLSClientConfig.RootCAs.AddCert(srv.Certificate())
+	transport.TLSClientConfig.ServerName = "example.com"
+	configure(transport)
+	return &Client{HTTPClient: NewHTTPClient(transport, 5*time.Second, 10)}
+}
+
+func TestTransportMinTLSVersion(t *testing.T) {
+	srv := httptest.NewUnstartedServer(fixtures{"example.com/": "{}"})
+	srv.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // the failed handshake is expected
+	srv.StartTLS()
+	defer srv.Close()
+
+	c := newTrustingClient(t, srv, IPFamilyAuto, func(*http.Transport) {})
+	_, err := c.get(context.Background(), srv.URL)
+	if !errors.As(err, new(ErrUpstreamTLS)) {
+		t.Errorf("default: got %v, want a tls error", err)
+	}
+	c = newTrustingClient(t, srv, IPFamilyAuto, func(transport *http.Transport) {
+		transport.TLSClientConfig.MinVersion = TLSVersions["1.0"]
+	})
+	resp, err := c.get(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("TLS 1.0 allowed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.TLS.Version != tls.VersionTLS11 {
+		t.Errorf("TLS 1.0 allowed: got version %s, want TLS 1.1", tls.VersionName(resp.TLS.Version))
+	}
+}
+
+func TestTransportMaxResponseHeaderBytes(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := range 10 {
+			w.Header().Set(fmt.Sprintf("X-Padding-%d", i), strings.Repeat("x", 1000))
+		}
+	}))
+	defer srv.Close()
+	for _, test := range []struct {
+		limit int64
+		wantErr bool
+	}{
+		{0, false}, // the default
+		{4 << 10, true},
+		{16 << 10, false},
+	} {
+		c := newTrustingClient(t, srv, IPFamilyAuto, func(transport *http.Transport) {
+			if test.limit != 0 {
+				transport.MaxResponseHeaderBytes = test.limit
+			}
+		})
+		resp, err := c.get(context.Background(), srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if test.wantErr && !errors.As(err, new(ErrUpstreamInvalid)) {
+			t.Errorf("limit %d: got %v, want invalid", test.limit, err)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("limit %d: got %v, want no error", test.limit, err)
+		}
+	}
+}
+
+func TestGetRejectsOversizedHeaders(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := range 100 {
+			w.Header().Set(fmt.Sprintf("X-Padding-%d", i), strings.Repeat("x", 1000))
+		}
+	}))
+	defer srv.Close()
+	c := newTrustingClient(t, srv, IPFamilyAuto, func(*http.Transport) {})
+	_, err := c.get(context.Background(), srv.URL)
+	if !errors.As(err, new(ErrUpstreamInvalid)) || ErrorClass(err) != "invalid" {
+		t.Errorf("got %v of class %s, want invalid", err, ErrorClass(err))
+	}
+}
+
+func TestIPFamilyNetwork(t *testing.T) {
+	for _, test := range []struct {
+		family IPFamily
+		network, want string
+	}{
+		{IPFamilyAuto, "tcp", "tcp"},
+		{"", "udp", "udp"},
+		{IPFamilyV4, "tcp", "tcp4"},
+		{IPFamilyV4, "tcp6", "tcp4"},
+		{IPFamilyV4, "ip", "ip4"},
+		{IPFamilyV6, "udp", "udp6"},
+		{IPFamilyV6, "tcp4", "tcp6"},
+	} {
+		if got := test.family.network(test.network); got != test.want {
+			t.Errorf("%s %s: got %s, want %s", test.family, test.network, got, test.want)
+		}
+	}
+}
+
+func TestTransportIPFamily(t *testing.T) {
+	for _, test := range []struct {
+		network, addr string
+		reachable map[IPFamily]bool
+	}{
+		{"tcp4", "127.0.0.1:0", map[IPFamily]bool{IPFamilyAuto: true, IPFamilyV4: true, IPFamilyV6: false}},
+		{"tcp6", "[::1]:0", map[IPFamily]bool{IPFamilyAuto: true, IPFamilyV4: false, IPFamilyV6: true}},
+	} {
+		listener, err := net.Listen(test.network, test.addr)
+		if err != nil {
+			t.Skipf("no %s loopback: %v", test.network, err)
+		}
+		srv := httptest.NewUnstartedServer(fixtures{})
+		srv.Listener.Close()
+		srv.Listener = listener
+		srv.StartTLS()
+		defer srv.Close()
+		for family, reachable := range test.reachable {
+			c := newTrustingClient(t, srv, family, func(*http.Transport) {})
+			resp, err := c.get(context.Background(), srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != reachable {
+				t.Errorf("%s over %s: got %v, want reachable: %t", srv.URL, family, err, reachable)
+			}
+		}
+	}
+}
+
+func TestIsBlockedIP(t *testing.T) {
+	for _, test := range []struct {
+		ip string
+		blocked bool
+	}{
+		{"0.0.0.0", true},
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true}, // cloud metadata
+		{"100.64.0.1", true},
+		{"192.0.0.8", true},
+		{"198.18.0.1", true},
+		{"224.0.0.1", true},
+		{"240.0.0.1", true},
+		{"255.255.255.255", true},
+		{"::", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fc00::1", true},
+		{"fd12:3456::1", true},
+		{"ff02::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"64:ff9b::a9fe:a9fe", true}, // nat64 of 169.254.169.254
+		{"1.1.1.1", false},
+		{"93.184.215.14", false},
+		{"100.63.255.255", false},
+		{"2606:4700::6810:84e5", false},
+		{"::ffff:1.1.1.1", false},
+	} {
+		if blocked := isBlockedIP(netip.MustParseAddr(test.ip)); blocked != test.blocked {
+			t.Errorf("%s: got blocked %v, want %v", test.ip, blocked, test.blocked)
+		}
+	}
+	if !isBlockedIP(netip.Addr{}) {
+		t.Errorf("the zero address isn't blocked")
+	}
+}
+
+func TestAllowedPrefixes(t *testing.T) {
+	defer func(prefixes []netip.Prefix) { AllowedPrefixes = prefixes }(AllowedPrefixes)
+	AllowedPrefixes = []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}
+	if isBlockedIP(netip.MustParseAddr("192.168.1.10")) {
+		t.Errorf("allowed address is blocked")
+	}
+	if !isBlockedIP(netip.MustParseAddr("192.168.2.10")) {
+		t.Errorf("address outside of the allowed prefix isn't blocked")
+	}
+}
+
+func TestGuardDial(t *testing.T) {
+	srv := httptest.NewTLSServer(fixtures{})
+	defer srv.Close()
+	c := &Client{HTTPClient: NewHTTPClient(NewTransport(IPFamilyAuto), 5*time.Second, 10)}
+
+	_, err := c.get(context.Background(), srv.URL)
+	if !errors.As(err, new(ErrUpstreamInvalid)) || !errors.Is(err, errBlockedAddress) || ErrorClass(err) != "blocked" {
+		t.Errorf("loopback: got %v of class %s, want a blocked address", err, ErrorClass(err))
+	}
+
+	allowLoopback(t)
+	_, err = c.get(context.Background(), srv.URL)
+	var certErr x509.UnknownAuthorityError
+	if !errors.As(err, new(ErrUpstreamTLS)) || !errors.As(err, &certErr) || ErrorClass(err) != "tls" {
+		t.Errorf("allowed loopback: got %v of class %s, want a certificate error", err, ErrorClass(err))
+	}
+}
+
+func TestGetBodyLimit(t *testing.T) {
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", 100)
+		if r.URL.Path == "/announced" {
+			w.Header().Set("Content-Length", "100")
+		}
+		io.WriteString(w, body[:50])
+		w.(http.Flusher).Flush() // without a content length
+		io.WriteString(w, body[50:])
+	}))
+	c.MaxBodyBytes = 64
+	if _, err := c.get(context.Background(), "https://example.test/announced"); !errors.As(err, new(ErrUpstreamInvalid)) {
+		t.Errorf("announced: got %v, want invalid", err)
+	}
+	resp, err := c.get(context.Background(), "https://example.test/streamed")
+	if err != nil {
+		t.Fatalf("streamed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if !errors.As(err, new(ErrUpstreamInvalid)) || len(body) != 64 {
+		t.Errorf("streamed: got %d bytes, %v, want 64 bytes and invalid", len(body), err)
+	}
+
+	c.MaxBodyBytes = 100
+	resp, err = c.get(context.Background(), "https://example.test/streamed")
+	if err != nil {
+		t.Fatalf("at the limit: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, err := io.ReadAll(resp.Body); err != nil || len(body) != 100 {
+		t.Errorf("at the limit: got %d bytes, %v", len(body), err)
+	}
+}
+
+func TestGetTimeout(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5*time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	c := newTestClient(t, slow)
+	c.HTTPClient.Timeout = 100*time.Millisecond
+	start := time.Now()
+	_, err := c.get(context.Background(), "https://example.test/.well-known/nodeinfo")
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("request took %s, want about %s", took, c.HTTPClient.Timeout)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() || ErrorClass(err) != "timeout" {
+		t.Errorf("got %v of class %s, want a timeout", err, ErrorClass(err))
+	}
+
+	// the caller going away cancels the request just the same
+	c.HTTPClient.Timeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := c.get(ctx, "https://example.test/.well-known/nodeinfo"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("cancelled request took %s", took)
+	}
+}
+
+func TestGetRedirectLimit(t *testing.T) {
+	// /hops/n redirects n more times before it arrives
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hops int
+		fmt.Sscanf(r.URL.Path, "/hops/%d", &hops)
+		if hops > 0 {
+			http.Redirect(w, r, fmt.Sprintf("https://example.test/hops/%d", hops-1), http.StatusFound)
+		}
+	}))
+	c.HTTPClient = NewHTTPClient(c.HTTPClient.Transport, 5*time.Second, 3)
+	resp, err := c.get(context.Background(), "https://example.test/hops/3")
+	if err != nil {
+		t.Fatalf("3 redirects: %v", err)
+	}
+	resp.Body.Close()
+	if _, err := c.get(context.Background(), "https://example.test/hops/4"); err == nil || !strings.Contains(err.Error(), "stopped after 3 redirects") {
+		t.Errorf("4 redirects: got %v, want the redirects to be stopped", err)
+	}
+	if _, err := c.get(context.Background(), "https://example.test/hops/1000"); err == nil {
+		t.Error("endless redirects: got no error")
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	for _, test := range []struct {
+		err error
+		class string
+	}{
+		{nil, ""},
+		{ErrLookupTimeout, "timeout"},
+		{fmt.Errorf("lookup: %w", context.DeadlineExceeded), "timeout"},
+		{ErrNonPublicHost{Host: "localhost"}, "blocked"},
+		{ErrUpstreamInvalid{Domain: "example.test", Err: fmt.Errorf("%w: 10.0.0.1:443", errBlockedAddress)}, "blocked"},
+		{ErrUpstreamTLS{Host: "example.test", Err: x509.UnknownAuthorityError{}}, "tls"},
+		{&net.DNSError{Err: "no such host", Name: "example.test", IsNotFound: true}, "dns"},
+		{&net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}, "refused"},
+		{ErrUpstreamInvalid{Domain: "example.test", Violations: []string{"empty well-known response"}}, "invalid"},
+		{ErrCacheUnavailable{Err: errors.New("connection refused")}, "cache"},
+		{errors.New("something else"), "other"},
+	} {
+		if class := ErrorClass(test.err); class != test.class {
+			t.Errorf("%v: got class %q, want %q", test.err, class, test.class)
+		}
+	}
+}
+
+func TestTransportNegotiatesHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(fixtures{"example.com/": "{}"})
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	c := newTrustingClient(t, srv, IPFamilyAuto, func(*http.Transport) {})
+	resp, err := c.HTTPClient.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("got %s, want HTTP/2", resp.Proto)
+	}
+}
@@ -0,0 +1,121 @@
+package fedinfo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// MaxPeers bounds how many peers of an instance are returned.
+	MaxPeers = 10_000
+	// maxPeersBytes bounds the size of the peer list we are willing to read.
+	maxPeersBytes = 8 << 20
+)
+
+// Peers returns the instances a server federates with, up to MaxPeers of
+// them. The peer list of the Mastodon API is supported, which many other
+// servers implement too, and the federated instances of Lemmy.
+func (c *Client) Peers(ctx context.Context, domain string) (peers []string, truncated bool, err error) {
+	resp, err := c.getLimit(ctx, fmt.Sprintf("https://%s/api/v1/instance/peers", domain), maxPeersBytes)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	var raw []string
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+			return nil, false, fmt.Errorf("%s: invalid peer list: %w", domain, err)
+		}
+	case http.StatusNotFound:
+		raw, err = c.lemmyPeers(ctx, domain)
+		if err != nil {
+			return nil, false, err
+		}
+	default:
+		return nil, false, fmt.Errorf("%s: unexpected status: %s", resp.Request.URL, resp.Status)
+	}
+	seen := map[string]bool{}
+	for _, peer := range raw {
+		peer = strings.ToLower(peer)
+		if seen[peer] || !IsValidHostname(peer) {
+			continue
+		}
+		if len(peers) == MaxPeers {
+			return peers, true, nil
+		}
+		seen[peer] = true
+		peers = append(peers, peer)
+	}
+	return peers, false, nil
+}
+
+func (c *Client) lemmyPeers(ctx context.Context, domain string) ([]string, error) {
+	resp, err := c.getLimit(ctx, fmt.Sprintf("https://%s/api/v3/federated_instances", domain), maxPeersBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status: %s", resp.Request.URL, resp.Status)
+	}
+	var instances struct {
+		FederatedInstances struct {
+			Linked []struct {
+				Domain string `json:"domain"`
+			} `json:"linked"`
+		} `json:"federated_instances"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&instances); err != nil {
+		return nil, fmt.Errorf("%s: invalid peer list: %w", domain, err)
+	}
+	peers := make([]string, 0, len(instances.FederatedInstances.Linked))
+	for _, instance := range instances.FederatedInstances.Linked {
+		peers = append(peers, instance.Domain)
+	}
+	return peers, nil
+}
+
+// extractPeerCount reads the number of known peers from nodeinfo metadata,
+// if the software publishes it.
+func extractPeerCount(metadata map[string]any) *int {
+	for _, key := range []string{"peerCount", "peers_count", "domainCount", "domain_count", "peers"} {
+		switch value := metadata[key].(type) {
+		case float64:
+			if value >= 0 {
+				count := int(value)
+				return &count
+			}
+		case []any:
+			count := len(value)
+			return &count
+		}
+	}
+	return nil
+}
+
+// PeerCount reads the number of known peers from the instance statistics of
+// the Mastodon API, which is much cheaper than fetching the peer list. A nil
+// count means the API doesn't report one.
+func (c *Client) PeerCount(ctx context.Context, domain string) (*int, error) {
+	resp, err := c.get(ctx, fmt.Sprintf("https://%s/api/v1/instance", domain))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status: %s", resp.Request.URL, resp.Status)
+	}
+	var instance struct {
+		Stats struct {
+			DomainCount *int `json:"domain_count"`
+		} `json:"stats"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&instance); err != nil {
+		return nil, err
+	}
+	return instance.Stats.DomainCount, nil
+}
@@ -0,0 +1,103 @@
+package fedinfo
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestExtractPeerCount(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		metadata map[string]any
+		want int // -1 for none
+	}{
+		{"count", map[string]any{"peerCount": 1200.0}, 1200},
+		{"domain count", map[string]any{"domain_count": 42.0}, 42},
+		{"list", map[string]any{"peers": []any{"a.example", "b.example"}}, 2},
+		{"first key wins", map[string]any{"peers_count": 7.0, "peers": []any{"a.example"}}, 7},
+		{"negative", map[string]any{"peerCount": -1.0}, -1},
+		{"wrong type", map[string]any{"peerCount": "many"}, -1},
+		{"none", map[string]any{"nodeName": "example"}, -1},
+	} {
+		got := extractPeerCount(test.metadata)
+		if test.want < 0 && got != nil || test.want >= 0 && (got == nil || *got != test.want) {
+			t.Errorf("%s: got %v, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPeerCount(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"mastodon.test/api/v1/instance": `{"uri": "mastodon.test", "stats": {"user_count": 5000, "status_count": 100000, "domain_count": 4321}}`,
+		"nostats.test/api/v1/instance": `{"uri": "nostats.test"}`,
+	})
+	if count, err := c.PeerCount(context.Background(), "mastodon.test"); err != nil || count == nil || *count != 4321 {
+		t.Errorf("mastodon: got %v, %v, want 4321", count, err)
+	}
+	if count, err := c.PeerCount(context.Background(), "nostats.test"); err != nil || count != nil {
+		t.Errorf("without stats: got %v, %v, want nil", count, err)
+	}
+	if _, err := c.PeerCount(context.Background(), "missing.test"); err == nil {
+		t.Error("without api: got no error")
+	}
+}
+
+func TestPeerCountFromNodeInfo(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": `{
+			"version": "2.0",
+			"software": {"name": "gotosocial", "version": "0.17.3"},
+			"protocols": ["activitypub"],
+			"services": {"inbound": [], "outbound": []},
+			"openRegistrations": false,
+			"usage": {"users": {"total": 1}},
+			"metadata": {"nodeName": "example", "peerCount": 321}
+		}`,
+	})
+	info, err := c.Lookup(context.Background(), "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.PeerCount == nil || *info.PeerCount != 321 {
+		t.Errorf("got %v, want 321", info.PeerCount)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"mastodon.test/api/v1/instance/peers": `["a.example", "B.example", "a.example", "not a host"]`,
+		"lemmy.test/api/v3/federated_instances": `{"federated_instances": {"linked": [{"domain": "c.example"}, {"domain": "d.example"}]}}`,
+	})
+	for _, test := range []struct {
+		domain string
+		want []string
+	}{
+		{"mastodon.test", []string{"a.example", "b.example"}},
+		{"lemmy.test", []string{"c.example", "d.example"}},
+	} {
+		peers, truncated, err := c.Peers(context.Background(), test.domain)
+		if err != nil || truncated || !slices.Equal(peers, test.want) {
+			t.Errorf("%s: got %q, %v, %v, want %q", test.domain, peers, truncated, err, test.want)
+		}
+	}
+	if _, _, err := c.Peers(context.Background(), "missing.test"); err == nil {
+		t.Error("without peer list: got no error")
+	}
+}
+
+func TestPeerCountFromMastodonAPI(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"example.test/.well-known/nodeinfo": `{"links":[{"rel":"http://nodeinfo.diaspora.software/ns/schema/2.0","href":"https://social.example.test/nodeinfo/2.0"}]}`,
+		"social.example.test/nodeinfo/2.0": mastodonNodeInfo,
+		"social.example.test/api/v1/instance": `{"uri": "social.example.test", "stats": {"domain_count": 4321}}`,
+	})
+	info, err := c.Lookup(context.Background(), "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ServerDomain != "social.example.test" || info.PeerCount == nil || *info.PeerCount != 4321 {
+		t.Errorf("got peer count %v from %s, want 4321 from social.example.test", info.PeerCount, info.ServerDomain)
+	}
+}
@@ -0,0 +1,86 @@
+package fedinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+type (
+	// RewriteRule relabels the software reported by an instance. A rule
+	// matches if all of its configured patterns match; an empty pattern
+	// matches anything. Non-empty SetName/SetVersion replace the respective
+	// field of a matching software.
+	RewriteRule struct {
+		Name *regexp.Regexp
+		Version *regexp.Regexp
+		SetName string
+		SetVersion string
+	}
+	RewriteRules struct {
+		Rules []RewriteRule
+		// ApplyAll applies every matching rule in order, each seeing the
+		// result of the previous one. Otherwise only the first match applies.
+		ApplyAll bool
+	}
+)
+
+func (rule RewriteRule) Matches(sfw Software) bool {
+	if rule.Name != nil && !rule.Name.MatchString(sfw.Name) {
+		return false
+	}
+	if rule.Version != nil && !rule.Version.MatchString(sfw.Version) {
+		return false
+	}
+	return true
+}
+
+func (rules RewriteRules) Apply(sfw Software) Software {
+	for _, rule := range rules.Rules {
+		if !rule.Matches(sfw) {
+			continue
+		}
+		if rule.SetName != "" {
+			sfw.Name = rule.SetName
+		}
+		if rule.SetVersion != "" {
+			sfw.Version = rule.SetVersion
+		}
+		if !rules.ApplyAll {
+			break
+		}
+	}
+	return sfw
+}
+
+// ParseRewriteRules reads rules from a json array like
+//
+//	[{"name": "^wildebeest$", "setName": "cloudflare-wildebeest"}]
+func ParseRewriteRules(data string) (rules []RewriteRule, err error) {
+	var raw []struct {
+		Name string `json:"name"`
+		Version string `json:"version"`
+		SetName string `json:"setName"`
+		SetVersion string `json:"setVersion"`
+	}
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, err
+	}
+	for i, r := range raw {
+		var rule RewriteRule
+		if r.Name != "" {
+			if rule.Name, err = regexp.Compile(r.Name); err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+		}
+		if r.Version != "" {
+			if rule.Version, err = regexp.Compile(r.Version); err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+		}
+		rule.SetName = r.SetName
+		rule.SetVersion = r.SetVersion
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
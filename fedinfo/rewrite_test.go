@@ -0,0 +1,66 @@
+package fedinfo
+
+import (
+	"testing"
+)
+
+func TestRewriteRulesPrecedence(t *testing.T) {
+	rules, err := ParseRewriteRules(`[
+		{"name": "^wildebeest$", "setName": "cloudflare-wildebeest"},
+		{"name": "soc$", "setName": "mastodon"},
+		{"name": "^mastodon$", "version": "glitch", "setName": "glitch-soc"},
+		{"name": "^mastodon$", "setVersion": "unknown"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		software Software
+		first, all Software
+	}{
+		{
+			Software{Name: "wildebeest", Version: "0.1.0"},
+			Software{Name: "cloudflare-wildebeest", Version: "0.1.0"},
+			Software{Name: "cloudflare-wildebeest", Version: "0.1.0"},
+		},
+		{
+			Software{Name: "hometownsoc", Version: "4.2.10"},
+			Software{Name: "mastodon", Version: "4.2.10"},
+			Software{Name: "mastodon", Version: "unknown"},
+		},
+		{
+			Software{Name: "mastodon", Version: "4.3.0+glitch"},
+			Software{Name: "glitch-soc", Version: "4.3.0+glitch"},
+			Software{Name: "glitch-soc", Version: "4.3.0+glitch"},
+		},
+		{
+			Software{Name: "mastodon", Version: "4.3.2"},
+			Software{Name: "mastodon", Version: "unknown"},
+			Software{Name: "mastodon", Version: "unknown"},
+		},
+		{
+			Software{Name: "misskey", Version: "2024.11.0"},
+			Software{Name: "misskey", Version: "2024.11.0"},
+			Software{Name: "misskey", Version: "2024.11.0"},
+		},
+	} {
+		if got := (RewriteRules{Rules: rules}).Apply(test.software); got != test.first {
+			t.Errorf("first match of %+v: got %+v, want %+v", test.software, got, test.first)
+		}
+		if got := (RewriteRules{Rules: rules, ApplyAll: true}).Apply(test.software); got != test.all {
+			t.Errorf("all matches of %+v: got %+v, want %+v", test.software, got, test.all)
+		}
+	}
+}
+
+func TestParseRewriteRulesInvalid(t *testing.T) {
+	for _, data := range []string{
+		`{"name": "mastodon"}`,
+		`[{"name": "("}]`,
+		`[{"version": "["}]`,
+	} {
+		if _, err := ParseRewriteRules(data); err == nil {
+			t.Errorf("%s: got no error", data)
+		}
+	}
+}
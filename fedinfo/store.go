@@ -0,0 +1,250 @@
+package fedinfo
+
+import (
+	"log/slog"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// CacheStore persists cache entries, so that they survive restarts and can
+// be shared between replicas. Entries are written in batches by Cache.Flush
+// and read back by Cache.Load at startup, and by a Client with a Backend on
+// every miss of its in-memory cache.
+type CacheStore interface {
+	// Load returns all persisted entries.
+	Load(ctx context.Context) (CacheFile, error)
+	// Get returns the persisted entry of key and when it was stored.
+	Get(ctx context.Context, key string) (info NodeInfo, age time.Time, found bool, err error)
+	// Put persists the entries of file, replacing existing ones.
+	Put(ctx context.Context, file CacheFile) error
+	Close() error
+}
+
+type BackendPolicy string
+
+const (
+	// BackendFailOpen looks domains up as if they weren't cached when the
+	// backend can't be read. This is the default.
+	BackendFailOpen BackendPolicy = "fail-open"
+	// BackendFailClosed fails lookups with ErrCacheUnavailable instead.
+	BackendFailClosed BackendPolicy = "fail-closed"
+)
+
+// ErrCacheUnavailable is returned by lookups if the backend of the client
+// can't be read and its policy is BackendFailClosed.
+type ErrCacheUnavailable struct {
+	Err error
+}
+
+func (e ErrCacheUnavailable) Error() string {
+	return fmt.Sprintf("cache unavailable: %v", e.Err)
+}
+
+func (e ErrCacheUnavailable) Unwrap() error {
+	return e.Err
+}
+
+func (e ErrCacheUnavailable) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	status := http.StatusServiceUnavailable
+	http.Error(w, e.Error(), status)
+	return true
+}
+
+func (e ErrCacheUnavailable) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+// JSONFileStore keeps all entries in a single json file, which is rewritten
+// as a whole on every Put. It is replaced atomically, so a crash while
+// writing leaves the previous version intact. Not meant to be shared between
+// replicas, so there is no point in using it as the Backend of a Client.
+type JSONFileStore struct {
+	Path string
+	// MaxEntries, if positive, bounds the number of entries kept, usually
+	// to that of the Cache. Beyond it, the oldest entries are dropped.
+	MaxEntries int
+	lock sync.Mutex
+	file CacheFile
+}
+
+func (s *JSONFileStore) Load(ctx context.Context) (CacheFile, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.file = CacheFile{Version: CacheFileVersion, Data: map[string]NodeInfo{}, Age: map[string]time.Time{}, Aliases: map[string]string{}}
+	raw, err := os.ReadFile(s.Path)
+	if err != nil {
+		return s.clone(), err
+	}
+	var contents CacheFile
+	if err := json.Unmarshal(raw, &contents); err != nil || contents.Data == nil {
+		// written by an older version that only stored the data, without
+		// ages, so all of it is loaded as stale
+		var entries map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return s.clone(), err
+		}
+		contents = CacheFile{Data: map[string]NodeInfo{}}
+		for key, entry := range entries {
+			info, err := decodeLegacyEntry(key, entry)
+			if err != nil {
+				return s.clone(), fmt.Errorf("%s: %w", key, err)
+			}
+			contents.Data[key] = info
+		}
+	} else if contents.Version > CacheFileVersion {
+		return s.clone(), fmt.Errorf("file has version %d, but only up to %d is supported", contents.Version, CacheFileVersion)
+	}
+	for key, info := range contents.Data {
+		s.file.Data[key] = info
+		if age, ok := contents.Age[key]; ok {
+			s.file.Age[key] = age
+		}
+	}
+	maps.Copy(s.file.Aliases, contents.Aliases)
+	s.prune()
+	return s.clone(), nil
+}
+
+// decodeLegacyEntry also reads entries written by even older versions, which
+// only stored the software.
+func decodeLegacyEntry(key string, raw json.RawMessage) (info NodeInfo, err error) {
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return info, err
+	}
+	if info.Domain == "" {
+		info = NodeInfo{Domain: key}
+		if err := json.Unmarshal(raw, &info.Software); err != nil {
+			return info, err
+		}
+	}
+	return info, nil
+}
+
+func (s *JSONFileStore) Get(ctx context.Context, key string) (info NodeInfo, age time.Time, found bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	info, found = s.file.Data[key]
+	return info, s.file.Age[key], found, nil
+}
+
+func (s *JSONFileStore) Put(ctx context.Context, file CacheFile) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file.Data == nil {
+		s.file = CacheFile{Version: CacheFileVersion, Data: map[string]NodeInfo{}, Age: map[string]time.Time{}, Aliases: map[string]string{}}
+	}
+	maps.Copy(s.file.Data, file.Data)
+	maps.Copy(s.file.Age, file.Age)
+	for key := range file.Data {
+		delete(s.file.Aliases, key)
+	}
+	maps.Copy(s.file.Aliases, file.Aliases)
+	s.prune()
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if err := json.NewEncoder(tmp).Encode(s.file); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+func (s *JSONFileStore) Close() error {
+	return nil
+}
+
+// prune drops the oldest entries beyond MaxEntries, and the aliases of
+// entries that are gone, it must be called with the lock held.
+func (s *JSONFileStore) prune() {
+	if s.MaxEntries > 0 && len(s.file.Data) > s.MaxEntries {
+		keys := slices.SortedFunc(maps.Keys(s.file.Data), func(a, b string) int {
+			return s.file.Age[a].Compare(s.file.Age[b])
+		})
+		for _, key := range keys[:len(keys)-s.MaxEntries] {
+			delete(s.file.Data, key)
+			delete(s.file.Age, key)
+		}
+	}
+	for alias, key := range s.file.Aliases {
+		if _, ok := s.file.Data[key]; !ok {
+			delete(s.file.Aliases, alias)
+		}
+	}
+}
+
+// clone must be called with the lock held.
+func (s *JSONFileStore) clone() CacheFile {
+	return CacheFile{
+		Version: s.file.Version,
+		Data: maps.Clone(s.file.Data),
+		Age: maps.Clone(s.file.Age),
+		Aliases: maps.Clone(s.file.Aliases),
+	}
+}
+
+// Flush writes the entries that were set since the last flush to store. If
+// that fails, they are kept for the next one.
+func (c *Cache) Flush(ctx context.Context, store CacheStore) error {
+	c.lock.Lock()
+	c.segfaultPrevention()
+	file := CacheFile{Version: CacheFileVersion, Data: map[string]NodeInfo{}, Age: map[string]time.Time{}, Aliases: map[string]string{}}
+	for key := range c.dirty {
+		if info, ok := c.Data[key]; ok {
+			file.Data[key] = info
+			file.Age[key] = c.Age[key]
+		}
+	}
+	for alias, key := range c.aliases {
+		if _, ok := file.Data[key]; ok {
+			file.Aliases[alias] = key
+		}
+	}
+	clear(c.dirty)
+	c.lock.Unlock()
+	if len(file.Data) == 0 {
+		return nil
+	}
+	if err := store.Put(ctx, file); err != nil {
+		c.lock.Lock()
+		for key := range file.Data {
+			c.dirty[key] = true
+		}
+		c.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// FlushEvery flushes the cache to store every interval, until ctx is done.
+func (c *Cache) FlushEvery(ctx context.Context, store CacheStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Flush(ctx, store); err != nil {
+				slog.Error("failed to flush cache", "error", err)
+			}
+		}
+	}
+}
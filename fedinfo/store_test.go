@@ -0,0 +1,141 @@
+package fedinfo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJSONFileStoreVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	age := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name string
+		raw string
+		wantErr bool
+	}{
+		{"current", `{"version": 2, "data": {"example.test": {"domain": "example.test", "software": {"name": "mastodon", "version": "4.3.2"}}}, "age": {"example.test": "2024-01-01T00:00:00Z"}}`, false},
+		{"version 1", `{"data": {"example.test": {"domain": "example.test", "software": {"name": "mastodon", "version": "4.3.2"}}}, "age": {"example.test": "2024-01-01T00:00:00Z"}}`, false},
+		{"newer version", `{"version": 99, "data": {}, "age": {}}`, true},
+		{"garbage", `[`, true},
+	} {
+		if err := os.WriteFile(path, []byte(test.raw), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		contents, err := (&JSONFileStore{Path: path}).Load(context.Background())
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %+v, want an error", test.name, contents)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if info := contents.Data["example.test"]; info.Software != (Software{Name: "mastodon", Version: "4.3.2"}) || !contents.Age["example.test"].Equal(age) {
+			t.Errorf("%s: got %+v of age %s", test.name, info, contents.Age["example.test"])
+		}
+	}
+}
+
+func TestJSONFileStoreLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "software.json")
+	for name, legacy := range map[string]string{
+		"software only": `{"example.test":{"name":"mastodon","version":"4.3.2"}}`,
+		"nodeinfo without ages": `{"example.test":{"domain":"example.test","software":{"name":"mastodon","version":"4.3.2"}}}`,
+	} {
+		if err := os.WriteFile(path, []byte(legacy), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		store := &JSONFileStore{Path: path}
+		contents, err := store.Load(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		info := contents.Data["example.test"]
+		if info.Domain != "example.test" || info.Software != (Software{Name: "mastodon", Version: "4.3.2"}) {
+			t.Errorf("%s: got %+v", name, info)
+		}
+		cache := &Cache{TTL: time.Hour}
+		cache.Load(contents)
+		if _, ok := cache.Get("example.test"); ok {
+			t.Errorf("%s: entry without age is fresh", name)
+		}
+	}
+}
+
+// flakyStore records what is put, failing while down is set.
+type flakyStore struct {
+	JSONFileStore
+	down bool
+	puts []CacheFile
+}
+
+func (s *flakyStore) Put(ctx context.Context, file CacheFile) error {
+	if s.down {
+		return errors.New("connection refused")
+	}
+	s.puts = append(s.puts, file)
+	return nil
+}
+
+func TestCacheFlush(t *testing.T) {
+	store := &flakyStore{}
+	cache := &Cache{TTL: time.Hour}
+	cache.Set("a.example.test", NodeInfo{Domain: "a.example.test"})
+	if err := cache.Flush(context.Background(), store); err != nil || len(store.puts) != 1 || len(store.puts[0].Data) != 1 {
+		t.Fatalf("got %v, puts %+v, want the entry written", err, store.puts)
+	}
+	if err := cache.Flush(context.Background(), store); err != nil || len(store.puts) != 1 {
+		t.Errorf("got %v, %d puts, want nothing written without changes", err, len(store.puts))
+	}
+
+	cache.Set("b.example.test", NodeInfo{Domain: "b.example.test"})
+	store.down = true
+	if err := cache.Flush(context.Background(), store); err == nil {
+		t.Fatal("flush to a store that is down succeeded")
+	}
+	store.down = false
+	cache.Set("c.example.test", NodeInfo{Domain: "c.example.test"})
+	if err := cache.Flush(context.Background(), store); err != nil || len(store.puts) != 2 || len(store.puts[1].Data) != 2 {
+		t.Errorf("got %v, puts %+v, want the failed entry written with the new one", err, store.puts)
+	}
+}
+
+func TestJSONFileStoreMaxEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	store := &JSONFileStore{Path: path, MaxEntries: 3}
+	now := time.Now()
+	for i := range 5 {
+		domain := fmt.Sprintf("%d.example.test", i)
+		file := CacheFile{
+			Data: map[string]NodeInfo{domain: {Domain: domain}},
+			Age: map[string]time.Time{domain: now.Add(time.Duration(i)*time.Minute)},
+		}
+		if err := store.Put(context.Background(), file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopened := &JSONFileStore{Path: path}
+	contents, err := reopened.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents.Data) != 3 {
+		t.Fatalf("got %d entries, want 3", len(contents.Data))
+	}
+	for _, domain := range []string{"2.example.test", "3.example.test", "4.example.test"} {
+		if _, ok := contents.Data[domain]; !ok {
+			t.Errorf("newest entry %s was dropped", domain)
+		}
+	}
+
+	bounded := &JSONFileStore{Path: path, MaxEntries: 2}
+	if contents, err := bounded.Load(context.Background()); err != nil || len(contents.Data) != 2 {
+		t.Errorf("got %d entries, %v, want 2", len(contents.Data), err)
+	}
+}
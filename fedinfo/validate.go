@@ -0,0 +1,163 @@
+package fedinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+var (
+	nodeInfoProtocols = []string{"activitypub", "buddycloud", "dfrn", "diaspora", "libertree", "ostatus", "pumpio", "tent", "xmpp", "zot"}
+	nodeInfoInboundServices = []string{"atom1.0", "gnusocial", "imap", "pnut", "pop3", "pumpio", "rss2.0", "twitter"}
+	nodeInfoOutboundServices = []string{"atom1.0", "blogger", "buddycloud", "diaspora", "dreamwidth", "drupal", "facebook", "friendica", "gnusocial", "google", "insanejournal", "libertree", "linkedin", "livejournal", "mediagoblin", "myspace", "pinterest", "pnut", "posterous", "pumpio", "redmatrix", "rss2.0", "smtp", "tent", "tumblr", "twitter", "wordpress", "xmpp"}
+	nodeInfoSoftwareName = regexp.MustCompile(`^[a-z0-9-]+$`)
+)
+
+// validateNodeInfo checks a raw nodeinfo document against the 2.0 or 2.1
+// schema (picked by its version field) and returns every violation found.
+func validateNodeInfo(raw json.RawMessage) (violations []string) {
+	var doc map[string]any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return []string{fmt.Sprintf("document is not a json object: %v", err)}
+	}
+	v := &schemaValidator{}
+	version, _ := doc["version"].(string)
+	switch version {
+	case "2.0", "2.1":
+	default:
+		v.fail("version: must be 2.0 or 2.1, got %v", doc["version"])
+	}
+	v.onlyKeys("", doc, "version", "software", "protocols", "services", "openRegistrations", "usage", "metadata")
+
+	if software, ok := v.object("software", doc["software"]); ok {
+		softwareKeys := []string{"name", "version"}
+		if version == "2.1" {
+			softwareKeys = append(softwareKeys, "repository", "homepage")
+			v.optionalString("software.repository", software["repository"])
+			v.optionalString("software.homepage", software["homepage"])
+		}
+		v.onlyKeys("software.", software, softwareKeys...)
+		if name, ok := v.string("software.name", software["name"]); ok && !nodeInfoSoftwareName.MatchString(name) {
+			v.fail("software.name: must match %s, got %q", nodeInfoSoftwareName, name)
+		}
+		v.string("software.version", software["version"])
+	}
+
+	if protocols, ok := v.enumArray("protocols", doc["protocols"], nodeInfoProtocols); ok && len(protocols) == 0 {
+		v.fail("protocols: must contain at least one protocol")
+	}
+
+	if services, ok := v.object("services", doc["services"]); ok {
+		v.onlyKeys("services.", services, "inbound", "outbound")
+		v.enumArray("services.inbound", services["inbound"], nodeInfoInboundServices)
+		v.enumArray("services.outbound", services["outbound"], nodeInfoOutboundServices)
+	}
+
+	if _, ok := doc["openRegistrations"].(bool); !ok {
+		v.fail("openRegistrations: must be a boolean, got %s", jsonType(doc["openRegistrations"]))
+	}
+
+	if usage, ok := v.object("usage", doc["usage"]); ok {
+		v.onlyKeys("usage.", usage, "users", "localPosts", "localComments")
+		if users, ok := v.object("usage.users", usage["users"]); ok {
+			v.onlyKeys("usage.users.", users, "total", "activeHalfyear", "activeMonth")
+			v.optionalCount("usage.users.total", users["total"])
+			v.optionalCount("usage.users.activeHalfyear", users["activeHalfyear"])
+			v.optionalCount("usage.users.activeMonth", users["activeMonth"])
+		}
+		v.optionalCount("usage.localPosts", usage["localPosts"])
+		v.optionalCount("usage.localComments", usage["localComments"])
+	}
+
+	v.object("metadata", doc["metadata"])
+	return v.violations
+}
+
+type schemaValidator struct {
+	violations []string
+}
+
+func (v *schemaValidator) fail(format string, args ...any) {
+	v.violations = append(v.violations, fmt.Sprintf(format, args...))
+}
+
+func (v *schemaValidator) onlyKeys(prefix string, obj map[string]any, allowed ...string) {
+	var unknown []string
+	for key := range obj {
+		if !slices.Contains(allowed, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		v.fail("%s%s: unknown property", prefix, key)
+	}
+}
+
+func (v *schemaValidator) object(path string, value any) (map[string]any, bool) {
+	obj, ok := value.(map[string]any)
+	if !ok {
+		v.fail("%s: must be an object, got %s", path, jsonType(value))
+	}
+	return obj, ok
+}
+
+func (v *schemaValidator) string(path string, value any) (string, bool) {
+	s, ok := value.(string)
+	if !ok {
+		v.fail("%s: must be a string, got %s", path, jsonType(value))
+	}
+	return s, ok
+}
+
+func (v *schemaValidator) optionalString(path string, value any) {
+	if value != nil {
+		v.string(path, value)
+	}
+}
+
+func (v *schemaValidator) optionalCount(path string, value any) {
+	if value == nil {
+		return
+	}
+	n, ok := value.(float64)
+	if !ok || n < 0 || n != math.Trunc(n) {
+		v.fail("%s: must be a non-negative integer, got %v", path, value)
+	}
+}
+
+func (v *schemaValidator) enumArray(path string, value any, allowed []string) ([]any, bool) {
+	values, ok := value.([]any)
+	if !ok {
+		v.fail("%s: must be an array, got %s", path, jsonType(value))
+		return nil, false
+	}
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok || !slices.Contains(allowed, s) {
+			v.fail("%s[%d]: unsupported value %v", path, i, value)
+		}
+	}
+	return values, true
+}
+
+func jsonType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null or missing"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
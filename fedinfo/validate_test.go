@@ -0,0 +1,62 @@
+package fedinfo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStrictRequiresNodeInfo(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"example.test/.well-known/nodeinfo": `{"links":[]}`,
+		"example.test/api/v1/instance": `{"version":"4.3.2"}`,
+	})
+	if info, err := c.Resolve(context.Background(), "example.test", false); err != nil || info.Software.Name != "mastodon" {
+		t.Fatalf("lenient lookup: got %+v, %v, want the fallback result", info, err)
+	}
+	_, err := c.Resolve(context.Background(), "example.test", true)
+	if !errors.As(err, new(ErrUpstreamInvalid)) {
+		t.Fatalf("strict lookup: got error %v, want ErrUpstreamInvalid", err)
+	}
+}
+
+func TestStrictReportsViolations(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": `{"version":"2.0","software":{"name":"Mastodon","version":4},"protocols":[],"extra":true}`,
+	})
+	_, err := c.Resolve(context.Background(), "example.test", true)
+	var invalid ErrUpstreamInvalid
+	if !errors.As(err, &invalid) {
+		t.Fatalf("got error %v, want ErrUpstreamInvalid", err)
+	}
+	// name pattern, version type, empty protocols, extra key, missing
+	// services, openRegistrations, usage and metadata
+	if len(invalid.Violations) < 5 {
+		t.Errorf("got violations %q, want at least 5", invalid.Violations)
+	}
+	if violations := validateNodeInfo([]byte(mastodonNodeInfo)); len(violations) > 0 {
+		t.Errorf("valid document: got violations %q", violations)
+	}
+}
+
+func TestLookupStrictReusesResult(t *testing.T) {
+	counter := &hitCounter{next: fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+	}}
+	c := newTestClient(t, counter)
+	for range 3 {
+		info, err := c.LookupStrict(context.Background(), "example.test", time.Minute)
+		if err != nil || info.Software.Name != "mastodon" {
+			t.Fatalf("got %+v, %v", info, err)
+		}
+	}
+	if hits := counter.count("example.test/.well-known/nodeinfo"); hits != 1 {
+		t.Errorf("got %d requests, want 1", hits)
+	}
+	if _, ok := c.Cache.GetMaxAge("example.test", 0); !ok {
+		t.Errorf("result of strict check wasn't cached")
+	}
+}
@@ -0,0 +1,229 @@
+package fedinfo
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	JRD struct {
+		Subject string `json:"subject"`
+		Aliases []string `json:"aliases"`
+		Links []JRDLink `json:"links"`
+	}
+	JRDLink struct {
+		Rel string `json:"rel"`
+		Type string `json:"type"`
+		Href string `json:"href"`
+	}
+)
+
+// ErrAccountNotFound is returned by WebFinger if the instance doesn't know
+// the resource.
+type ErrAccountNotFound struct {
+	Resource string
+}
+
+func (e ErrAccountNotFound) Error() string {
+	return fmt.Sprintf("account not found: %s", e.Resource)
+}
+
+func (e ErrAccountNotFound) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	status := http.StatusNotFound
+	http.Error(w, e.Error(), status)
+	return true
+}
+
+func (e ErrAccountNotFound) StatusCode() int {
+	return http.StatusNotFound
+}
+
+// WebFinger looks up resource, e.g. acct:alice@example.social, on domain. If
+// domain doesn't answer webfinger requests itself, the lrdd template of its
+// host-meta is followed, through which it may delegate them to another host.
+func (c *Client) WebFinger(ctx context.Context, domain, resource string) (jrd JRD, err error) {
+	wellKnown := fmt.Sprintf("https://%s/.well-known/webfinger?resource=%s", domain, url.QueryEscape(resource))
+	jrd, answered, err := c.fetchJRD(ctx, wellKnown, resource)
+	if err == nil || !answered {
+		return jrd, err
+	}
+	lrdd, hmErr := c.hostMetaLRDD(ctx, domain)
+	if hmErr != nil || !strings.Contains(lrdd, "{uri}") {
+		// most instances don't have a host-meta, the original error is
+		// more telling
+		return jrd, err
+	}
+	delegated := strings.ReplaceAll(lrdd, "{uri}", url.QueryEscape(resource))
+	if delegated == wellKnown {
+		return jrd, err
+	}
+	jrd, _, err = c.fetchJRD(ctx, delegated, resource)
+	return jrd, err
+}
+
+// fetchJRD also reports whether the server answered at all, even if not
+// with a JRD.
+func (c *Client) fetchJRD(ctx context.Context, url, resource string) (jrd JRD, answered bool, err error) {
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return jrd, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return jrd, true, ErrAccountNotFound{Resource: resource}
+	default:
+		return jrd, true, fmt.Errorf("%s: unexpected status: %s", resp.Request.URL, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jrd); err != nil {
+		return jrd, true, err
+	}
+	return jrd, true, nil
+}
+
+// ActorID returns the id of the ActivityPub actor the JRD links to, if any.
+func (jrd JRD) ActorID() string {
+	for _, link := range jrd.Links {
+		if link.Rel != "self" {
+			continue
+		}
+		switch link.Type {
+		case "application/activity+json", `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`:
+			return link.Href
+		}
+	}
+	return ""
+}
+
+// ProfileURL returns the url of the human readable profile page the JRD
+// links to, if any.
+func (jrd JRD) ProfileURL() string {
+	for _, link := range jrd.Links {
+		if link.Rel == "http://webfinger.net/rel/profile-page" {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+// Account is what LookupAccount found out about a resource.
+type Account struct {
+	// Subject is the canonical name of the account, which may differ from
+	// the resource that was looked up, e.g. if the domain delegates to
+	// another host.
+	Subject string `json:"subject"`
+	ActorID string `json:"actorId,omitempty"`
+	ProfileURL string `json:"profileUrl,omitempty"`
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// AccountCache caches the results of LookupAccount, failures included. Like
+// Cache, entries expire after a TTL randomized by Jitter, and MaxEntries
+// bounds their number by evicting the least recently used.
+type AccountCache struct {
+	TTL time.Duration
+	Jitter float64
+	MaxEntries int
+	lock sync.Mutex
+	lru *list.List // of *accountEntry, most recently used at the front
+	entries map[string]*list.Element
+}
+
+type accountEntry struct {
+	resource string
+	account Account
+	err error
+	expires time.Time
+}
+
+const DefaultMaxAccounts = 10_000
+
+func (c *AccountCache) get(resource string) (account Account, err error, found bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[resource]
+	if !ok {
+		return account, nil, false
+	}
+	entry := elem.Value.(*accountEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, resource)
+		return account, nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.account, entry.err, true
+}
+
+// set caches account, or err if it isn't nil, for ttl. If ttl is zero, the
+// TTL of the cache is used.
+func (c *AccountCache) set(resource string, account Account, err error, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = jitterTTL(c.TTL, c.Jitter)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.lru = list.New()
+		c.entries = map[string]*list.Element{}
+	}
+	entry := &accountEntry{resource: resource, account: account, err: err, expires: time.Now().Add(ttl)}
+	if elem, ok := c.entries[resource]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[resource] = c.lru.PushFront(entry)
+	for c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*accountEntry).resource)
+	}
+}
+
+// LookupAccount looks resource up on domain via WebFinger, from the cache if
+// possible. Failed lookups are cached for NegativeTTL, like those of Lookup.
+// Concurrent lookups of the same resource share a single request.
+func (c *Client) LookupAccount(ctx context.Context, domain, resource string) (Account, error) {
+	c.setDefaults()
+	if account, err, ok := c.Accounts.get(resource); ok {
+		return account, err
+	}
+	res := c.accountLookups.DoChan(resource, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.maxDuration())
+		defer cancel()
+		var account Account
+		jrd, err := c.WebFinger(ctx, domain, resource)
+		if err != nil {
+			if ttl := c.negativeTTL(); ttl > 0 {
+				c.Accounts.set(resource, account, err, ttl)
+			}
+			return account, err
+		}
+		account = Account{
+			Subject: jrd.Subject,
+			ActorID: jrd.ActorID(),
+			ProfileURL: jrd.ProfileURL(),
+			Aliases: jrd.Aliases,
+		}
+		if account.Subject == "" {
+			account.Subject = resource
+		}
+		c.Accounts.set(resource, account, nil, 0)
+		return account, nil
+	})
+	select {
+	case <-ctx.Done():
+		return Account{}, ctx.Err()
+	case res := <-res:
+		return res.Val.(Account), res.Err
+	}
+}
@@ -0,0 +1,128 @@
+package fedinfo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const aliceJRD = `{
+	"subject": "acct:alice@example.test",
+	"aliases": ["https://example.test/@alice"],
+	"links": [
+		{"rel": "http://webfinger.net/rel/profile-page", "type": "text/html", "href": "https://example.test/@alice"},
+		{"rel": "self", "type": "application/activity+json", "href": "https://example.test/users/alice"}
+	]
+}`
+
+func TestWebFinger(t *testing.T) {
+	c := newTestClient(t, fixtures{
+		"example.test/.well-known/webfinger": aliceJRD,
+		"delegating.test/.well-known/host-meta": `<?xml version="1.0" encoding="UTF-8"?>
+<XRD xmlns="http://docs.oasis-open.org/ns/xri/xrd-1.0">
+	<Link rel="lrdd" template="https://example.test/.well-known/webfinger?resource={uri}"/>
+</XRD>`,
+	})
+	for _, domain := range []string{"example.test", "delegating.test"} {
+		jrd, err := c.WebFinger(context.Background(), domain, "acct:alice@"+domain)
+		if err != nil {
+			t.Fatalf("%s: %v", domain, err)
+		}
+		if jrd.Subject != "acct:alice@example.test" || jrd.ActorID() != "https://example.test/users/alice" || jrd.ProfileURL() != "https://example.test/@alice" {
+			t.Errorf("%s: got %+v", domain, jrd)
+		}
+	}
+	if _, err := c.WebFinger(context.Background(), "missing.test", "acct:bob@missing.test"); !errors.As(err, new(ErrAccountNotFound)) {
+		t.Errorf("without webfinger: got %v, want ErrAccountNotFound", err)
+	}
+}
+
+func TestWebFingerHostMetaTemplate(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		lrdd string
+		delegated bool
+	}{
+		{"https", "https://example.test/.well-known/webfinger?resource={uri}", true},
+		{"http", "http://example.test/.well-known/webfinger?resource={uri}", false},
+		{"localhost", "https://localhost/.well-known/webfinger?resource={uri}", false},
+		{"private address", "https://10.0.0.1/.well-known/webfinger?resource={uri}", false},
+		{"without placeholder", "https://example.test/.well-known/webfinger", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			counter := &hitCounter{next: fixtures{
+				"example.test/.well-known/webfinger": aliceJRD,
+				"localhost/.well-known/webfinger": aliceJRD,
+				"10.0.0.1/.well-known/webfinger": aliceJRD,
+				"delegating.test/.well-known/host-meta": hostMetaXRD(test.lrdd),
+			}}
+			c := newTestClient(t, counter)
+			jrd, err := c.WebFinger(context.Background(), "delegating.test", "acct:alice@delegating.test")
+			if test.delegated {
+				if err != nil || jrd.Subject != "acct:alice@example.test" {
+					t.Errorf("got %+v, %v, want alice's jrd", jrd, err)
+				}
+				return
+			}
+			if !errors.As(err, new(ErrAccountNotFound)) {
+				t.Errorf("got %v, want ErrAccountNotFound", err)
+			}
+			hits := counter.count("example.test/.well-known/webfinger") + counter.count("localhost/.well-known/webfinger") + counter.count("10.0.0.1/.well-known/webfinger")
+			if hits != 0 {
+				t.Errorf("the lrdd template was followed %d times", hits)
+			}
+		})
+	}
+}
+
+func TestLookupAccount(t *testing.T) {
+	counter := &hitCounter{next: fixtures{
+		"example.test/.well-known/webfinger": aliceJRD,
+	}}
+	c := newTestClient(t, counter)
+	c.Accounts = &AccountCache{TTL: time.Hour, MaxEntries: 10}
+	for range 2 {
+		account, err := c.LookupAccount(context.Background(), "example.test", "acct:alice@example.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Account{Subject: "acct:alice@example.test", ActorID: "https://example.test/users/alice", ProfileURL: "https://example.test/@alice"}
+		if account.Subject != want.Subject || account.ActorID != want.ActorID || account.ProfileURL != want.ProfileURL || len(account.Aliases) != 1 {
+			t.Errorf("got %+v, want %+v", account, want)
+		}
+	}
+	if hits := counter.count("example.test/.well-known/webfinger"); hits != 1 {
+		t.Errorf("got %d requests, want 1", hits)
+	}
+
+	for range 2 {
+		if _, err := c.LookupAccount(context.Background(), "missing.test", "acct:bob@missing.test"); !errors.As(err, new(ErrAccountNotFound)) {
+			t.Errorf("got %v, want ErrAccountNotFound", err)
+		}
+	}
+	if hits := counter.count("missing.test/.well-known/webfinger"); hits != 1 {
+		t.Errorf("failure: got %d requests, want 1", hits)
+	}
+}
+
+func TestAccountCacheBounded(t *testing.T) {
+	c := &AccountCache{TTL: time.Hour, MaxEntries: 2}
+	c.set("acct:a@example.test", Account{Subject: "acct:a@example.test"}, nil, 0)
+	c.set("acct:b@example.test", Account{Subject: "acct:b@example.test"}, nil, 0)
+	c.get("acct:a@example.test") // keep it recently used
+	c.set("acct:c@example.test", Account{Subject: "acct:c@example.test"}, nil, 0)
+	for resource, want := range map[string]bool{
+		"acct:a@example.test": true,
+		"acct:b@example.test": false,
+		"acct:c@example.test": true,
+	} {
+		if _, _, found := c.get(resource); found != want {
+			t.Errorf("%s: got cached %v, want %v", resource, found, want)
+		}
+	}
+	c.set("acct:d@example.test", Account{}, nil, -time.Second)
+	if _, _, found := c.get("acct:d@example.test"); found {
+		t.Error("expired entry is still cached")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+func TestNodeInfoLanguagesOptIn(t *testing.T) {
+	cache.Set("languages.example.social", fedinfo.NodeInfo{Domain: "languages.example.social", Languages: []string{"en", "de-ch"}})
+	for query, want := range map[string][]string{
+		"": nil,
+		"&languages=true": {"en", "de-ch"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/node-info?domain=languages.example.social"+query, nil)
+		w := httptest.NewRecorder()
+		HandlerWithError(nodeInfoRoute).ServeHTTP(w, r)
+		var info fedinfo.NodeInfo
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+		if !slices.Equal(info.Languages, want) {
+			t.Errorf("%q: got %q, want %q", query, info.Languages, want)
+		}
+	}
+}
+
+// hasKey reports whether key appears anywhere in the decoded json v.
+func hasKey(v any, key string) bool {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, value := range v {
+			if k == key || hasKey(value, key) {
+				return true
+			}
+		}
+	case []any:
+		for _, value := range v {
+			if hasKey(value, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestOptionalFieldsOnAllRoutes(t *testing.T) {
+	useTestServer(t, fixtures{})
+	originalCrawler := crawler
+	t.Cleanup(func() { crawler = originalCrawler })
+	crawler = &Crawler{Revisit: time.Hour, instances: map[string]bool{"example.social": true}}
+	since := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	peers := 42
+	cache.Set("example.social", fedinfo.NodeInfo{
+		Domain: "example.social",
+		Software: fedinfo.Software{Name: "mastodon", Version: "4.3.2"},
+		Languages: []string{"en"},
+		InstanceSince: &since,
+		PeerCount: &peers,
+	})
+	for _, route := range []struct {
+		method, target string
+		handler HandlerWithError
+	}{
+		{http.MethodGet, "/node-info?domain=example.social", nodeInfoRoute},
+		{http.MethodPost, "/node-info/batch", batchRoute},
+		{http.MethodGet, "/object?url=https://example.social/users/alice", objectRoute},
+		{http.MethodGet, "/resolve?handle=alice@example.social", resolveRoute},
+		{http.MethodGet, "/domains", domainsRoute},
+		{http.MethodGet, "/instances", instancesRoute},
+	} {
+		for _, optIn := range []bool{false, true} {
+			target := route.target
+			if optIn {
+				separator := "?"
+				if strings.Contains(target, "?") {
+					separator = "&"
+				}
+				target += separator + "languages=true&since=true&peers_count=true"
+			}
+			r := httptest.NewRequest(route.method, target, strings.NewReader(`{"domains": ["example.social"]}`))
+			w := httptest.NewRecorder()
+			route.handler.ServeHTTP(w, r)
+			var response any
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("%s %s: %v", route.method, target, err)
+			}
+			for _, key := range []string{"languages", "instanceSince", "peerCount"} {
+				if hasKey(response, key) != optIn {
+					t.Errorf("%s %s: got %s: %t, want %t", route.method, target, key, !optIn, optIn)
+				}
+			}
+		}
+	}
+}
+
+func TestDisplayVersion(t *testing.T) {
+	for _, test := range []struct {
+		version, want string
+	}{
+		{"4.3.2", "4.3.2"},
+		{"4.3.0+glitch.abc123", "4.3.0"},
+		{"4.2.10+hometown-1.1.1", "4.2.10"},
+		{"2024.5.0-unstable-a1b2c3", "2024.5.0"},
+		{"2.6.50-develop", "2.6.50-develop"},
+		{"0.19.4-nightly-2024-05-01", "0.19.4"},
+		{"1.2.0-dev", "1.2.0"},
+		{"3.0.0-SNAPSHOT", "3.0.0"},
+		{"0.16.0-1a2b3c4d", "0.16.0"},
+		{"1.0.0-g1a2b3c4", "1.0.0"},
+		{"2024.11.0-beta.3", "2024.11.0-beta.3"},
+		{"2.7.0 (compatible; Pleroma 2.7.0)", "2.7.0 (compatible; Pleroma 2.7.0)"},
+		{"", ""},
+	} {
+		if got := displayVersion(test.version); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.version, got, test.want)
+		}
+	}
+}
+
+func TestParseDomainParamPolicy(t *testing.T) {
+	defer func(policy DomainInputPolicy) { domainInputPolicy = policy }(domainInputPolicy)
+	const param = "https://Example.Social/about?lang=en#rules"
+	for _, test := range []struct {
+		policy DomainInputPolicy
+		wantErr, wantWarning bool
+	}{
+		{DomainInputReject, true, false},
+		{DomainInputStripAndWarn, false, true},
+		{DomainInputStripSilent, false, false},
+	} {
+		domainInputPolicy = test.policy
+		domain, warning, err := parseDomainParam(param)
+		if (err != nil) != test.wantErr || (warning != "") != test.wantWarning {
+			t.Errorf("%s: got %q, %v, want error: %t, warning: %t", test.policy, warning, err, test.wantErr, test.wantWarning)
+		}
+		if !test.wantErr && domain != "example.social" {
+			t.Errorf("%s: got domain %s, want example.social", test.policy, domain)
+		}
+		// a bare domain is fine under every policy
+		if domain, warning, err := parseDomainParam("example.social/"); err != nil || warning != "" || domain != "example.social" {
+			t.Errorf("%s: got %s, %q, %v for a bare domain", test.policy, domain, warning, err)
+		}
+	}
+}
+
+func TestParseDomainParam(t *testing.T) {
+	for _, test := range []struct {
+		param, want string
+	}{
+		{"example.social", "example.social"},
+		{"Example.SOCIAL", "example.social"},
+		{"https://Example.Social", "example.social"},
+		{"http://example.social/", "example.social"},
+		{"bücher.example", "bücher.example"},
+		{"localhost", ""},
+		{"127.0.0.1", ""},
+		{"[::1]", ""},
+		{"169.254.169.254", ""},
+		{"example.social:8080", ""},
+		{"user:pass@example.social", ""},
+		{"ftp://example.social", ""},
+		{"", ""},
+	} {
+		domain, _, err := parseDomainParam(test.param)
+		if test.want == "" && err == nil {
+			t.Errorf("%q: got %s, want an error", test.param, domain)
+		}
+		if test.want != "" && (err != nil || domain != test.want) {
+			t.Errorf("%q: got %q, %v, want %s", test.param, domain, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+type HistoryEntry struct {
+	At time.Time `json:"at"`
+	Latency string `json:"latency"`
+	Software *fedinfo.Software `json:"software,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// History keeps the outcomes of the most recent lookups per domain. Both the
+// number of entries per domain (Depth) and the number of domains
+// (MaxDomains) are bounded; the least recently looked up domain is evicted
+// first.
+type History struct {
+	Depth int
+	MaxDomains int
+	lock sync.Mutex
+	lru *list.List // of *domainHistory, most recent at the front
+	domains map[string]*list.Element
+}
+
+type domainHistory struct {
+	domain string
+	entries []HistoryEntry // ring buffer
+	next int
+}
+
+var history = &History{Depth: 5, MaxDomains: 1000}
+
+func (h *History) Record(domain string, entry HistoryEntry) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.domains == nil {
+		h.lru = list.New()
+		h.domains = map[string]*list.Element{}
+	}
+	elem, ok := h.domains[domain]
+	if ok {
+		h.lru.MoveToFront(elem)
+	} else {
+		elem = h.lru.PushFront(&domainHistory{domain: domain})
+		h.domains[domain] = elem
+		for h.lru.Len() > h.MaxDomains {
+			oldest := h.lru.Back()
+			h.lru.Remove(oldest)
+			delete(h.domains, oldest.Value.(*domainHistory).domain)
+		}
+	}
+	dh := elem.Value.(*domainHistory)
+	if len(dh.entries) < h.Depth {
+		dh.entries = append(dh.entries, entry)
+	} else {
+		dh.entries[dh.next] = entry
+	}
+	dh.next = (dh.next + 1) % h.Depth
+}
+
+// Get returns the recorded lookups of domain, most recent first.
+func (h *History) Get(domain string) []HistoryEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	elem, ok := h.domains[domain]
+	if !ok {
+		return []HistoryEntry{}
+	}
+	dh := elem.Value.(*domainHistory)
+	entries := make([]HistoryEntry, 0, len(dh.entries))
+	for i := 1; i <= len(dh.entries); i++ {
+		entries = append(entries, dh.entries[(dh.next-i+len(dh.entries))%len(dh.entries)])
+	}
+	return entries
+}
+
+// recordHistory is the OnResolve hook of the client, it records the outcome
+// of every uncached lookup.
+func recordHistory(domain string, start time.Time, info fedinfo.NodeInfo, err error) {
+	entry := HistoryEntry{
+		At: start,
+		Latency: time.Since(start).String(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		sfw := info.Software
+		entry.Software = &sfw
+	}
+	history.Record(domain, entry)
+}
+
+func historyRoute(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	domain := r.Form.Get("domain")
+	if domain == "" {
+		return ErrMissingParam("domain")
+	}
+	domain, _, err := parseDomainParam(domain)
+	if err != nil {
+		return err
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history.Get(domain)); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHistoryDepth(t *testing.T) {
+	h := &History{Depth: 3, MaxDomains: 10}
+	for i := range 2 {
+		h.Record("example.social", HistoryEntry{Latency: fmt.Sprint(i)})
+	}
+	if got := latencies(h.Get("example.social")); got != "[1 0]" {
+		t.Errorf("before wrapping: got %s, want [1 0]", got)
+	}
+	for i := 2; i < 7; i++ {
+		h.Record("example.social", HistoryEntry{Latency: fmt.Sprint(i)})
+	}
+	if got := latencies(h.Get("example.social")); got != "[6 5 4]" {
+		t.Errorf("after wrapping: got %s, want the 3 most recent, [6 5 4]", got)
+	}
+	if got := h.Get("unknown.social"); got == nil || len(got) != 0 {
+		t.Errorf("unknown domain: got %v, want an empty list", got)
+	}
+}
+
+func TestHistoryEvictsOldestDomain(t *testing.T) {
+	h := &History{Depth: 2, MaxDomains: 2}
+	h.Record("a.social", HistoryEntry{Latency: "a"})
+	h.Record("b.social", HistoryEntry{Latency: "b"})
+	// looking a.social up again makes b.social the least recent
+	h.Record("a.social", HistoryEntry{Latency: "a2"})
+	h.Record("c.social", HistoryEntry{Latency: "c"})
+	if got := h.Get("b.social"); len(got) != 0 {
+		t.Errorf("got %v for the oldest domain, want it evicted", got)
+	}
+	if got := latencies(h.Get("a.social")); got != "[a2 a]" {
+		t.Errorf("a.social: got %s, want [a2 a]", got)
+	}
+	if got := latencies(h.Get("c.social")); got != "[c]" {
+		t.Errorf("c.social: got %s, want [c]", got)
+	}
+	if len(h.domains) != 2 || h.lru.Len() != 2 {
+		t.Errorf("got %d domains, %d in the lru list, want 2", len(h.domains), h.lru.Len())
+	}
+}
+
+func latencies(entries []HistoryEntry) string {
+	var latencies []string
+	for _, entry := range entries {
+		latencies = append(latencies, entry.Latency)
+	}
+	return fmt.Sprint(latencies)
+}
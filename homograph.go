@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+// Homograph detection is modeled on Unicode Technical Standard #39 (Unicode
+// Security Mechanisms). Each label of the (punycode-decoded) domain must
+// satisfy a simplified "Highly Restrictive" restriction level of UTS-39
+// section 5.2: all characters, ignoring the Common and Inherited scripts,
+// belong to a single script, or to one of the CJK combinations
+// Latin+Han+Hiragana+Katakana, Latin+Han+Bopomofo, or Latin+Han+Hangul.
+//
+// In addition, labels written entirely in Cyrillic or Greek are flagged if
+// they only use the letters in latinLookalikes. This is not the full
+// whole-script confusable check of UTS-39 section 4, other confusables go
+// undetected.
+
+var homographScripts = map[string]*unicode.RangeTable{
+	"Latin": unicode.Latin,
+	"Greek": unicode.Greek,
+	"Cyrillic": unicode.Cyrillic,
+	"Armenian": unicode.Armenian,
+	"Hebrew": unicode.Hebrew,
+	"Arabic": unicode.Arabic,
+	"Han": unicode.Han,
+	"Hiragana": unicode.Hiragana,
+	"Katakana": unicode.Katakana,
+	"Bopomofo": unicode.Bopomofo,
+	"Hangul": unicode.Hangul,
+	"Cherokee": unicode.Cherokee,
+	"Georgian": unicode.Georgian,
+	"Thai": unicode.Thai,
+	"Devanagari": unicode.Devanagari,
+}
+
+var allowedScriptMixes = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+// latinLookalikes are lowercase Cyrillic and Greek letters that render
+// (nearly) identical to a lowercase Latin letter.
+var latinLookalikes = "аеорсухіјѕԁԛԝһӏ" + // Cyrillic
+	"οαρνϲκ" // Greek
+
+// detectHomograph returns a description of why domain looks like a possible
+// homograph attack, or an empty string.
+func detectHomograph(domain string) string {
+	unicodeDomain, err := idna.ToUnicode(domain)
+	if err != nil {
+		return fmt.Sprintf("%s: not a valid internationalized domain: %v", domain, err)
+	}
+	for _, label := range strings.Split(unicodeDomain, ".") {
+		scripts := labelScripts(label)
+		if len(scripts) > 1 && !isAllowedScriptMix(scripts) {
+			return fmt.Sprintf("%s: label %q mixes scripts %s", domain, label, strings.Join(scripts, ", "))
+		}
+		if len(scripts) == 1 && (scripts[0] == "Cyrillic" || scripts[0] == "Greek") && onlyLatinLookalikes(label) {
+			return fmt.Sprintf("%s: label %q only uses %s letters that look like Latin ones", domain, label, scripts[0])
+		}
+	}
+	return ""
+}
+
+func labelScripts(label string) (scripts []string) {
+	seen := map[string]bool{}
+	for _, c := range label {
+		if unicode.Is(unicode.Common, c) || unicode.Is(unicode.Inherited, c) {
+			continue
+		}
+		script := "Other"
+		for name, table := range homographScripts {
+			if unicode.Is(table, c) {
+				script = name
+				break
+			}
+		}
+		if !seen[script] {
+			seen[script] = true
+			scripts = append(scripts, script)
+		}
+	}
+	return scripts
+}
+
+func isAllowedScriptMix(scripts []string) bool {
+	for _, mix := range allowedScriptMixes {
+		allowed := true
+		for _, script := range scripts {
+			if !slices.Contains(mix, script) {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func onlyLatinLookalikes(label string) bool {
+	for _, c := range strings.ToLower(label) {
+		if unicode.Is(unicode.Common, c) || unicode.Is(unicode.Inherited, c) {
+			continue
+		}
+		if !strings.ContainsRune(latinLookalikes, c) {
+			return false
+		}
+	}
+	return true
+}
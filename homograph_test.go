@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectHomograph(t *testing.T) {
+	for _, test := range []struct {
+		domain string
+		want string // substring of the warning, or "" for none
+	}{
+		{"example.com", ""},
+		{"пример.рф", ""}, // Cyrillic, but not only lookalikes
+		{"日本語.jp", ""},
+		{"ラーメンshop.jp", ""}, // Latin+Katakana is an allowed mix
+		{"한국abc.kr", ""}, // so is Latin+Hangul
+		{"pаypal.com", "mixes scripts Latin, Cyrillic"},
+		{"αpple.com", "mixes scripts"},
+		{"ラーメン한국.jp", "mixes scripts"},
+		{"аррӏе.com", "only uses Cyrillic letters that look like Latin ones"},
+		{"xn--80ak6aa92e.com", "only uses Cyrillic letters"}, // аррӏе, punycode-encoded
+		{"АРРЕ.com", "only uses Cyrillic letters"},
+		{"ροκ.example", "only uses Greek letters"},
+		{"xn--zz.com", "not a valid internationalized domain"},
+	} {
+		got := detectHomograph(test.domain)
+		if test.want == "" && got != "" || !strings.Contains(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.domain, got, test.want)
+		}
+	}
+}
+
+func TestLatinLookalikesUnique(t *testing.T) {
+	seen := map[rune]bool{}
+	for _, c := range latinLookalikes {
+		if seen[c] {
+			t.Errorf("%q is listed more than once", c)
+		}
+		seen[c] = true
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+// maxMarketShareEntries bounds the number of software listed, everything
+// beyond the largest ones is summed up as "other".
+const maxMarketShareEntries = 50
+
+const (
+	MarketShareByInstances = "instances"
+	MarketShareByUsers = "users"
+)
+
+type (
+	MarketShare struct {
+		Software string `json:"software"`
+		Instances int `json:"instances"`
+		Users int `json:"users"`
+		Share float64 `json:"share"`
+	}
+	MarketShareResponse struct {
+		Weight string `json:"weight"`
+		Instances int `json:"instances"`
+		Users int `json:"users"`
+		Software []MarketShare `json:"software"`
+	}
+)
+
+// marketShareRoute computes the share of each software among the cached
+// instances, either by instance count (?weight=instances, the default) or by
+// total users (?weight=users).
+//
+// Instances without a resolved nodeinfo are left out entirely. Instances that
+// don't report a user count still count as an instance, but contribute zero
+// users. Shares are percentages and are all zero if the total is zero.
+func marketShareRoute(w http.ResponseWriter, r *http.Request) error {
+	weight := r.URL.Query().Get("weight")
+	switch weight {
+	case "":
+		weight = MarketShareByInstances
+	case MarketShareByInstances, MarketShareByUsers:
+	default:
+		return ErrBadRequest(fmt.Sprintf("invalid weight, expected %s or %s: %s", MarketShareByInstances, MarketShareByUsers, weight))
+	}
+	response := MarketShareResponse{
+		Weight: weight,
+		Software: []MarketShare{},
+	}
+	bySoftware := map[string]*MarketShare{}
+	cache.Range(func(domain string, info fedinfo.NodeInfo) bool {
+		if !info.Software.IsResolved() {
+			return true
+		}
+		name := strings.ToLower(strings.TrimSpace(info.Software.Name))
+		share, ok := bySoftware[name]
+		if !ok {
+			share = &MarketShare{Software: name}
+			bySoftware[name] = share
+		}
+		users := 0
+		if info.Usage != nil && info.Usage.Users.Total != nil {
+			users = *info.Usage.Users.Total
+		}
+		share.Instances++
+		share.Users += users
+		response.Instances++
+		response.Users += users
+		return true
+	})
+	weighted := func(share MarketShare) int {
+		if weight == MarketShareByUsers {
+			return share.Users
+		}
+		return share.Instances
+	}
+	for _, share := range bySoftware {
+		response.Software = append(response.Software, *share)
+	}
+	slices.SortFunc(response.Software, func(a, b MarketShare) int {
+		if c := weighted(b) - weighted(a); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Software, b.Software)
+	})
+	if len(response.Software) > maxMarketShareEntries {
+		other := MarketShare{Software: "other"}
+		for _, share := range response.Software[maxMarketShareEntries-1:] {
+			other.Instances += share.Instances
+			other.Users += share.Users
+		}
+		response.Software = append(response.Software[:maxMarketShareEntries-1], other)
+	}
+	total := response.Instances
+	if weight == MarketShareByUsers {
+		total = response.Users
+	}
+	if total > 0 {
+		for i := range response.Software {
+			response.Software[i].Share = 100 * float64(weighted(response.Software[i])) / float64(total)
+		}
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return err
+	}
+	return nil
+}
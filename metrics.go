@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metrics = prometheus.NewRegistry()
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fedinfo_http_requests_total",
+		Help: "Requests served, by route and status.",
+	}, []string{"route", "status"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "fedinfo_http_request_duration_seconds",
+		Help: "Time taken to serve requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fedinfo_cache_lookups_total",
+		Help: "Lookups by how they were served: hit, backend, stale, negative or miss.",
+	}, []string{"result"})
+	lookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "fedinfo_lookup_duration_seconds",
+		Help: "Time taken by uncached lookups, by outcome: resolved, unresolved or the class of the error.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"outcome"})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "fedinfo_upstream_request_duration_seconds",
+		Help: "Time taken by requests to instances, by outcome: the status class or the class of the error.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"outcome"})
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fedinfo_upstream_errors_total",
+		Help: "Failed requests to instances, by class of the error.",
+	}, []string{"class"})
+	storeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fedinfo_cache_store_errors_total",
+		Help: "Failed operations of the cache store, by operation: load, get or put.",
+	}, []string{"op"})
+	canarySuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fedinfo_canary_success",
+		Help: "Whether the last canary lookup succeeded (1) or failed (0).",
+	})
+	canaryLastRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fedinfo_canary_last_run_timestamp_seconds",
+		Help: "Unix time of the last canary lookup.",
+	})
+)
+
+func init() {
+	metrics.MustRegister(
+		requestsTotal,
+		requestDuration,
+		cacheLookups,
+		lookupDuration,
+		upstreamDuration,
+		upstreamErrors,
+		storeErrors,
+		canarySuccess,
+		canaryLastRun,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "fedinfo_cache_entries",
+			Help: "Number of cached entries, stale or not.",
+		}, func() float64 { return float64(cache.Len()) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+var metricsHandler = promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+
+func metricsRoute(w http.ResponseWriter, r *http.Request) error {
+	metricsHandler.ServeHTTP(w, r)
+	return nil
+}
+
+// instrumentRoute counts the requests to route and how long they took.
+func instrumentRoute(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		requestsTotal.WithLabelValues(route, strconv.Itoa(rec.status)).Inc()
+		requestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	})
+}
+
+func observeCache(domain string, result fedinfo.CacheResult) {
+	cacheLookups.WithLabelValues(string(result)).Inc()
+}
+
+func observeCanary(status CanaryStatus) {
+	canaryLastRun.Set(float64(status.LastCheck.Unix()))
+	if status.Healthy {
+		canarySuccess.Set(1)
+	} else {
+		canarySuccess.Set(0)
+	}
+}
+
+func observeLookup(domain string, start time.Time, info fedinfo.NodeInfo, err error) {
+	outcome := fedinfo.ErrorClass(err)
+	if err == nil {
+		outcome = "unresolved"
+		if info.Software.IsResolved() {
+			outcome = "resolved"
+		}
+	}
+	lookupDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
+
+// metricsTransport records the duration and failures of requests to
+// instances.
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	outcome := fedinfo.ErrorClass(err)
+	if err != nil {
+		upstreamErrors.WithLabelValues(outcome).Inc()
+	} else {
+		outcome = strconv.Itoa(resp.StatusCode/100) + "xx"
+	}
+	upstreamDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// metricsStore counts the errors of a cache store.
+type metricsStore struct {
+	fedinfo.CacheStore
+}
+
+func (s metricsStore) Load(ctx context.Context) (fedinfo.CacheFile, error) {
+	file, err := s.CacheStore.Load(ctx)
+	if err != nil {
+		storeErrors.WithLabelValues("load").Inc()
+	}
+	return file, err
+}
+
+func (s metricsStore) Get(ctx context.Context, key string) (info fedinfo.NodeInfo, age time.Time, found bool, err error) {
+	info, age, found, err = s.CacheStore.Get(ctx, key)
+	if err != nil {
+		storeErrors.WithLabelValues("get").Inc()
+	}
+	return info, age, found, err
+}
+
+func (s metricsStore) Put(ctx context.Context, file fedinfo.CacheFile) error {
+	err := s.CacheStore.Put(ctx, file)
+	if err != nil {
+		storeErrors.WithLabelValues("put").Inc()
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentRoute(t *testing.T) {
+	handler := instrumentRoute("GET /test-instrument", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "teapot", http.StatusTeapot)
+	}))
+	for range 2 {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test-instrument", nil))
+	}
+	if n := testutil.ToFloat64(requestsTotal.WithLabelValues("GET /test-instrument", "418")); n != 2 {
+		t.Errorf("got %v requests counted, want 2", n)
+	}
+
+	w := httptest.NewRecorder()
+	HandlerWithError(metricsRoute).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `fedinfo_http_requests_total{route="GET /test-instrument",status="418"} 2`) {
+		t.Errorf("metrics are missing the counted requests:\n%s", w.Body)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var out strings.Builder
+	handler := AccessLog(&out, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/node-info?domain=example.social", nil)
+	r.RemoteAddr = "203.0.113.7:51234"
+	r.Header.Set("User-Agent", "curl/8.5.0")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	line := out.String()
+	for _, want := range []string{
+		`203.0.113.7 - - [`,
+		`"GET /node-info?domain=example.social HTTP/1.1" 200 5 "-" "curl/8.5.0" `,
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("got %q, want it to contain %q", line, want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+type ObjectResponse struct {
+	URL string `json:"url"`
+	// Domain is the host of the object url.
+	Domain string `json:"domain"`
+	// ServerDomain is the domain of the server actually hosting the
+	// instance, if discovery found it to differ from Domain.
+	ServerDomain string `json:"serverDomain,omitempty"`
+	Instance fedinfo.NodeInfo `json:"instance"`
+}
+
+// objectRoute resolves the instance hosting an ActivityPub object, given its
+// url, e.g. https://example.social/users/alice/statuses/123.
+func objectRoute(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	objectUrl := r.Form.Get("url")
+	if objectUrl == "" {
+		return ErrMissingParam("url")
+	}
+	domain, err := parseObjectURL(objectUrl)
+	if err != nil {
+		return err
+	}
+	info, err := client.Lookup(r.Context(), domain)
+	if errors.Is(err, fedinfo.ErrLookupTimeout) {
+		info.Warnings = append(slices.Clip(info.Warnings), err.Error())
+	} else if err != nil {
+		return err
+	}
+	stripOptionalFields(r, &info)
+	response := ObjectResponse{
+		URL: objectUrl,
+		Domain: domain,
+		ServerDomain: info.ServerDomain,
+		Instance: info,
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseObjectURL returns the domain of the instance serving objectUrl. Like
+// the domain parameter, it may not carry credentials or a port, instances
+// are always queried over https on the default port.
+func parseObjectURL(objectUrl string) (domain string, err error) {
+	parsedUrl, err := url.Parse(objectUrl)
+	if err != nil || (parsedUrl.Scheme != "https" && parsedUrl.Scheme != "http") || parsedUrl.User != nil || !fedinfo.IsPublicHostname(parsedUrl.Hostname()) {
+		return "", ErrBadRequest(fmt.Sprintf("not an object url: %s", objectUrl))
+	}
+	if parsedUrl.Port() != "" {
+		return "", ErrBadRequest(fmt.Sprintf("expected an object url without port: %s", objectUrl))
+	}
+	return strings.ToLower(parsedUrl.Hostname()), nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+type (
+	// Route describes an endpoint of the api. The mux is populated from
+	// apiRoutes, and the OpenAPI document is generated from the same
+	// table, so that the two can't drift apart.
+	Route struct {
+		Method string
+		Path string
+		Summary string
+		Handler HandlerWithError
+		Admin bool
+		Params []Param
+		// Request, if set, is a value of the type expected as json body.
+		Request any
+		// Response is a value of the type returned on success.
+		Response any
+		// ContentType of the response, if not json. The response is then
+		// described as plain string.
+		ContentType string
+		Status int
+	}
+	Param struct {
+		Name string
+		In string // query or path
+		Description string
+		Required bool
+		Type string
+		Repeated bool
+	}
+)
+
+func apiRoutes() []Route {
+	domain := Param{Name: "domain", In: "query", Required: true, Type: "string", Description: "domain of the instance"}
+	flag := func(name, description string) Param {
+		return Param{Name: name, In: "query", Type: "boolean", Description: description}
+	}
+	common := []Param{
+		flag("alwaysOK", "report errors with status 200 and an error object in the body"),
+	}
+	// see stripOptionalFields
+	optional := []Param{
+		flag("languages", "include the instance languages"),
+		flag("since", "include when the instance was created"),
+		flag("peers_count", "include the number of known peers"),
+	}
+	return []Route{
+		{
+			Method: http.MethodGet, Path: "/node-info", Summary: "Look up the software of an instance", Handler: nodeInfoRoute,
+			Params: append([]Param{
+				domain,
+				{Name: "maxAge", In: "query", Type: "string", Description: "only accept cached results younger than this duration, e.g. 5m"},
+				{Name: "format", In: "query", Type: "string", Description: "json (default) or protobuf"},
+				{Name: "homograph", In: "query", Type: "string", Description: "warn or strict"},
+				{Name: "ifVersionNot", In: "query", Type: "string", Description: "respond with 304 Not Modified if the instance runs this version"},
+				flag("refresh", "look the instance up again even if it recently failed, subject to a cooldown per domain"),
+				flag("strict", "validate the current nodeinfo document against the schema, instances without one fail"),
+				flag("cleanversion", "include a version without build metadata"),
+			}, append(optional, common...)...),
+			Response: fedinfo.NodeInfo{},
+		},
+		{
+			Method: http.MethodPost, Path: "/node-info/batch", Summary: "Look up the software of many instances or handles", Handler: batchRoute,
+			Params: append([]Param{
+				{Name: "format", In: "query", Type: "string", Description: "json (default) or protobuf"},
+			}, append(optional, common...)...),
+			Request: BatchRequest{},
+			Response: []BatchEntry{},
+		},
+		{
+			Method: http.MethodGet, Path: "/resolve", Summary: "Resolve a handle's actor and instance software", Handler: resolveRoute,
+			Params: append([]Param{{Name: "handle", In: "query", Required: true, Type: "string", Description: "user@domain"}}, append(optional, common...)...),
+			Response: ResolveResponse{},
+		},
+		{
+			Method: http.MethodGet, Path: "/webfinger", Summary: "Look up an account via WebFinger", Handler: webFingerRoute,
+			Params: append([]Param{{Name: "resource", In: "query", Required: true, Type: "string", Description: "acct:user@domain, user@domain, or the https url of the account"}}, common...),
+			Response: fedinfo.Account{},
+		},
+		{
+			Method: http.MethodGet, Path: "/peers", Summary: "List the peers of an instance", Handler: peersRoute,
+			Params: append([]Param{domain, flag("resolve", "look up the nodeinfo of all peers in the background, requires the admin token")}, common...),
+			Response: PeersResponse{},
+		},
+		{
+			Method: http.MethodGet, Path: "/object", Summary: "Look up the instance hosting an ActivityPub object", Handler: objectRoute,
+			Params: append([]Param{{Name: "url", In: "query", Required: true, Type: "string", Description: "url of the object"}}, append(optional, common...)...),
+			Response: ObjectResponse{},
+		},
+		{
+			Method: http.MethodGet, Path: "/domains", Summary: "List cached instances", Handler: domainsRoute,
+			Params: append([]Param{
+				{Name: "software", In: "query", Type: "string", Repeated: true, Description: "only list instances of this software family"},
+				{Name: "offset", In: "query", Type: "integer"},
+				{Name: "limit", In: "query", Type: "integer"},
+			}, append(optional, common...)...),
+			Response: DomainsResponse{},
+		},
+		{
+			Method: http.MethodGet, Path: "/instances", Summary: "List instances found by the crawler", Handler: instancesRoute,
+			Params: append([]Param{
+				{Name: "software", In: "query", Type: "string", Repeated: true, Description: "only list instances of these software families"},
+				{Name: "offset", In: "query", Type: "integer"},
+				{Name: "limit", In: "query", Type: "integer", Description: "at most 1000, defaults to 100"},
+			}, append(optional, common...)...),
+			Response: InstancesResponse{},
+		},
+		{
+			Method: http.MethodGet, Path: "/badge", Summary: "Render a badge with the software and version of an instance", Handler: badgeRoute,
+			Params: append([]Param{
+				domain,
+				{Name: "format", In: "query", Type: "string", Description: "svg (default), or json for a shields.io endpoint badge"},
+			}, common...),
+			ContentType: "image/svg+xml",
+		},
+		{
+			Method: http.MethodGet, Path: "/marketshare", Summary: "Share of each software among cached instances", Handler: marketShareRoute,
+			Params: append([]Param{
+				{Name: "weight", In: "query", Type: "string", Description: "instances (default) or users"},
+			}, common...),
+			Response: MarketShareResponse{},
+		},
+		{
+			Method: http.MethodGet, Path: "/healthz", Summary: "Report service health", Handler: healthRoute,
+			Response: HealthResponse{},
+		},
+		{
+			Method: http.MethodGet, Path: "/openapi.json", Summary: "This document", Handler: openAPIRoute,
+			Response: map[string]any{},
+		},
+		{
+			Method: http.MethodGet, Path: "/metrics", Summary: "Prometheus metrics", Handler: metricsRoute,
+			ContentType: "text/plain",
+		},
+		{
+			Method: http.MethodPost, Path: "/refresh-all", Summary: "Refresh all cached entries in the background", Handler: refreshAllRoute, Admin: true,
+			Params: common,
+			Response: RefreshJob{},
+			Status: http.StatusAccepted,
+		},
+		{
+			Method: http.MethodGet, Path: "/refresh-all/{id}", Summary: "Report the progress of a refresh job", Handler: refreshJobRoute, Admin: true,
+			Params: append([]Param{{Name: "id", In: "path", Required: true, Type: "string"}}, common...),
+			Response: RefreshJob{},
+		},
+		{
+			Method: http.MethodGet, Path: "/history", Summary: "List the recent lookups of a domain", Handler: historyRoute, Admin: true,
+			Params: append([]Param{domain}, common...),
+			Response: []HistoryEntry{},
+		},
+	}
+}
+
+func (route Route) Pattern() string {
+	return route.Method + " " + route.Path
+}
+
+func (route Route) HTTPHandler() http.Handler {
+	var handler http.Handler = route.Handler
+	if route.Admin {
+		handler = RequireAdmin(route.Handler)
+	}
+	return instrumentRoute(route.Pattern(), handler)
+}
+
+// newMux serves all of apiRoutes.
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, route := range apiRoutes() {
+		mux.Handle(route.Pattern(), route.HTTPHandler())
+	}
+	return mux
+}
+
+func openAPIRoute(w http.ResponseWriter, r *http.Request) error {
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(openAPIDocument(apiRoutes())); err != nil {
+		return err
+	}
+	return nil
+}
+
+// openAPIDocument builds an OpenAPI 3 description of routes, deriving the
+// response schemas from the Go types via their json tags.
+func openAPIDocument(routes []Route) map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]any{}
+	for _, route := range routes {
+		var params []any
+		for _, param := range route.Params {
+			schema := map[string]any{"type": param.Type}
+			if param.Repeated {
+				schema = map[string]any{"type": "array", "items": schema}
+			}
+			p := map[string]any{
+				"name": param.Name,
+				"in": param.In,
+				"required": param.Required,
+				"schema": schema,
+			}
+			if param.Description != "" {
+				p["description"] = param.Description
+			}
+			params = append(params, p)
+		}
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		var content map[string]any
+		if route.ContentType != "" {
+			content = map[string]any{
+				route.ContentType: map[string]any{"schema": map[string]any{"type": "string"}},
+			}
+		} else {
+			content = map[string]any{
+				"application/json": map[string]any{"schema": jsonSchema(reflect.TypeOf(route.Response), schemas)},
+			}
+		}
+		responses := map[string]any{
+			strconv.Itoa(status): map[string]any{
+				"description": http.StatusText(status),
+				"content": content,
+			},
+			"default": map[string]any{
+				"description": "error, as plain text, or with alwaysOK=true as an error object with status 200",
+				"content": map[string]any{
+					"text/plain": map[string]any{"schema": map[string]any{"type": "string"}},
+					"application/json": map[string]any{"schema": jsonSchema(reflect.TypeOf(ErrorBody{}), schemas)},
+				},
+			},
+		}
+		operation := map[string]any{
+			"summary": route.Summary,
+			"responses": responses,
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if route.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": jsonSchema(reflect.TypeOf(route.Request), schemas)},
+				},
+			}
+		}
+		if route.Admin {
+			operation["security"] = []any{map[string]any{"adminToken": []any{}}}
+		}
+		item, ok := paths[route.Path].(map[string]any)
+		if !ok {
+			item = map[string]any{}
+			paths[route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title": "fedinfo",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"adminToken": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema describes how encoding/json serializes t. Named struct types
+// are added to schemas and referenced.
+func jsonSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := jsonSchema(t.Elem(), schemas)
+		if _, isRef := schema["$ref"]; isRef {
+			return map[string]any{"allOf": []any{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 { // json.RawMessage and []byte
+			return map[string]any{}
+		}
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; ok {
+			return ref
+		}
+		schemas[t.Name()] = nil // guard against recursive types
+		properties := map[string]any{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = jsonSchema(field.Type, schemas)
+			if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]any{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		schemas[t.Name()] = schema
+		return ref
+	}
+	return map[string]any{}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cvanloo/go-fedi-info/admin"
+)
+
+// routeTarget fills the path parameters of route in.
+func routeTarget(route Route) string {
+	return strings.NewReplacer("{id}", "1").Replace(route.Path)
+}
+
+func TestMuxServesAllRoutes(t *testing.T) {
+	mux := newMux()
+	for _, route := range apiRoutes() {
+		r := httptest.NewRequest(route.Method, routeTarget(route), nil)
+		if _, pattern := mux.Handler(r); pattern != route.Pattern() {
+			t.Errorf("%s: got pattern %q", route.Pattern(), pattern)
+		}
+	}
+}
+
+func TestAdminRoutesRequireToken(t *testing.T) {
+	defer func(authorizer admin.Authorizer) { adminAuthorizer = authorizer }(adminAuthorizer)
+	adminAuthorizer = admin.StaticToken{Token: "secret"}
+	mux := newMux()
+	paths := openAPIDocument(apiRoutes())["paths"].(map[string]any)
+	for _, route := range apiRoutes() {
+		operation := paths[route.Path].(map[string]any)[strings.ToLower(route.Method)].(map[string]any)
+		if _, secured := operation["security"]; secured != route.Admin {
+			t.Errorf("%s: got security requirement: %t, want %t", route.Pattern(), secured, route.Admin)
+		}
+		if !route.Admin {
+			continue
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(route.Method, routeTarget(route), nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got status %d without a token, want %d", route.Pattern(), w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	w := httptest.NewRecorder()
+	newMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	var document struct {
+		OpenAPI string `json:"openapi"`
+		Paths map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+	if document.OpenAPI == "" {
+		t.Error("openapi version is missing")
+	}
+	for _, route := range apiRoutes() {
+		if _, ok := document.Paths[route.Path][strings.ToLower(route.Method)]; !ok {
+			t.Errorf("%s is not documented", route.Pattern())
+		}
+	}
+	for _, name := range []string{"NodeInfo", "Software", "ErrorBody"} {
+		if document.Components.Schemas[name] == nil {
+			t.Errorf("schema %s is missing", name)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/textproto"
+)
+
+// reservedOutboundHeaders are managed by the http client itself and can't be
+// overridden through OUTBOUND_HEADERS.
+var reservedOutboundHeaders = []string{
+	"Host",
+	"Content-Length",
+	"Transfer-Encoding",
+	"Connection",
+	"Keep-Alive",
+	"Upgrade",
+	"Te",
+	"Trailer",
+	"Proxy-Connection",
+	"Proxy-Authorization",
+}
+
+// headerTransport adds static headers to every outbound request that
+// doesn't already set them.
+type headerTransport struct {
+	headers http.Header
+	next http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		if _, ok := req.Header[name]; !ok {
+			req.Header[name] = values
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// parseOutboundHeaders reads a json object of header names to values, e.g.
+//
+//	{"From": "admin@example.com", "Accept": "application/json"}
+func parseOutboundHeaders(data string) (http.Header, error) {
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, err
+	}
+	headers := http.Header{}
+	for name, value := range raw {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		for _, reserved := range reservedOutboundHeaders {
+			if name == reserved {
+				return nil, fmt.Errorf("header %s is reserved and can't be set", name)
+			}
+		}
+		headers.Set(name, value)
+	}
+	return headers, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log/slog"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/cvanloo/go-fedi-info/admin"
+)
+
+type PeersResponse struct {
+	Domain string `json:"domain"`
+	Peers []string `json:"peers"`
+	Truncated bool `json:"truncated,omitempty"`
+	Resolving int `json:"resolving,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// resolvingPeers is set while the peers of an instance are resolved in the
+// background. Only one instance is resolved at a time.
+var resolvingPeers atomic.Bool
+
+// ErrResolveBusy is returned for resolve=true while the peers of another
+// instance are still being resolved.
+type ErrResolveBusy struct{}
+
+func (e ErrResolveBusy) Error() string {
+	return "already resolving the peers of an instance, try again later"
+}
+
+func (e ErrResolveBusy) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	status := http.StatusConflict
+	http.Error(w, e.Error(), status)
+	return true
+}
+
+func (e ErrResolveBusy) StatusCode() int {
+	return http.StatusConflict
+}
+
+// peersRoute returns the instances a Mastodon-compatible server federates
+// with. With resolve=true, which is restricted to admins, the nodeinfo of
+// every peer not yet in the cache is looked up in the background to warm it.
+func peersRoute(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	domain := r.Form.Get("domain")
+	if domain == "" {
+		return ErrMissingParam("domain")
+	}
+	domain, warning, err := parseDomainParam(domain)
+	if err != nil {
+		return err
+	}
+	resolve, _ := strconv.ParseBool(r.Form.Get("resolve"))
+	started := false
+	if resolve {
+		// warming the cache with hundreds of lookups is for operators only
+		if err := admin.Check(adminAuthorizer, r); err != nil {
+			return err
+		}
+		if !resolvingPeers.CompareAndSwap(false, true) {
+			return ErrResolveBusy{}
+		}
+		defer func() {
+			if !started {
+				resolvingPeers.Store(false)
+			}
+		}()
+	}
+	peers, truncated, err := client.Peers(r.Context(), domain)
+	if err != nil {
+		return err
+	}
+	response := PeersResponse{
+		Domain: domain,
+		Peers: peers,
+		Truncated: truncated,
+	}
+	if warning != "" {
+		response.Warnings = append(response.Warnings, warning)
+	}
+	if resolve {
+		var unresolved []string
+		for _, peer := range peers {
+			if _, ok := cache.Get(peer); !ok {
+				unresolved = append(unresolved, peer)
+			}
+		}
+		if len(unresolved) > maxBatchSize {
+			response.Warnings = append(response.Warnings, fmt.Sprintf("only resolving %d of %d uncached peers", maxBatchSize, len(unresolved)))
+			unresolved = unresolved[:maxBatchSize]
+		}
+		response.Resolving = len(unresolved)
+		started = true
+		go resolvePeers(domain, unresolved)
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return err
+	}
+	return nil
+}
+
+// resolvePeers warms the cache with the peers of domain, like a batch lookup
+// would, and clears resolvingPeers when done.
+func resolvePeers(domain string, peers []string) {
+	defer resolvingPeers.Store(false)
+	failed := 0
+	for peer, result := range lookupAll(context.Background(), peers) {
+		if result.Error != nil {
+			failed++
+			slog.Debug("failed to resolve peer", "domain", peer, "error", result.Error.Message)
+		}
+	}
+	slog.Info("resolved peers", "domain", domain, "resolved", len(peers)-failed, "failed", failed)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cvanloo/go-fedi-info/admin"
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+func TestPeersResolveRequiresAdmin(t *testing.T) {
+	defer func(authorizer admin.Authorizer) { adminAuthorizer = authorizer }(adminAuthorizer)
+	adminAuthorizer = admin.StaticToken{Token: "secret"}
+	r := httptest.NewRequest(http.MethodGet, "/peers?domain=example.social&resolve=true", nil)
+	w := httptest.NewRecorder()
+	HandlerWithError(peersRoute).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestPeersResolveOneAtATime(t *testing.T) {
+	defer func(authorizer admin.Authorizer) { adminAuthorizer = authorizer }(adminAuthorizer)
+	adminAuthorizer = admin.StaticToken{Token: "secret"}
+	resolvingPeers.Store(true)
+	defer resolvingPeers.Store(false)
+	r := httptest.NewRequest(http.MethodGet, "/peers?domain=example.social&resolve=true", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	HandlerWithError(peersRoute).ServeHTTP(w, r)
+	if w.Code != http.StatusConflict {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestNodeInfoPeerCountCached(t *testing.T) {
+	counter := &hitCounter{next: fixtures{
+		"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+		"example.test/nodeinfo/2.0": mastodonNodeInfo,
+		"example.test/api/v1/instance": `{"uri": "example.test", "stats": {"domain_count": 4321}}`,
+	}}
+	useTestServer(t, counter)
+	for range 2 {
+		w := httptest.NewRecorder()
+		HandlerWithError(nodeInfoRoute).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/node-info?domain=example.test&peers_count=true", nil))
+		var info fedinfo.NodeInfo
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		if info.PeerCount == nil || *info.PeerCount != 4321 {
+			t.Errorf("got peer count %v, want 4321", info.PeerCount)
+		}
+	}
+	if hits := counter.count("example.test/api/v1/instance"); hits != 1 {
+		t.Errorf("got %d requests for the peer count, want 1", hits)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"mime"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+// The encoders in this file implement the messages defined in nodeinfo.proto
+// and have to be kept in sync with it.
+
+const protobufContentType = "application/protobuf"
+
+// wantsProtobuf reports whether the client asked for a protobuf encoded
+// response, either via format=protobuf or the Accept header.
+func wantsProtobuf(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "protobuf"
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			return false
+		case protobufContentType, "application/x-protobuf":
+			return true
+		}
+	}
+	return false
+}
+
+func marshalSoftwareProto(sfw fedinfo.Software) (b []byte) {
+	b = appendProtoString(b, 1, sfw.Name)
+	b = appendProtoString(b, 2, sfw.Version)
+	b = appendProtoString(b, 3, sfw.VersionDisplay)
+	b = appendProtoString(b, 4, sfw.Repository)
+	b = appendProtoString(b, 5, sfw.Homepage)
+	return b
+}
+
+func marshalUsageProto(usage fedinfo.Usage) (b []byte) {
+	b = appendProtoCount(b, 1, usage.Users.Total)
+	b = appendProtoCount(b, 2, usage.Users.ActiveMonth)
+	b = appendProtoCount(b, 3, usage.Users.ActiveHalfyear)
+	b = appendProtoCount(b, 4, usage.LocalPosts)
+	b = appendProtoCount(b, 5, usage.LocalComments)
+	return b
+}
+
+func marshalServicesProto(services fedinfo.Services) (b []byte) {
+	for _, name := range services.Inbound {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, name)
+	}
+	for _, name := range services.Outbound {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, name)
+	}
+	return b
+}
+
+func marshalNodeInfoProto(info fedinfo.NodeInfo) (b []byte) {
+	b = appendProtoString(b, 1, info.Domain)
+	b = appendProtoString(b, 2, info.ServerDomain)
+	b = appendProtoString(b, 3, info.InstanceID)
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendBytes(b, marshalSoftwareProto(info.Software))
+	for _, lang := range info.Languages {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendString(b, lang)
+	}
+	if info.InstanceSince != nil {
+		b = protowire.AppendTag(b, 6, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(info.InstanceSince.Unix()))
+	}
+	for _, warning := range info.Warnings {
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendString(b, warning)
+	}
+	b = appendProtoString(b, 8, info.HomographWarning)
+	b = appendProtoCount(b, 9, info.PeerCount)
+	b = appendProtoString(b, 10, info.CanonicalDomain)
+	if info.Usage != nil {
+		b = protowire.AppendTag(b, 11, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalUsageProto(*info.Usage))
+	}
+	if info.OpenRegistrations != nil {
+		b = protowire.AppendTag(b, 12, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(*info.OpenRegistrations))
+	}
+	for _, protocol := range info.Protocols {
+		b = protowire.AppendTag(b, 13, protowire.BytesType)
+		b = protowire.AppendString(b, protocol)
+	}
+	if len(info.Metadata) > 0 {
+		if metadata, err := json.Marshal(info.Metadata); err == nil {
+			b = protowire.AppendTag(b, 14, protowire.BytesType)
+			b = protowire.AppendBytes(b, metadata)
+		}
+	}
+	if info.Services != nil {
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalServicesProto(*info.Services))
+	}
+	b = appendProtoString(b, 16, info.DiscoveryMethod)
+	return b
+}
+
+func marshalErrorProto(err ErrorObject) (b []byte) {
+	if err.Status != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(err.Status))
+	}
+	return appendProtoString(b, 2, err.Message)
+}
+
+func marshalBatchProto(entries []BatchEntry) (b []byte) {
+	for _, entry := range entries {
+		var e []byte
+		e = appendProtoString(e, 1, entry.Query)
+		if entry.Result != nil {
+			e = protowire.AppendTag(e, 2, protowire.BytesType)
+			e = protowire.AppendBytes(e, marshalNodeInfoProto(*entry.Result))
+		}
+		if entry.Error != nil {
+			e = protowire.AppendTag(e, 3, protowire.BytesType)
+			e = protowire.AppendBytes(e, marshalErrorProto(*entry.Error))
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, e)
+	}
+	return b
+}
+
+// appendProtoCount encodes an optional int64 field, omitting it if unknown.
+func appendProtoCount(b []byte, num protowire.Number, count *int) []byte {
+	if count == nil {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(*count))
+}
+
+// appendProtoString omits empty strings, as proto3 does for default values.
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+func TestWantsProtobuf(t *testing.T) {
+	for _, test := range []struct {
+		url, accept string
+		want bool
+	}{
+		{"/node-info", "", false},
+		{"/node-info", "application/json", false},
+		{"/node-info", "application/protobuf", true},
+		{"/node-info/batch", "application/x-protobuf", true},
+		{"/node-info/batch", "application/json, application/x-protobuf", false},
+		{"/node-info/batch", "text/html, application/x-protobuf;q=0.9", true},
+		{"/node-info?format=protobuf", "application/json", true},
+		{"/node-info?format=json", "application/protobuf", false},
+	} {
+		r := httptest.NewRequest(http.MethodPost, test.url, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		if got := wantsProtobuf(r); got != test.want {
+			t.Errorf("%s with Accept %q: got %v, want %v", test.url, test.accept, got, test.want)
+		}
+	}
+}
+
+func TestMarshalBatchProto(t *testing.T) {
+	entries := []BatchEntry{
+		{Query: "example.social", Result: &fedinfo.NodeInfo{Domain: "example.social", Software: fedinfo.Software{Name: "mastodon", Version: "4.3.2"}}},
+		{Query: "not a domain", Error: &ErrorObject{Status: http.StatusBadRequest, Message: "not an url"}},
+	}
+	b := marshalBatchProto(entries)
+	var queries []string
+	var results, errs int
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || num != 1 || typ != protowire.BytesType {
+			t.Fatalf("unexpected field %d of type %d", num, typ)
+		}
+		entry, m := protowire.ConsumeBytes(b[n:])
+		if m < 0 {
+			t.Fatalf("truncated entry")
+		}
+		b = b[n+m:]
+		for len(entry) > 0 {
+			num, _, n := protowire.ConsumeTag(entry)
+			value, m := protowire.ConsumeBytes(entry[n:])
+			switch num {
+			case 1:
+				queries = append(queries, string(value))
+			case 2:
+				results++
+			case 3:
+				errs++
+			}
+			entry = entry[n+m:]
+		}
+	}
+	if len(queries) != 2 || queries[0] != "example.social" || queries[1] != "not a domain" {
+		t.Errorf("got queries %q", queries)
+	}
+	if results != 1 || errs != 1 {
+		t.Errorf("got %d results and %d errors, want one of each", results, errs)
+	}
+}
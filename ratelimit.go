@@ -0,0 +1,155 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the requests per client IP with a token bucket: every
+// client may make Burst requests at once, and Rate more per second after
+// that. The number of tracked clients is bounded by MaxClients; the least
+// recently seen client is forgotten first, which only ever lets it make more
+// requests, never fewer.
+type RateLimiter struct {
+	Rate float64
+	Burst int
+	MaxClients int
+	// TrustedProxies are the addresses of reverse proxies, whose requests
+	// are attributed to the client named in X-Forwarded-For instead.
+	TrustedProxies []netip.Prefix
+	lock sync.Mutex
+	lru *list.List // of *rateBucket, most recent at the front
+	clients map[netip.Prefix]*list.Element
+}
+
+type rateBucket struct {
+	client netip.Prefix
+	tokens float64
+	last time.Time
+}
+
+// rateLimiter is nil unless RATE_LIMIT is set.
+var rateLimiter *RateLimiter
+
+// ErrRateLimited is returned when a client made too many requests, it can
+// try again after RetryAfter.
+type ErrRateLimited struct {
+	RetryAfter time.Duration
+}
+
+func (e ErrRateLimited) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry after %ds", e.seconds())
+}
+
+func (e ErrRateLimited) seconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+func (e ErrRateLimited) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Retry-After", strconv.Itoa(e.seconds()))
+	http.Error(w, e.Error(), http.StatusTooManyRequests)
+	return true
+}
+
+func (e ErrRateLimited) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+// Allow takes a token from the bucket of client. If there is none left, it
+// reports how long until there is.
+func (l *RateLimiter) Allow(client netip.Addr, now time.Time) (ok bool, retryAfter time.Duration) {
+	// an IPv6 client usually has a whole /64 to pick addresses from
+	bits := 32
+	if client.Is6() && !client.Is4In6() {
+		bits = 64
+	}
+	key, _ := client.Unmap().Prefix(bits)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.clients == nil {
+		l.lru = list.New()
+		l.clients = map[netip.Prefix]*list.Element{}
+	}
+	var bucket *rateBucket
+	if elem, ok := l.clients[key]; ok {
+		l.lru.MoveToFront(elem)
+		bucket = elem.Value.(*rateBucket)
+		bucket.tokens = min(float64(l.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.Rate)
+		bucket.last = now
+	} else {
+		bucket = &rateBucket{client: key, tokens: float64(l.Burst), last: now}
+		l.clients[key] = l.lru.PushFront(bucket)
+		for l.lru.Len() > l.MaxClients {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.clients, oldest.Value.(*rateBucket).client)
+		}
+	}
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.Rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// ClientIP returns the address of the client that made r. Requests by
+// trusted proxies are attributed to the last address in X-Forwarded-For that
+// isn't a trusted proxy itself; earlier ones could be made up by the client.
+func (l *RateLimiter) ClientIP(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return addr, err
+	}
+	addr = addr.Unmap()
+	if !l.trusted(addr) {
+		return addr, nil
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		client, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = client.Unmap()
+		if !l.trusted(addr) {
+			break
+		}
+	}
+	return addr, nil
+}
+
+func (l *RateLimiter) trusted(addr netip.Addr) bool {
+	for _, prefix := range l.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimit answers requests of clients that exceed the limits of limiter
+// with 429 Too Many Requests.
+func RateLimit(limiter *RateLimiter, next http.Handler) http.Handler {
+	return HandlerWithError(func(w http.ResponseWriter, r *http.Request) error {
+		client, err := limiter.ClientIP(r)
+		if err == nil {
+			if ok, retryAfter := limiter.Allow(client, time.Now()); !ok {
+				return ErrRateLimited{RetryAfter: retryAfter}
+			}
+		}
+		next.ServeHTTP(w, r)
+		return nil
+	})
+}
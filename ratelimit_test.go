@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefills(t *testing.T) {
+	limiter := &RateLimiter{Rate: 2, Burst: 2, MaxClients: 10}
+	client := netip.MustParseAddr("203.0.113.1")
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := limiter.Allow(client, now); ok != want {
+			t.Fatalf("request %d: got allowed %v, want %v", i, ok, want)
+		}
+	}
+	if _, retryAfter := limiter.Allow(client, now); retryAfter != 500*time.Millisecond {
+		t.Errorf("got retry after %v, want 500ms", retryAfter)
+	}
+	if ok, _ := limiter.Allow(client, now.Add(500*time.Millisecond)); !ok {
+		t.Error("denied after refill")
+	}
+	if ok, _ := limiter.Allow(netip.MustParseAddr("203.0.113.2"), now); !ok {
+		t.Error("other client is limited")
+	}
+}
+
+func TestRateLimiterBounded(t *testing.T) {
+	limiter := &RateLimiter{Rate: 0.001, Burst: 1, MaxClients: 100}
+	now := time.Now()
+	kept := netip.MustParseAddr("203.0.113.1")
+	if ok, _ := limiter.Allow(kept, now); !ok {
+		t.Fatal("first request denied")
+	}
+	for i := range 10000 {
+		client := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+		limiter.Allow(client, now)
+		if i%50 == 0 {
+			limiter.Allow(kept, now) // keep it recently used
+		}
+	}
+	if len(limiter.clients) != limiter.MaxClients || limiter.lru.Len() != limiter.MaxClients {
+		t.Fatalf("got %d clients tracked, want %d", len(limiter.clients), limiter.MaxClients)
+	}
+	if ok, _ := limiter.Allow(kept, now); ok {
+		t.Error("recently seen client was forgotten")
+	}
+	// an evicted client just starts over with a full bucket
+	if ok, _ := limiter.Allow(netip.AddrFrom4([4]byte{10, 0, 0, 0}), now); !ok {
+		t.Error("evicted client is still limited")
+	}
+}
+
+func TestRateLimiterGroupsIPv6(t *testing.T) {
+	limiter := &RateLimiter{Rate: 0.001, Burst: 1, MaxClients: 100}
+	now := time.Now()
+	if ok, _ := limiter.Allow(netip.MustParseAddr("2001:db8::1"), now); !ok {
+		t.Fatal("first request denied")
+	}
+	if ok, _ := limiter.Allow(netip.MustParseAddr("2001:db8::ffff:1"), now); ok {
+		t.Error("address from the same /64 isn't limited")
+	}
+	if ok, _ := limiter.Allow(netip.MustParseAddr("2001:db8:0:1::1"), now); !ok {
+		t.Error("address from another /64 is limited")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	limiter := &RateLimiter{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	for _, test := range []struct {
+		remote string
+		forwarded []string
+		want string
+	}{
+		{"203.0.113.1:1234", nil, "203.0.113.1"},
+		{"203.0.113.1:1234", []string{"198.51.100.1"}, "203.0.113.1"}, // untrusted, ignored
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"192.0.2.1, 198.51.100.1", "10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"[::ffff:203.0.113.1]:1234", nil, "203.0.113.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remote
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		addr, err := limiter.ClientIP(r)
+		if err != nil || addr != netip.MustParseAddr(test.want) {
+			t.Errorf("%s %q: got %v, %v, want %s", test.remote, test.forwarded, addr, err, test.want)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limiter := &RateLimiter{Rate: 0.1, Burst: 1, MaxClients: 100}
+	handler := RateLimit(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/node-info?domain=example.com", nil))
+		if w.Code != want {
+			t.Fatalf("request %d: got status %d, want %d", i, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "10" {
+			t.Errorf("request %d: got Retry-After %q, want 10", i, w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestRateLimitIgnoresAlwaysOK(t *testing.T) {
+	limiter := &RateLimiter{Rate: 1, Burst: 1, MaxClients: 10}
+	handler := RateLimit(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodGet, "/?domain=example.com&alwaysOK=true", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Fatalf("request %d: got status %d, want %d", i, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("request %d: missing Retry-After", i)
+		}
+	}
+}
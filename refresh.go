@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// refreshRate limits how many lookups per second a refresh job starts.
+	refreshRate = 5
+	// refreshConcurrency bounds the number of lookups in flight per job.
+	refreshConcurrency = 4
+	// refreshJobRetention is how long a finished job can still be polled.
+	refreshJobRetention = time.Hour
+)
+
+type RefreshJob struct {
+	ID string `json:"id"`
+	Total int `json:"total"`
+	Done int `json:"done"`
+	Failed int `json:"failed"`
+	Started time.Time `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+var refreshJobs = struct {
+	sync.RWMutex
+	jobs map[string]*RefreshJob
+	running *RefreshJob
+}{jobs: map[string]*RefreshJob{}}
+
+// refreshAllRoute starts a background job refreshing every cached domain and
+// immediately returns it. Its progress can be polled at /refresh-all/{id}.
+// While a job is running, it is returned instead of starting another.
+func refreshAllRoute(w http.ResponseWriter, r *http.Request) error {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	refreshJobs.Lock()
+	expireRefreshJobs()
+	job := refreshJobs.running
+	if job == nil {
+		snapshot := cache.Snapshot()
+		domains := make([]string, 0, len(snapshot))
+		for domain := range snapshot {
+			domains = append(domains, domain)
+		}
+		job = &RefreshJob{
+			ID: hex.EncodeToString(id[:]),
+			Total: len(domains),
+			Started: time.Now(),
+		}
+		refreshJobs.jobs[job.ID] = job
+		refreshJobs.running = job
+		go runRefreshJob(job, domains)
+	}
+	status := *job
+	refreshJobs.Unlock()
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Location", fmt.Sprintf("/refresh-all/%s", job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		return err
+	}
+	return nil
+}
+
+func refreshJobRoute(w http.ResponseWriter, r *http.Request) error {
+	refreshJobs.Lock()
+	expireRefreshJobs()
+	job, ok := refreshJobs.jobs[r.PathValue("id")]
+	var status RefreshJob
+	if ok {
+		status = *job
+	}
+	refreshJobs.Unlock()
+	if !ok {
+		http.Error(w, "no such refresh job", http.StatusNotFound)
+		return nil
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		return err
+	}
+	return nil
+}
+
+func runRefreshJob(job *RefreshJob, domains []string) {
+	ticker := time.NewTicker(time.Second / time.Duration(refreshRate))
+	defer ticker.Stop()
+	slots := make(chan struct{}, refreshConcurrency)
+	var wg sync.WaitGroup
+	for _, domain := range domains {
+		<-ticker.C
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			_, err := client.Refresh(context.Background(), domain)
+			if err != nil {
+				slog.Warn("failed to refresh", "job", job.ID, "domain", domain, "error", err)
+			}
+			refreshJobs.Lock()
+			job.Done++
+			if err != nil {
+				job.Failed++
+			}
+			refreshJobs.Unlock()
+		}()
+	}
+	wg.Wait()
+	refreshJobs.Lock()
+	defer refreshJobs.Unlock()
+	finished := time.Now()
+	job.Finished = &finished
+	refreshJobs.running = nil
+	slog.Info("refresh job finished", "job", job.ID, "refreshed", job.Done-job.Failed, "failed", job.Failed)
+}
+
+// expireRefreshJobs forgets jobs that finished more than refreshJobRetention
+// ago. refreshJobs must be locked.
+func expireRefreshJobs() {
+	for id, job := range refreshJobs.jobs {
+		if job.Finished != nil && time.Since(*job.Finished) > refreshJobRetention {
+			delete(refreshJobs.jobs, id)
+		}
+	}
+}
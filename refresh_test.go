@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+// startRefreshJob posts to /refresh-all and returns the job it responded with.
+func startRefreshJob(t *testing.T) RefreshJob {
+	t.Helper()
+	w := httptest.NewRecorder()
+	HandlerWithError(refreshAllRoute).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/refresh-all", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusAccepted)
+	}
+	var job RefreshJob
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// pollRefreshJob returns the status of job, or nil if it is unknown.
+func pollRefreshJob(t *testing.T, id string) *RefreshJob {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/refresh-all/"+id, nil)
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	HandlerWithError(refreshJobRoute).ServeHTTP(w, r)
+	if w.Code == http.StatusNotFound {
+		return nil
+	}
+	var job RefreshJob
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	return &job
+}
+
+func waitForRefreshJob(t *testing.T, id string) RefreshJob {
+	t.Helper()
+	deadline := time.Now().Add(5*time.Second)
+	for time.Now().Before(deadline) {
+		if job := pollRefreshJob(t, id); job != nil && job.Finished != nil {
+			return *job
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+	t.Fatalf("refresh job %s did not finish", id)
+	return RefreshJob{}
+}
+
+func TestRefreshJob(t *testing.T) {
+	defer func(rate int) { refreshRate = rate }(refreshRate)
+	refreshRate = 1000
+	requested, release := make(chan struct{}, 1), make(chan struct{})
+	counter := &hitCounter{next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nodeinfo/2.0" {
+			select {
+			case requested <- struct{}{}:
+			default:
+			}
+			<-release
+		}
+		fixtures{
+			"example.test/.well-known/nodeinfo": wellKnown("example.test"),
+			"example.test/nodeinfo/2.0": mastodonNodeInfo,
+		}.ServeHTTP(w, r)
+	})}
+	useTestServer(t, counter)
+	client.Store("example.test", fedinfo.NodeInfo{Domain: "example.test"})
+	client.Store("gone.test", fedinfo.NodeInfo{Domain: "gone.test"})
+
+	job := startRefreshJob(t)
+	if job.Total != 2 {
+		t.Errorf("got %d domains, want 2", job.Total)
+	}
+	<-requested
+	if joined := startRefreshJob(t); joined.ID != job.ID {
+		t.Errorf("got job %s while %s is running", joined.ID, job.ID)
+	}
+	// a lookup during the refresh shares its request
+	refreshed := make(chan error)
+	go func() {
+		_, err := client.Refresh(context.Background(), "example.test")
+		refreshed <- err
+	}()
+	time.Sleep(10*time.Millisecond)
+	close(release)
+	if err := <-refreshed; err != nil {
+		t.Error(err)
+	}
+
+	finished := waitForRefreshJob(t, job.ID)
+	if finished.Done != 2 || finished.Failed != 1 {
+		t.Errorf("got %d done, %d failed, want 2 done, 1 failed", finished.Done, finished.Failed)
+	}
+	if hits := counter.count("example.test/nodeinfo/2.0"); hits != 1 {
+		t.Errorf("got %d requests, want 1", hits)
+	}
+	if info, ok := cache.Get("example.test"); !ok || info.Software.Name != "mastodon" {
+		t.Errorf("got %+v, want the refreshed nodeinfo", info)
+	}
+
+	next := startRefreshJob(t)
+	if next.ID == job.ID {
+		t.Error("no new job was started after the first finished")
+	}
+	waitForRefreshJob(t, next.ID)
+}
+
+func TestRefreshJobExpires(t *testing.T) {
+	finished := time.Now().Add(-refreshJobRetention - time.Minute)
+	recent := time.Now()
+	refreshJobs.Lock()
+	refreshJobs.jobs["expired"] = &RefreshJob{ID: "expired", Finished: &finished}
+	refreshJobs.jobs["recent"] = &RefreshJob{ID: "recent", Finished: &recent}
+	refreshJobs.Unlock()
+	defer func() {
+		refreshJobs.Lock()
+		delete(refreshJobs.jobs, "recent")
+		refreshJobs.Unlock()
+	}()
+	if job := pollRefreshJob(t, "expired"); job != nil {
+		t.Errorf("got %+v, want the expired job to be forgotten", job)
+	}
+	if job := pollRefreshJob(t, "recent"); job == nil {
+		t.Error("recently finished job was forgotten")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// signingTransport retries requests that an instance rejected with 401,
+// signed with the configured actor key following HTTP Signatures
+// (draft-cavage-http-signatures-12), as used by Mastodon's secure mode.
+// Requests are only signed when challenged, so that instances that don't
+// require it never see our key id.
+type signingTransport struct {
+	key *rsa.PrivateKey
+	keyID string
+	next http.RoundTripper
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.Body != nil {
+		return resp, err
+	}
+	if challenge := resp.Header.Get("WWW-Authenticate"); challenge != "" && !strings.Contains(strings.ToLower(challenge), "signature") {
+		return resp, nil
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	signed := req.Clone(req.Context())
+	if err := t.sign(signed); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(signed)
+}
+
+func (t *signingTransport) sign(req *http.Request) error {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	signingString := strings.Join([]string{
+		fmt.Sprintf("(request-target): %s %s", strings.ToLower(req.Method), req.URL.RequestURI()),
+		fmt.Sprintf("host: %s", req.URL.Host),
+		fmt.Sprintf("date: %s", req.Header.Get("Date")),
+	}, "\n")
+	digest := sha256.Sum256([]byte(signingString))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, t.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="(request-target) host date",signature="%s"`,
+		t.keyID, base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+// loadSigningKey reads a PEM encoded RSA private key, in PKCS #1 or PKCS #8
+// form.
+func loadSigningKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an rsa key, got %T", key)
+	}
+	return rsaKey, nil
+}
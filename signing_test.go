@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var signatureParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// requireSignature only serves requests signed by key as keyID.
+func requireSignature(key *rsa.PublicKey, keyID string, challenge string, signed *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := map[string]string{}
+		for _, match := range signatureParam.FindAllStringSubmatch(r.Header.Get("Signature"), -1) {
+			params[match[1]] = match[2]
+		}
+		signingString := strings.Join([]string{
+			fmt.Sprintf("(request-target): %s %s", strings.ToLower(r.Method), r.URL.RequestURI()),
+			fmt.Sprintf("host: %s", r.Host),
+			fmt.Sprintf("date: %s", r.Header.Get("Date")),
+		}, "\n")
+		digest := sha256.Sum256([]byte(signingString))
+		signature, _ := base64.StdEncoding.DecodeString(params["signature"])
+		if params["keyId"] != keyID || params["headers"] != "(request-target) host date" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, "request not signed", http.StatusUnauthorized)
+			return
+		}
+		signed.Add(1)
+		w.Write([]byte("{}"))
+	})
+}
+
+func TestSigningTransport(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const keyID = "https://fedinfo.example/actor#main-key"
+	for _, test := range []struct {
+		challenge string
+		want int
+	}{
+		{`Signature realm="example.social",headers="(request-target) host date"`, http.StatusOK},
+		{"", http.StatusOK},
+		{`Bearer realm="example.social"`, http.StatusUnauthorized},
+	} {
+		var signed atomic.Int32
+		srv := httptest.NewServer(requireSignature(&key.PublicKey, keyID, test.challenge, &signed))
+		client := &http.Client{Transport: &signingTransport{key: key, keyID: keyID, next: http.DefaultTransport}}
+		resp, err := client.Get(srv.URL + "/nodeinfo/2.0?q=1")
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%q: %v", test.challenge, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%q: got status %d, want %d", test.challenge, resp.StatusCode, test.want)
+		}
+		if wantSigned := test.want == http.StatusOK; (signed.Load() == 1) != wantSigned {
+			t.Errorf("%q: got %d signed requests, want signed: %t", test.challenge, signed.Load(), wantSigned)
+		}
+	}
+
+	var signed atomic.Int32
+	srv := httptest.NewServer(requireSignature(&key.PublicKey, keyID, "Signature", &signed))
+	defer srv.Close()
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &signingTransport{key: other, keyID: keyID, next: http.DefaultTransport}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong key: got status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for name, block := range map[string]*pem.Block{
+		"pkcs1.pem": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		"pkcs8.pem": {Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadSigningKey(path)
+		if err != nil || !loaded.Equal(key) {
+			t.Errorf("%s: got %v, want the written key", name, err)
+		}
+	}
+	path := filepath.Join(dir, "garbage.pem")
+	os.WriteFile(path, []byte("not a key"), 0o600)
+	if _, err := loadSigningKey(path); err == nil {
+		t.Error("garbage: got no error")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+// cacheStores holds the constructors of the supported CACHE_STORE backends,
+// by name. The file store is always available; sqlite and redis are
+// registered when built with the respective tag.
+var cacheStores = map[string]func(url string) (fedinfo.CacheStore, error){
+	"file": func(path string) (fedinfo.CacheStore, error) {
+		return &fedinfo.JSONFileStore{Path: path, MaxEntries: cache.MaxEntries}, nil
+	},
+}
+
+func openCacheStore(name, url string) (fedinfo.CacheStore, error) {
+	open, ok := cacheStores[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cache store %q, expected one of %s", name, strings.Join(slices.Sorted(maps.Keys(cacheStores)), ", "))
+	}
+	return open(url)
+}
+
+// resolvedOnlyStore keeps the durable dataset free of entries that never
+// fully resolved.
+type resolvedOnlyStore struct {
+	fedinfo.CacheStore
+}
+
+func (s resolvedOnlyStore) Put(ctx context.Context, file fedinfo.CacheFile) error {
+	for key, info := range file.Data {
+		if !info.Software.IsResolved() {
+			delete(file.Data, key)
+			delete(file.Age, key)
+		}
+	}
+	if len(file.Data) == 0 {
+		return nil
+	}
+	return s.CacheStore.Put(ctx, file)
+}
@@ -0,0 +1,105 @@
+//go:build redis
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+	"github.com/redis/go-redis/v9"
+)
+
+func init() {
+	cacheStores["redis"] = func(url string) (fedinfo.CacheStore, error) {
+		opts, err := redis.ParseURL(url)
+		if err != nil {
+			return nil, err
+		}
+		return &RedisStore{
+			client: redis.NewClient(opts),
+			key: fmt.Sprintf("fedinfo:cache:v%d", fedinfo.CacheFileVersion),
+		}, nil
+	}
+}
+
+// RedisStore keeps all entries in a single hash, keyed by domain, and the
+// aliases in another. The format version is part of the name of the hashes,
+// so that replicas running different versions don't read each other's
+// entries.
+type RedisStore struct {
+	client *redis.Client
+	key string
+}
+
+type redisEntry struct {
+	Info fedinfo.NodeInfo `json:"info"`
+	Age time.Time `json:"age"`
+}
+
+func (s *RedisStore) Load(ctx context.Context) (fedinfo.CacheFile, error) {
+	file := fedinfo.CacheFile{Version: fedinfo.CacheFileVersion, Data: map[string]fedinfo.NodeInfo{}, Age: map[string]time.Time{}}
+	fields, err := s.client.HGetAll(ctx, s.key).Result()
+	if err != nil {
+		return file, err
+	}
+	for domain, raw := range fields {
+		var entry redisEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			return file, fmt.Errorf("%s: %w", domain, err)
+		}
+		file.Data[domain] = entry.Info
+		file.Age[domain] = entry.Age
+	}
+	file.Aliases, err = s.client.HGetAll(ctx, s.key+":aliases").Result()
+	return file, err
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (info fedinfo.NodeInfo, age time.Time, found bool, err error) {
+	raw, err := s.client.HGet(ctx, s.key, key).Bytes()
+	if err == redis.Nil {
+		return info, age, false, nil
+	}
+	if err != nil {
+		return info, age, false, err
+	}
+	var entry redisEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return info, age, false, err
+	}
+	return entry.Info, entry.Age, true, nil
+}
+
+func (s *RedisStore) Put(ctx context.Context, file fedinfo.CacheFile) error {
+	values := make([]any, 0, 2*len(file.Data))
+	for domain, info := range file.Data {
+		raw, err := json.Marshal(redisEntry{Info: info, Age: file.Age[domain]})
+		if err != nil {
+			return err
+		}
+		values = append(values, domain, raw)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	aliases := make([]any, 0, 2*len(file.Aliases))
+	for alias, domain := range file.Aliases {
+		aliases = append(aliases, alias, domain)
+	}
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, s.key, values...)
+	pipe.HDel(ctx, s.key+":aliases", slices.Collect(maps.Keys(file.Data))...)
+	if len(aliases) > 0 {
+		pipe.HSet(ctx, s.key+":aliases", aliases...)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
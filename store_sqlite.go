@@ -0,0 +1,162 @@
+//go:build sqlite
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	cacheStores["sqlite"] = func(path string) (fedinfo.CacheStore, error) {
+		return openSQLiteStore(path)
+	}
+}
+
+// SQLiteStore keeps one row per entry, so a flush only writes the entries
+// that changed, and one per alias. The format version is kept in the
+// user_version pragma.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only allows a single writer anyway
+	db.SetMaxOpenConns(1)
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if version > fedinfo.CacheFileVersion {
+		db.Close()
+		return nil, fmt.Errorf("database has version %d, but only up to %d is supported", version, fedinfo.CacheFileVersion)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS nodeinfo (
+		domain TEXT PRIMARY KEY,
+		info TEXT NOT NULL,
+		age INTEGER NOT NULL
+	)`)
+	if err == nil {
+		_, err = db.Exec(`CREATE TABLE IF NOT EXISTS alias (
+			alias TEXT PRIMARY KEY,
+			domain TEXT NOT NULL
+		)`)
+	}
+	if err == nil {
+		_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", fedinfo.CacheFileVersion))
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Load(ctx context.Context) (fedinfo.CacheFile, error) {
+	file := fedinfo.CacheFile{Version: fedinfo.CacheFileVersion, Data: map[string]fedinfo.NodeInfo{}, Age: map[string]time.Time{}}
+	rows, err := s.db.QueryContext(ctx, "SELECT domain, info, age FROM nodeinfo")
+	if err != nil {
+		return file, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			domain string
+			raw []byte
+			age int64
+			info fedinfo.NodeInfo
+		)
+		if err := rows.Scan(&domain, &raw, &age); err != nil {
+			return file, err
+		}
+		if err := json.Unmarshal(raw, &info); err != nil {
+			return file, fmt.Errorf("%s: %w", domain, err)
+		}
+		file.Data[domain] = info
+		file.Age[domain] = time.UnixMilli(age)
+	}
+	if err := rows.Err(); err != nil {
+		return file, err
+	}
+	aliases, err := s.db.QueryContext(ctx, "SELECT alias, domain FROM alias")
+	if err != nil {
+		return file, err
+	}
+	defer aliases.Close()
+	file.Aliases = map[string]string{}
+	for aliases.Next() {
+		var alias, domain string
+		if err := aliases.Scan(&alias, &domain); err != nil {
+			return file, err
+		}
+		file.Aliases[alias] = domain
+	}
+	return file, aliases.Err()
+}
+
+func (s *SQLiteStore) Get(ctx context.Context, key string) (info fedinfo.NodeInfo, age time.Time, found bool, err error) {
+	var (
+		raw []byte
+		ageMillis int64
+	)
+	err = s.db.QueryRowContext(ctx, "SELECT info, age FROM nodeinfo WHERE domain = ?", key).Scan(&raw, &ageMillis)
+	if err == sql.ErrNoRows {
+		return info, age, false, nil
+	}
+	if err != nil {
+		return info, age, false, err
+	}
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return info, age, false, err
+	}
+	return info, time.UnixMilli(ageMillis), true, nil
+}
+
+func (s *SQLiteStore) Put(ctx context.Context, file fedinfo.CacheFile) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO nodeinfo (domain, info, age) VALUES (?, ?, ?)
+		ON CONFLICT (domain) DO UPDATE SET info = excluded.info, age = excluded.age`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for domain, info := range file.Data {
+		raw, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, domain, raw, file.Age[domain].UnixMilli()); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM alias WHERE alias = ?", domain); err != nil {
+			return err
+		}
+	}
+	for alias, domain := range file.Aliases {
+		_, err := tx.ExecContext(ctx, `INSERT INTO alias (alias, domain) VALUES (?, ?)
+			ON CONFLICT (alias) DO UPDATE SET domain = excluded.domain`, alias, domain)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
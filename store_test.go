@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failingStore is a cache store that is down.
+type failingStore struct {
+	fedinfo.CacheStore
+}
+
+var errStoreDown = errors.New("connection refused")
+
+func (failingStore) Get(ctx context.Context, key string) (fedinfo.NodeInfo, time.Time, bool, error) {
+	return fedinfo.NodeInfo{}, time.Time{}, false, errStoreDown
+}
+
+func (failingStore) Put(ctx context.Context, file fedinfo.CacheFile) error {
+	return errStoreDown
+}
+
+func TestMetricsStoreCountsErrors(t *testing.T) {
+	store := metricsStore{failingStore{}}
+	before := testutil.ToFloat64(storeErrors.WithLabelValues("get"))
+	if _, _, _, err := store.Get(context.Background(), "example.social"); !errors.Is(err, errStoreDown) {
+		t.Errorf("got %v, want the error of the store", err)
+	}
+	if got := testutil.ToFloat64(storeErrors.WithLabelValues("get")); got != before+1 {
+		t.Errorf("got %g get errors, want %g", got, before+1)
+	}
+	before = testutil.ToFloat64(storeErrors.WithLabelValues("put"))
+	store.Put(context.Background(), fedinfo.CacheFile{})
+	if got := testutil.ToFloat64(storeErrors.WithLabelValues("put")); got != before+1 {
+		t.Errorf("got %g put errors, want %g", got, before+1)
+	}
+}
+
+func TestResolvedOnlyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	store := resolvedOnlyStore{&fedinfo.JSONFileStore{Path: path}}
+	cache := &fedinfo.Cache{TTL: time.Hour}
+	cache.Set("resolved.example.social", fedinfo.NodeInfo{Software: fedinfo.Software{Name: "mastodon", Version: "4.3.2"}})
+	cache.Set("unversioned.example.social", fedinfo.NodeInfo{Software: fedinfo.Software{Name: "mastodon"}})
+	cache.Set("empty.example.social", fedinfo.NodeInfo{})
+	if err := store.Put(context.Background(), cache.Dump()); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Len() != 3 {
+		t.Errorf("got %d entries in memory, want all 3", cache.Len())
+	}
+	contents, err := (&fedinfo.JSONFileStore{Path: path}).Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents.Data) != 1 || len(contents.Age) != 1 {
+		t.Errorf("got %d entries and %d ages written, want only the resolved one", len(contents.Data), len(contents.Age))
+	}
+	if _, ok := contents.Data["resolved.example.social"]; !ok {
+		t.Error("resolved entry wasn't written")
+	}
+}
+
+func TestOpenCacheStore(t *testing.T) {
+	if _, err := openCacheStore("file", filepath.Join(t.TempDir(), "cache.json")); err != nil {
+		t.Errorf("file: %v", err)
+	}
+	if _, err := openCacheStore("memcached", "localhost:11211"); err == nil {
+		t.Error("memcached: got no error for an unsupported store")
+	}
+}
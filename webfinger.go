@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+type (
+	ResolveResponse struct {
+		Handle string `json:"handle"`
+		ActorID string `json:"actorId,omitempty"`
+		Instance *fedinfo.NodeInfo `json:"instance,omitempty"`
+		Warnings []string `json:"warnings,omitempty"`
+	}
+)
+
+// resolveRoute combines a WebFinger lookup of the handle with a nodeinfo
+// lookup of its domain. If only one of them fails, the other is still
+// returned together with a warning.
+func resolveRoute(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	handle := r.Form.Get("handle")
+	if handle == "" {
+		return ErrMissingParam("handle")
+	}
+	user, domain, err := parseHandle(handle)
+	if err != nil {
+		return err
+	}
+	resolved := ResolveResponse{
+		Handle: user + "@" + domain,
+	}
+	account, wfErr := client.LookupAccount(r.Context(), domain, "acct:"+resolved.Handle)
+	if wfErr == nil {
+		resolved.ActorID = account.ActorID
+		if resolved.ActorID == "" {
+			resolved.Warnings = append(resolved.Warnings, "webfinger: no activitypub actor link")
+		}
+	} else {
+		resolved.Warnings = append(resolved.Warnings, fmt.Sprintf("webfinger: %v", wfErr))
+	}
+	info, niErr := client.Lookup(r.Context(), domain)
+	if niErr == nil {
+		stripOptionalFields(r, &info)
+		resolved.Instance = &info
+	} else {
+		if wfErr != nil {
+			return niErr
+		}
+		resolved.Warnings = append(resolved.Warnings, fmt.Sprintf("nodeinfo: %v", niErr))
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resolved); err != nil {
+		return err
+	}
+	return nil
+}
+
+// webFingerRoute looks up an account by its handle, or the url of its
+// profile, and returns what its instance knows about it.
+func webFingerRoute(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	resource := r.Form.Get("resource")
+	if resource == "" {
+		return ErrMissingParam("resource")
+	}
+	resource, domain, err := parseResource(resource)
+	if err != nil {
+		return err
+	}
+	account, err := client.LookupAccount(r.Context(), domain, resource)
+	if err != nil {
+		return err
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(account); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseResource normalizes a webfinger resource, either a handle, see
+// parseHandle, or an https url, and returns the domain to look it up on.
+func parseResource(resource string) (normalized, domain string, err error) {
+	if strings.HasPrefix(resource, "https://") {
+		parsedUrl, err := url.Parse(resource)
+		if err != nil || parsedUrl.User != nil || parsedUrl.Port() != "" || !fedinfo.IsPublicHostname(parsedUrl.Hostname()) {
+			return "", "", ErrBadRequest(fmt.Sprintf("not a resource url: %s", resource))
+		}
+		return resource, strings.ToLower(parsedUrl.Hostname()), nil
+	}
+	user, domain, err := parseHandle(resource)
+	if err != nil {
+		return "", "", err
+	}
+	return "acct:" + user + "@" + domain, domain, nil
+}
+
+// parseHandle splits a handle of the form user@domain, optionally prefixed
+// with @ or acct:.
+func parseHandle(handle string) (user, domain string, err error) {
+	handle = strings.TrimPrefix(strings.TrimPrefix(handle, "acct:"), "@")
+	user, domain, ok := strings.Cut(handle, "@")
+	if !ok || user == "" || strings.ContainsAny(user, "/?#") {
+		return "", "", ErrBadRequest(fmt.Sprintf("not a handle: %s", handle))
+	}
+	domain = strings.ToLower(domain)
+	if !fedinfo.IsPublicHostname(domain) {
+		return "", "", ErrBadRequest(fmt.Sprintf("not a valid domain: %s", domain))
+	}
+	return user, domain, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseResource(t *testing.T) {
+	for _, test := range []struct {
+		resource, normalized, domain string
+	}{
+		{"alice@Example.Social", "acct:alice@example.social", "example.social"},
+		{"@alice@example.social", "acct:alice@example.social", "example.social"},
+		{"acct:alice@example.social", "acct:alice@example.social", "example.social"},
+		{"https://Example.Social/@alice", "https://Example.Social/@alice", "example.social"},
+	} {
+		normalized, domain, err := parseResource(test.resource)
+		if err != nil || normalized != test.normalized || domain != test.domain {
+			t.Errorf("%q: got %q, %q, %v, want %q, %q", test.resource, normalized, domain, err, test.normalized, test.domain)
+		}
+	}
+	for _, invalid := range []string{
+		"alice",
+		"@example.social",
+		"alice/x@example.social",
+		"alice@localhost",
+		"alice@127.0.0.1",
+		"https://user@example.social/@alice",
+		"https://example.social:8443/@alice",
+		"http://example.social/@alice",
+	} {
+		if _, _, err := parseResource(invalid); err == nil {
+			t.Errorf("%q: got no error", invalid)
+		}
+	}
+}
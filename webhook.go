@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+type (
+	// Webhook posts a ChangeEvent to URL whenever a refresh finds that an
+	// instance's software differs from the cached one. If Secret is set,
+	// the body is signed with HMAC-SHA256 and the signature sent in the
+	// X-Fedinfo-Signature header as sha256=<hex>.
+	//
+	// Events are sent one at a time, in order, by a single worker. Events
+	// that don't fit in the queue while it is busy are dropped.
+	Webhook struct {
+		URL string
+		Secret string
+		Retries int
+		Client *http.Client
+		// QueueSize bounds the number of events waiting to be sent,
+		// DefaultWebhookQueueSize if zero.
+		QueueSize int
+		// Backoff before the first retry, doubled for every further one,
+		// a second if zero.
+		Backoff time.Duration
+		start sync.Once
+		queue chan ChangeEvent
+	}
+	ChangeEvent struct {
+		Domain string `json:"domain"`
+		Old fedinfo.Software `json:"old"`
+		New fedinfo.Software `json:"new"`
+		At time.Time `json:"at"`
+	}
+)
+
+const DefaultWebhookQueueSize = 100
+
+// OnChange queues an event if the software of domain changed, to be used as
+// the OnChange of a cache.
+func (wh *Webhook) OnChange(domain string, old, new fedinfo.NodeInfo) {
+	if old.Software == new.Software {
+		return
+	}
+	event := ChangeEvent{
+		Domain: domain,
+		Old: old.Software,
+		New: new.Software,
+		At: time.Now().UTC(),
+	}
+	wh.start.Do(func() {
+		size := wh.QueueSize
+		if size <= 0 {
+			size = DefaultWebhookQueueSize
+		}
+		wh.queue = make(chan ChangeEvent, size)
+		go wh.run()
+	})
+	select {
+	case wh.queue <- event:
+	default:
+		slog.Warn("webhook queue is full, dropping event", "domain", domain)
+	}
+}
+
+func (wh *Webhook) run() {
+	for event := range wh.queue {
+		wh.send(event)
+	}
+}
+
+func (wh *Webhook) send(event ChangeEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("failed to encode webhook event", "error", err)
+		return
+	}
+	backoff := wh.Backoff
+	if backoff <= 0 {
+		backoff = 1*time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		err := wh.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= wh.Retries {
+			slog.Warn("giving up on webhook", "domain", event.Domain, "attempts", attempt+1, "error", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (wh *Webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Fedinfo-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := wh.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cvanloo/go-fedi-info/fedinfo"
+)
+
+type webhookDelivery struct {
+	body []byte
+	signature string
+}
+
+// newWebhookReceiver records the deliveries to it, responding with the
+// statuses in turn and 200 once they run out.
+func newWebhookReceiver(t *testing.T, statuses ...int) (*httptest.Server, <-chan webhookDelivery) {
+	deliveries := make(chan webhookDelivery, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- webhookDelivery{body: body, signature: r.Header.Get("X-Fedinfo-Signature")}
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, deliveries
+}
+
+func receive(t *testing.T, deliveries <-chan webhookDelivery) webhookDelivery {
+	t.Helper()
+	select {
+	case delivery := <-deliveries:
+		return delivery
+	case <-time.After(5*time.Second):
+		t.Fatal("no webhook delivery")
+		return webhookDelivery{}
+	}
+}
+
+func TestWebhookSignsChanges(t *testing.T) {
+	srv, deliveries := newWebhookReceiver(t)
+	wh := &Webhook{URL: srv.URL, Secret: "secret", Client: srv.Client()}
+	v1 := fedinfo.NodeInfo{Software: fedinfo.Software{Name: "mastodon", Version: "4.3.1"}}
+	v2 := fedinfo.NodeInfo{Software: fedinfo.Software{Name: "mastodon", Version: "4.3.2"}}
+	wh.OnChange("unchanged.example.test", v1, v1) // not sent, or it would arrive first
+	wh.OnChange("example.test", v1, v2)
+
+	delivery := receive(t, deliveries)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(delivery.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); delivery.signature != want {
+		t.Errorf("got signature %q, want %q", delivery.signature, want)
+	}
+	var event ChangeEvent
+	if err := json.Unmarshal(delivery.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Domain != "example.test" || event.Old != v1.Software || event.New != v2.Software {
+		t.Errorf("got %+v, want the change of example.test from 4.3.1 to 4.3.2", event)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	srv, deliveries := newWebhookReceiver(t, http.StatusInternalServerError)
+	wh := &Webhook{URL: srv.URL, Retries: 1, Backoff: 10*time.Millisecond, Client: srv.Client()}
+	wh.OnChange("example.test", fedinfo.NodeInfo{}, fedinfo.NodeInfo{Software: fedinfo.Software{Name: "mastodon"}})
+	first, retry := receive(t, deliveries), receive(t, deliveries)
+	if string(first.body) != string(retry.body) {
+		t.Errorf("retried with %s, want %s", retry.body, first.body)
+	}
+	if first.signature != "" {
+		t.Errorf("got signature %q without a secret", first.signature)
+	}
+}
+
+func TestWebhookQueueBounded(t *testing.T) {
+	release := make(chan struct{})
+	srv, deliveries := newWebhookReceiver(t)
+	blocking := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.Config.Handler.ServeHTTP(w, r)
+		<-release
+	}))
+	defer blocking.Close()
+	wh := &Webhook{URL: blocking.URL, QueueSize: 1, Client: blocking.Client()}
+	changed := fedinfo.NodeInfo{Software: fedinfo.Software{Name: "mastodon"}}
+	wh.OnChange("first.example.test", fedinfo.NodeInfo{}, changed)
+	receive(t, deliveries) // the worker is busy with it
+	wh.OnChange("queued.example.test", fedinfo.NodeInfo{}, changed)
+	wh.OnChange("dropped.example.test", fedinfo.NodeInfo{}, changed)
+	close(release)
+
+	var event ChangeEvent
+	json.Unmarshal(receive(t, deliveries).body, &event)
+	if event.Domain != "queued.example.test" {
+		t.Errorf("got %s, want queued.example.test", event.Domain)
+	}
+	select {
+	case delivery := <-deliveries:
+		t.Errorf("got %s beyond the queue size", delivery.body)
+	case <-time.After(50*time.Millisecond):
+	}
+}